@@ -1,23 +1,92 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"gitlab.com/dirk.krummacker/contacts-service/internal/service"
 )
 
+// Defaults for shutting down. Load balancers get the readiness delay to notice that the service is
+// not ready anymore, and requests in flight get the drain timeout to complete.
+const (
+	defaultReadinessDelay = 5 * time.Second
+	defaultDrainTimeout   = 30 * time.Second
+)
+
 // Usage example on the command line:
 // > PORT=8080 DBHOST=localhost DBUSER=dirk DBPWD=bullo92 GIN_MODE=release GIN_LOGGING=OFF go run main.go
+//
+// The service shuts down on SIGTERM or SIGINT. It reports that it is not ready, waits for
+// READINESS_DELAY, stops accepting connections, waits up to DRAIN_TIMEOUT for the requests in
+// flight, stops the background jobs and closes the database. A second signal ends it at once.
 func main() {
-	sqlDB := service.CreateDatabase()
-	service.SetupDatabaseWrapper(sqlDB)
-	router := service.SetupHttpRouter()
 	_, err := strconv.Atoi(os.Getenv("PORT"))
 	if err != nil {
 		fmt.Println("could not parse PORT env variable", err)
 		panic(err)
 	}
-	router.Run(":" + os.Getenv("PORT"))
+	readinessDelay := readDuration("READINESS_DELAY", defaultReadinessDelay)
+	drainTimeout := readDuration("DRAIN_TIMEOUT", defaultDrainTimeout)
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
+
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	// the router reads the configuration, such as the request timeout, that the background jobs use
+	router := service.SetupHttpRouter()
+	jobs, stopJobs := context.WithCancel(context.Background())
+	service.StartTrashPurger(jobs)
+	service.StartIdempotencyKeyPurger(jobs)
+	service.StartContactCounter(jobs)
+	sinks := []service.OutboxSink{service.WebhookSink{}}
+	if strings.EqualFold(os.Getenv("EVENT_LOGGING"), "on") {
+		sinks = append(sinks, service.LogSink{})
+	}
+	service.StartOutboxDispatcher(jobs, sinks...)
+	service.StartWebhookDispatcher(jobs)
+	server := &http.Server{Addr: ":" + os.Getenv("PORT"), Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-signals.Done()
+	stopSignals()
+	fmt.Println("Shutting down.")
+	service.Drain()
+	time.Sleep(readinessDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("could not complete all requests:", err)
+		server.Close()
+	}
+	stopJobs()
+	service.CloseDatabase()
+	fmt.Println("Shut down.")
+}
+
+// readDuration returns the duration in the environment variable, or the default value if the
+// variable is not set.
+func readDuration(variable string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(variable)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		log.Fatalf("could not parse %s env variable %s", variable, value)
+	}
+	return duration
 }
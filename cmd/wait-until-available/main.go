@@ -1,38 +1,105 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"gitlab.com/dirk.krummacker/contacts-service/internal/wait"
 )
 
-// Usage example on the command line:
+// Usage examples on the command line:
 // > PORT=8080 go run main.go
+// > go run main.go -host=contacts -port=8080 -timeout=2m
+// > go run main.go -url=http://contacts:8080/readyz -json=components.database.status=up
+// > go run main.go -tcp=mysql:3306 -mysql='root:secret@tcp(mysql:3306)/test' -url=http://contacts:8080/healthz
+//
+// Without any dependency flags, the tool waits until the readiness endpoint of the service at
+// -host and -port reports that the service is ready. It exits with status 1 if a dependency is
+// not available within the timeout.
 func main() {
-	serverPort, err := strconv.Atoi(os.Getenv("PORT"))
+	var urls, tcpAddresses, mysqlDSNs []string
+	fields := make(map[string]string)
+	host := flag.String("host", "localhost", "the host of the service")
+	port := flag.String("port", os.Getenv("PORT"), "the port of the service, defaults to the PORT env variable")
+	timeout := flag.Duration("timeout", 5*time.Minute, "the time after which waiting is given up")
+	initialBackoff := flag.Duration("initial-backoff", 500*time.Millisecond, "the time to wait after the first failed check")
+	maxBackoff := flag.Duration("max-backoff", 10*time.Second, "the maximum time to wait between two checks")
+	checkTimeout := flag.Duration("check-timeout", 5*time.Second, "the time after which a single check fails")
+	statusList := flag.String("status", "200", "comma separated status codes that HTTP endpoints must respond with")
+	flag.Func("url", "an HTTP endpoint to wait for; may be repeated", func(value string) error {
+		urls = append(urls, value)
+		return nil
+	})
+	flag.Func("json", "a 'path=value' pair that the JSON of the HTTP endpoints must contain, like 'status=ready'; may be repeated", func(value string) error {
+		path, expected, found := strings.Cut(value, "=")
+		if !found || path == "" {
+			return fmt.Errorf("expected 'path=value'")
+		}
+		fields[path] = expected
+		return nil
+	})
+	flag.Func("tcp", "a 'host:port' that must accept connections; may be repeated", func(value string) error {
+		tcpAddresses = append(tcpAddresses, value)
+		return nil
+	})
+	flag.Func("mysql", "the data source name of a MySQL database that must answer; may be repeated", func(value string) error {
+		mysqlDSNs = append(mysqlDSNs, value)
+		return nil
+	})
+	flag.Parse()
+
+	statuses, err := parseStatuses(*statusList)
 	if err != nil {
-		fmt.Println("could not parse PORT env variable", err)
-		panic(err)
-	}
-	requestURL := fmt.Sprintf("http://localhost:%d/contacts", serverPort)
-	totalWaitTime := 0
-	for {
-		res, err := http.Get(requestURL) // nosemgrep
-		if err != nil {
-			fmt.Printf("Received error: %s", err.Error())
-			fmt.Println()
-		} else {
-			fmt.Printf("Received status code: %d", res.StatusCode)
-			fmt.Println()
-			if res.StatusCode == http.StatusNotFound {
-				break
-			}
+		fmt.Fprintln(os.Stderr, "could not parse -status flag:", err)
+		os.Exit(2)
+	}
+	if len(urls) == 0 && len(tcpAddresses) == 0 && len(mysqlDSNs) == 0 {
+		if _, err := strconv.Atoi(*port); err != nil {
+			fmt.Fprintln(os.Stderr, "could not parse port of the service, set -port or the PORT env variable")
+			os.Exit(2)
+		}
+		urls = append(urls, fmt.Sprintf("http://%s:%s/readyz", *host, *port))
+	}
+	var dependencies []wait.Dependency
+	for _, url := range urls {
+		dependencies = append(dependencies, wait.HTTPEndpoint{URL: url, Statuses: statuses, Fields: fields})
+	}
+	for _, address := range tcpAddresses {
+		dependencies = append(dependencies, wait.TCPPort{Address: address})
+	}
+	for _, dsn := range mysqlDSNs {
+		dependencies = append(dependencies, wait.MySQL{DSN: dsn})
+	}
+
+	waiter := wait.Waiter{
+		Backoff:      wait.Backoff{Initial: *initialBackoff, Max: *maxBackoff},
+		CheckTimeout: *checkTimeout,
+		Log: func(format string, args ...any) {
+			fmt.Printf(format+"\n", args...)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := waiter.Wait(ctx, dependencies...); err != nil {
+		fmt.Fprintf(os.Stderr, "Gave up waiting after %s: %s\n", *timeout, err)
+		os.Exit(1)
+	}
+}
+
+// parseStatuses parses a comma separated list of HTTP status codes.
+func parseStatuses(value string) ([]int, error) {
+	var statuses []int
+	for _, part := range strings.Split(value, ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid status code '%s'", part)
 		}
-		totalWaitTime += 5
-		fmt.Printf("Waiting in total %d seconds...", totalWaitTime)
-		fmt.Println()
-		time.Sleep(5 * time.Second)
+		statuses = append(statuses, status)
 	}
+	return statuses, nil
 }
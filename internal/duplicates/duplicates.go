@@ -0,0 +1,246 @@
+// Package duplicates provides functions to find contacts that probably describe the same person.
+//
+// Contacts are compared by their normalized names, phone numbers and birthdays. Names are
+// compared with the Jaro-Winkler similarity, so that typos and missing letters still match.
+// Phone numbers and birthdays either match or they do not. Each pair of contacts gets a score
+// between 0 and 1, which is the weighted average of the similarities of those properties that are
+// present in both contacts.
+package duplicates
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Weights of the contact properties in the score.
+const (
+	nameWeight     = 0.5
+	phoneWeight    = 0.3
+	birthdayWeight = 0.2
+)
+
+// phoneDigits is the number of trailing digits of a phone number that are compared. This ignores
+// differences in the notation of country codes and trunk prefixes.
+const phoneDigits = 9
+
+// minPhoneDigits is the minimum number of digits a phone number must have to be compared.
+const minPhoneDigits = 6
+
+// maxBlockSize is the maximum number of contacts sharing a blocking key that are compared with
+// each other. Larger blocks, for example for very common names, are skipped because comparing
+// all pairs would take too long.
+const maxBlockSize = 500
+
+// Group is a set of contacts that probably describe the same person. The confidence is the
+// lowest score of the matches that connect the contacts of the group.
+type Group struct {
+	Confidence float64         `json:"confidence"`
+	Contacts   []model.Contact `json:"contacts"`
+}
+
+// Match is a contact that probably describes the same person as another contact.
+type Match struct {
+	Confidence float64       `json:"confidence"`
+	Contact    model.Contact `json:"contact"`
+}
+
+// normalized holds the normalized properties of a contact.
+type normalized struct {
+	firstName string
+	lastName  string
+	phone     string
+	birthday  string
+}
+
+// Score returns the probability between 0 and 1 that both contacts describe the same person.
+// Contacts without any name are never considered duplicates.
+func Score(a model.Contact, b model.Contact) float64 {
+	return score(normalize(a), normalize(b))
+}
+
+// FindGroups compares all contacts with each other and returns the groups of contacts whose
+// scores reach the threshold. The groups with the highest confidence come first.
+func FindGroups(contacts []model.Contact, threshold float64) []Group {
+	normalizedContacts := make([]normalized, len(contacts))
+	blocks := make(map[string][]int)
+	for i, contact := range contacts {
+		normalizedContacts[i] = normalize(contact)
+		for _, key := range blockingKeys(normalizedContacts[i]) {
+			blocks[key] = append(blocks[key], i)
+		}
+	}
+
+	groups := newUnionFind(len(contacts))
+	for _, block := range blocks {
+		if len(block) > maxBlockSize {
+			continue
+		}
+		for i := 0; i < len(block); i++ {
+			for j := i + 1; j < len(block); j++ {
+				s := score(normalizedContacts[block[i]], normalizedContacts[block[j]])
+				if s >= threshold {
+					groups.union(block[i], block[j], s)
+				}
+			}
+		}
+	}
+
+	members := make(map[int][]model.Contact)
+	for i, contact := range contacts {
+		root := groups.find(i)
+		members[root] = append(members[root], contact)
+	}
+	var result []Group
+	for root, contactsOfGroup := range members {
+		if len(contactsOfGroup) < 2 {
+			continue
+		}
+		sort.Slice(contactsOfGroup, func(i, j int) bool { return contactsOfGroup[i].Id < contactsOfGroup[j].Id })
+		result = append(result, Group{Confidence: round(groups.confidence[root]), Contacts: contactsOfGroup})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Confidence != result[j].Confidence {
+			return result[i].Confidence > result[j].Confidence
+		}
+		return result[i].Contacts[0].Id < result[j].Contacts[0].Id
+	})
+	return result
+}
+
+// FindMatches compares the candidate with each of the contacts and returns those whose scores
+// reach the threshold. The best matches come first.
+func FindMatches(candidate model.Contact, contacts []model.Contact, threshold float64) []Match {
+	normalizedCandidate := normalize(candidate)
+	var matches []Match
+	for _, contact := range contacts {
+		s := score(normalizedCandidate, normalize(contact))
+		if s >= threshold {
+			matches = append(matches, Match{Confidence: round(s), Contact: contact})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Confidence > matches[j].Confidence })
+	return matches
+}
+
+// score returns the weighted average of the similarities of the properties that are present in
+// both contacts.
+func score(a normalized, b normalized) float64 {
+	nameA := strings.TrimSpace(a.firstName + " " + a.lastName)
+	nameB := strings.TrimSpace(b.firstName + " " + b.lastName)
+	if nameA == "" || nameB == "" {
+		return 0
+	}
+	swappedB := strings.TrimSpace(b.lastName + " " + b.firstName)
+	nameSimilarity := max(jaroWinkler(nameA, nameB), jaroWinkler(nameA, swappedB))
+
+	total := nameWeight * nameSimilarity
+	weights := nameWeight
+	if a.phone != "" && b.phone != "" {
+		weights += phoneWeight
+		if a.phone == b.phone {
+			total += phoneWeight
+		}
+	}
+	if a.birthday != "" && b.birthday != "" {
+		weights += birthdayWeight
+		if a.birthday == b.birthday {
+			total += birthdayWeight
+		}
+	}
+	return total / weights
+}
+
+// blockingKeys returns the keys of the blocks the contact is sorted into. Only contacts that share
+// at least one block are compared with each other.
+func blockingKeys(contact normalized) []string {
+	var keys []string
+	if contact.phone != "" {
+		keys = append(keys, "phone:"+contact.phone)
+	}
+	if contact.lastName != "" {
+		keys = append(keys, "name:"+prefix(contact.lastName, 3)+"/"+prefix(contact.firstName, 1))
+		keys = append(keys, "name:"+prefix(contact.firstName, 3)+"/"+prefix(contact.lastName, 1))
+		if contact.birthday != "" {
+			keys = append(keys, "birthday:"+contact.birthday+"/"+prefix(contact.lastName, 1))
+		}
+	} else if contact.firstName != "" {
+		keys = append(keys, "name:"+prefix(contact.firstName, 3)+"/")
+	}
+	return keys
+}
+
+// normalize converts the properties of a contact into a form in which they can be compared.
+func normalize(contact model.Contact) normalized {
+	var result normalized
+	if contact.FirstName != nil {
+		result.firstName = normalizeName(*contact.FirstName)
+	}
+	if contact.LastName != nil {
+		result.lastName = normalizeName(*contact.LastName)
+	}
+	if contact.Phone != nil {
+		result.phone = normalizePhone(*contact.Phone)
+	}
+	if contact.Birthday != nil {
+		result.birthday = contact.Birthday.Format("2006-01-02")
+	}
+	return result
+}
+
+// normalizeName converts a name to lower case, removes accents and all characters other than
+// letters, and collapses whitespace.
+func normalizeName(name string) string {
+	withoutAccents, _, err := transform.String(
+		transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), name)
+	if err != nil {
+		withoutAccents = name
+	}
+	withoutAccents = strings.ReplaceAll(withoutAccents, "ß", "ss")
+	var builder strings.Builder
+	for _, r := range strings.ToLower(withoutAccents) {
+		if unicode.IsLetter(r) {
+			builder.WriteRune(r)
+		} else if unicode.IsSpace(r) || r == '-' {
+			builder.WriteRune(' ')
+		}
+	}
+	return strings.Join(strings.Fields(builder.String()), " ")
+}
+
+// normalizePhone keeps the trailing digits of a phone number. Phone numbers with too few digits
+// are not compared and result in an empty string.
+func normalizePhone(phone string) string {
+	var digits []rune
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) < minPhoneDigits {
+		return ""
+	}
+	if len(digits) > phoneDigits {
+		digits = digits[len(digits)-phoneDigits:]
+	}
+	return string(digits)
+}
+
+// prefix returns the first n runes of the string.
+func prefix(str string, n int) string {
+	r := []rune(str)
+	if len(r) > n {
+		r = r[:n]
+	}
+	return string(r)
+}
+
+// round rounds the score to three decimal places.
+func round(score float64) float64 {
+	return float64(int(score*1000+0.5)) / 1000
+}
@@ -0,0 +1,97 @@
+package duplicates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// contact creates a contact with the specified values. Empty strings result in nil values.
+func contact(id int64, firstname string, lastname string, phone string, birthday string) model.Contact {
+	result := model.Contact{Id: id}
+	if firstname != "" {
+		result.FirstName = &firstname
+	}
+	if lastname != "" {
+		result.LastName = &lastname
+	}
+	if phone != "" {
+		result.Phone = &phone
+	}
+	if birthday != "" {
+		date, _ := time.Parse("2006-01-02", birthday)
+		result.Birthday = &date
+	}
+	return result
+}
+
+// TestNormalizeName verifies that names are compared without case, accents and punctuation.
+func TestNormalizeName(t *testing.T) {
+	assert.Equal(t, "jurgen muller", normalizeName("  Jürgen   MÜLLER "))
+	assert.Equal(t, "hans peter", normalizeName("Hans-Peter"))
+	assert.Equal(t, "strasse", normalizeName("Straße"))
+	assert.Equal(t, "obrien", normalizeName("O'Brien"))
+}
+
+// TestNormalizePhone verifies that phone numbers are compared by their trailing digits, and that
+// short phone numbers are ignored.
+func TestNormalizePhone(t *testing.T) {
+	assert.Equal(t, "815471100", normalizePhone("+49 (0)815 4711-00"))
+	assert.Equal(t, "815471100", normalizePhone("0815 471100"))
+	assert.Equal(t, "", normalizePhone("0815"))
+}
+
+// TestScore verifies the scores of several pairs of contacts.
+func TestScore(t *testing.T) {
+	erika := contact(1, "Erika", "Mustermann", "+49 815 471100", "1969-03-02")
+	assert.Equal(t, 1.0, Score(erika, contact(2, "erika", "MUSTERMANN", "0815 471100", "1969-03-02")))
+	assert.Equal(t, 1.0, Score(erika, contact(2, "Mustermann", "Erika", "", "")))
+	assert.Greater(t, Score(erika, contact(2, "Erika", "Musterman", "0815 471100", "")), 0.9)
+	assert.Less(t, Score(erika, contact(2, "Erika", "Mustermann", "0170 999999", "1980-01-01")), 0.6)
+	assert.Equal(t, 0.0, Score(erika, contact(2, "", "", "+49 815 471100", "1969-03-02")))
+}
+
+// TestFindGroups verifies that contacts are grouped transitively, that contacts below the
+// threshold are not grouped, and that the groups are sorted by confidence.
+func TestFindGroups(t *testing.T) {
+	contacts := []model.Contact{
+		contact(1, "Erika", "Mustermann", "+49 815 471100", "1969-03-02"),
+		contact(2, "Rudi", "Völler", "", "1960-04-13"),
+		contact(3, "Erika", "Musterman", "0815 471100", ""),
+		contact(4, "Rudi", "Voeller", "", "1960-04-13"),
+		contact(5, "Erika", "Mustermann", "", ""),
+		contact(6, "Hans", "Wurst", "", ""),
+	}
+	groups := FindGroups(contacts, 0.9)
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, []int64{1, 3, 5}, ids(groups[0].Contacts))
+	assert.Equal(t, []int64{2, 4}, ids(groups[1].Contacts))
+	assert.GreaterOrEqual(t, groups[0].Confidence, groups[1].Confidence)
+	assert.GreaterOrEqual(t, groups[1].Confidence, 0.9)
+}
+
+// TestFindMatches verifies that only contacts that reach the threshold are returned, best match
+// first.
+func TestFindMatches(t *testing.T) {
+	contacts := []model.Contact{
+		contact(1, "Erika", "Musterfrau", "", ""),
+		contact(2, "Erika", "Mustermann", "", ""),
+		contact(3, "Hans", "Wurst", "", ""),
+	}
+	matches := FindMatches(contact(0, "Erika", "Mustermann", "", ""), contacts, 0.85)
+	assert.Equal(t, 2, len(matches))
+	assert.Equal(t, int64(2), matches[0].Contact.Id)
+	assert.Equal(t, 1.0, matches[0].Confidence)
+	assert.Equal(t, int64(1), matches[1].Contact.Id)
+}
+
+// ids returns the ids of the contacts.
+func ids(contacts []model.Contact) []int64 {
+	var result []int64
+	for _, c := range contacts {
+		result = append(result, c.Id)
+	}
+	return result
+}
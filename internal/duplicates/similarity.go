@@ -0,0 +1,97 @@
+package duplicates
+
+// jaroWinkler returns the Jaro-Winkler similarity of two strings, a value between 0 (completely
+// different) and 1 (equal). Strings with a common prefix are considered more similar.
+func jaroWinkler(a string, b string) float64 {
+	runesA, runesB := []rune(a), []rune(b)
+	jaro := jaroSimilarity(runesA, runesB)
+	commonPrefix := 0
+	for commonPrefix < 4 && commonPrefix < len(runesA) && commonPrefix < len(runesB) &&
+		runesA[commonPrefix] == runesB[commonPrefix] {
+		commonPrefix++
+	}
+	return jaro + float64(commonPrefix)*0.1*(1-jaro)
+}
+
+// jaroSimilarity returns the Jaro similarity of two rune slices.
+func jaroSimilarity(a []rune, b []rune) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	matchDistance := max(len(a), len(b))/2 - 1
+	matchedA := make([]bool, len(a))
+	matchedB := make([]bool, len(b))
+	matches := 0
+	for i := range a {
+		from := max(0, i-matchDistance)
+		to := min(len(b), i+matchDistance+1)
+		for j := from; j < to; j++ {
+			if !matchedB[j] && a[i] == b[j] {
+				matchedA[i] = true
+				matchedB[j] = true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+	transpositions := 0
+	j := 0
+	for i := range a {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if a[i] != b[j] {
+			transpositions++
+		}
+		j++
+	}
+	m := float64(matches)
+	return (m/float64(len(a)) + m/float64(len(b)) + (m-float64(transpositions)/2)/m) / 3
+}
+
+// unionFind keeps track of the groups that contacts belong to. Every group also remembers the
+// lowest score of the matches that connect its contacts.
+type unionFind struct {
+	parent     []int
+	confidence []float64
+}
+
+// newUnionFind creates a unionFind in which each of the n contacts is in its own group.
+func newUnionFind(n int) *unionFind {
+	groups := &unionFind{parent: make([]int, n), confidence: make([]float64, n)}
+	for i := range groups.parent {
+		groups.parent[i] = i
+		groups.confidence[i] = 1
+	}
+	return groups
+}
+
+// find returns the representative of the group that contact i belongs to.
+func (groups *unionFind) find(i int) int {
+	for groups.parent[i] != i {
+		groups.parent[i] = groups.parent[groups.parent[i]]
+		i = groups.parent[i]
+	}
+	return i
+}
+
+// union merges the groups of contacts i and j, which match with the specified score.
+func (groups *unionFind) union(i int, j int, score float64) {
+	rootI := groups.find(i)
+	rootJ := groups.find(j)
+	if rootI == rootJ {
+		return
+	}
+	confidence := min(groups.confidence[rootI], groups.confidence[rootJ], score)
+	groups.parent[rootJ] = rootI
+	groups.confidence[rootI] = confidence
+}
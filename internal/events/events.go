@@ -0,0 +1,131 @@
+// Package events provides an in-process bus that distributes changes of contacts to subscribers.
+//
+// Every published event carries an id that the publisher assigns, and that identifies the event
+// on the buses of all instances of the service alike. The bus keeps the most recent events, so that
+// subscribers that lost their connection, even to another instance, can resume where they left off.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// Types of events.
+const (
+	Created = "created"
+	Updated = "updated"
+	Deleted = "deleted"
+)
+
+// subscriberBuffer is the number of events that can be queued for a subscriber. Subscribers that
+// fall further behind are dropped, and must resubscribe.
+const subscriberBuffer = 256
+
+// Event describes a change of a contact. Id is unique, and higher for events that were written
+// later; it is the id of the event in the outbox. Contact is the contact after the change, or nil
+// if the contact was deleted. Key identifies the change; an event may be delivered more than once, but
+// always with the same key. TenantId is the tenant of the contact and Owner its owner; they are not
+// sent to clients, which only receive the events of the contacts that they may see.
+type Event struct {
+	Id        int64          `json:"id"`
+	Key       string         `json:"key,omitempty"`
+	TenantId  string         `json:"-"`
+	Owner     string         `json:"-"`
+	Type      string         `json:"type"`
+	ContactId int64          `json:"contact_id"`
+	Contact   *model.Contact `json:"contact,omitempty"`
+	Time      time.Time      `json:"time"`
+}
+
+// Subscription receives the events published on a bus. The channel C is closed when the
+// subscription ends, either because it was cancelled or because the subscriber fell behind.
+type Subscription struct {
+	C  <-chan Event
+	ch chan Event
+}
+
+// Bus distributes events to subscribers. The zero value is not usable; use NewBus instead.
+type Bus struct {
+	mutex       sync.Mutex
+	lastId      int64
+	history     []Event
+	historySize int
+	subscribers map[*Subscription]struct{}
+}
+
+// NewBus creates a bus that keeps the specified number of recent events for resuming
+// subscribers.
+func NewBus(historySize int) *Bus {
+	return &Bus{historySize: historySize, subscribers: make(map[*Subscription]struct{})}
+}
+
+// Publish sends the event to all subscribers. It never blocks; subscribers that cannot keep up are
+// dropped.
+func (bus *Bus) Publish(event Event) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.lastId = max(bus.lastId, event.Id)
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	bus.history = append(bus.history, event)
+	if len(bus.history) > bus.historySize {
+		bus.history = bus.history[len(bus.history)-bus.historySize:]
+	}
+	for subscription := range bus.subscribers {
+		select {
+		case subscription.ch <- event:
+		default:
+			bus.unsubscribe(subscription)
+		}
+	}
+}
+
+// Subscribe starts a subscription for all events published from now on. If resume is true, the
+// subscription also returns the recent events with higher ids than the specified id. The second
+// return value is false if some of those events are no longer available, or not available yet, in
+// which case the subscriber has missed events and must catch up by other means. Since ids are not
+// contiguous, the events are only known to be complete if the bus still holds an event with the
+// specified id or a lower one.
+func (bus *Bus) Subscribe(afterId int64, resume bool) (*Subscription, []Event, bool) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	ch := make(chan Event, subscriberBuffer)
+	subscription := &Subscription{C: ch, ch: ch}
+	bus.subscribers[subscription] = struct{}{}
+	if !resume {
+		return subscription, nil, true
+	}
+
+	if afterId > bus.lastId {
+		// the event was published on another bus, which this one did not catch up with
+		return subscription, nil, false
+	}
+	complete := afterId == bus.lastId
+	var missed []Event
+	for _, event := range bus.history {
+		if event.Id > afterId {
+			missed = append(missed, event)
+		} else {
+			complete = true
+		}
+	}
+	return subscription, missed, complete
+}
+
+// Unsubscribe ends the subscription and closes its channel. It is safe to call it more than once.
+func (bus *Bus) Unsubscribe(subscription *Subscription) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.unsubscribe(subscription)
+}
+
+// unsubscribe ends the subscription. The caller must hold the mutex.
+func (bus *Bus) unsubscribe(subscription *Subscription) {
+	if _, found := bus.subscribers[subscription]; found {
+		delete(bus.subscribers, subscription)
+		close(subscription.ch)
+	}
+}
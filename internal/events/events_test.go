@@ -0,0 +1,81 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPublishAndSubscribe verifies that subscribers receive the events published after they
+// subscribed, with their ids.
+func TestPublishAndSubscribe(t *testing.T) {
+	bus := NewBus(10)
+	bus.Publish(Event{Id: 1, Type: Created, ContactId: 1})
+	subscription, missed, complete := bus.Subscribe(0, false)
+	defer bus.Unsubscribe(subscription)
+	assert.Nil(t, missed)
+	assert.True(t, complete)
+
+	bus.Publish(Event{Id: 2, Type: Updated, ContactId: 1})
+	bus.Publish(Event{Id: 3, Type: Deleted, ContactId: 2})
+	first := <-subscription.C
+	second := <-subscription.C
+	assert.Equal(t, int64(2), first.Id)
+	assert.Equal(t, Updated, first.Type)
+	assert.False(t, first.Time.IsZero())
+	assert.Equal(t, int64(3), second.Id)
+	assert.Equal(t, int64(2), second.ContactId)
+}
+
+// TestResume verifies that resuming subscribers receive the events they missed, and are told if
+// some of them are no longer available. The ids have gaps, as the ids of the outbox do.
+func TestResume(t *testing.T) {
+	bus := NewBus(3)
+	for i := 1; i <= 5; i++ {
+		bus.Publish(Event{Id: int64(i), Type: Updated, ContactId: int64(i)})
+	}
+	bus.Publish(Event{Id: 8, Type: Updated, ContactId: 8})
+
+	subscription, missed, complete := bus.Subscribe(4, true)
+	bus.Unsubscribe(subscription)
+	assert.True(t, complete)
+	assert.Equal(t, 2, len(missed))
+	assert.Equal(t, int64(5), missed[0].Id)
+	assert.Equal(t, int64(8), missed[1].Id)
+
+	// the gap of a rolled back event does not matter
+	subscription, missed, complete = bus.Subscribe(6, true)
+	bus.Unsubscribe(subscription)
+	assert.True(t, complete)
+	assert.Equal(t, 1, len(missed))
+
+	subscription, missed, complete = bus.Subscribe(8, true)
+	bus.Unsubscribe(subscription)
+	assert.True(t, complete)
+	assert.Equal(t, 0, len(missed))
+
+	subscription, missed, complete = bus.Subscribe(2, true)
+	bus.Unsubscribe(subscription)
+	assert.False(t, complete)
+	assert.Equal(t, 3, len(missed))
+
+	subscription, _, complete = bus.Subscribe(99, true)
+	bus.Unsubscribe(subscription)
+	assert.False(t, complete)
+}
+
+// TestSlowSubscriber verifies that a subscriber that does not keep up is dropped instead of
+// blocking the publisher.
+func TestSlowSubscriber(t *testing.T) {
+	bus := NewBus(1)
+	subscription, _, _ := bus.Subscribe(0, false)
+	for i := 0; i <= subscriberBuffer; i++ {
+		bus.Publish(Event{Id: int64(i), Type: Created, ContactId: int64(i)})
+	}
+	received := 0
+	for range subscription.C {
+		received++
+	}
+	assert.Equal(t, subscriberBuffer, received)
+	bus.Unsubscribe(subscription) // must not panic
+}
@@ -6,6 +6,7 @@ import (
 	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -182,7 +183,6 @@ func TestUpdateContactInvalidBody(t *testing.T) {
 
 	invalidRequestBodies := []string{
 		"",
-		"{}",
 		"not JSON",
 		`{
 			"firstname": "Erika"
@@ -203,7 +203,7 @@ func TestUpdateContactInvalidBody(t *testing.T) {
 }
 
 // TestUpdateContactPartially tests a PUT with only one field specified in the JSON. It verifies
-// that the other fields are still nil.
+// that the other fields are nil.
 func TestUpdateContactPartially(t *testing.T) {
 	sqlDB := service.CreateDatabase()
 	service.SetupDatabaseWrapper(sqlDB)
@@ -238,6 +238,592 @@ func TestUpdateContactPartially(t *testing.T) {
 	deleteContact(t, router, idAsString)
 }
 
+// TestPatchContact tests a PATCH with a JSON Merge Patch and a PATCH with a JSON Patch. It
+// verifies that only the patched fields are changed.
+func TestPatchContact(t *testing.T) {
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	postRecorder := httptest.NewRecorder()
+	postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`
+		{
+			"firstname": "Erika",
+			"lastname": "Mustermann",
+			"phone": "+49 0815 4711",
+			"birthday": "1969-03-02T00:00:00Z"
+		}
+	`))
+	router.ServeHTTP(postRecorder, postRequest)
+	assert.Equal(t, http.StatusCreated, postRecorder.Code)
+	var postBody map[string]interface{}
+	json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+	idAsFloat64 := postBody["id"]
+	idAsString := fmt.Sprintf("%.0f", idAsFloat64)
+
+	mergeRecorder := httptest.NewRecorder()
+	mergeRequest, _ := http.NewRequest("PATCH", "/contacts/"+idAsString, strings.NewReader(`
+		{
+			"phone": null,
+			"birthday": "1970-05-06T00:00:00Z"
+		}
+	`))
+	mergeRequest.Header.Set("Content-Type", "application/merge-patch+json")
+	router.ServeHTTP(mergeRecorder, mergeRequest)
+	assert.Equal(t, http.StatusOK, mergeRecorder.Code)
+	var mergeBody map[string]interface{}
+	json.Unmarshal(mergeRecorder.Body.Bytes(), &mergeBody)
+	assert.Equal(t, "Erika", mergeBody["firstname"])
+	assert.Equal(t, "Mustermann", mergeBody["lastname"])
+	assert.Nil(t, mergeBody["phone"])
+	assert.Equal(t, "1970-05-06T00:00:00Z", mergeBody["birthday"])
+
+	jsonPatchRecorder := httptest.NewRecorder()
+	jsonPatchRequest, _ := http.NewRequest("PATCH", "/contacts/"+idAsString, strings.NewReader(`
+		[
+			{"op": "test", "path": "/lastname", "value": "Mustermann"},
+			{"op": "replace", "path": "/lastname", "value": "Musterfrau"}
+		]
+	`))
+	jsonPatchRequest.Header.Set("Content-Type", "application/json-patch+json")
+	router.ServeHTTP(jsonPatchRecorder, jsonPatchRequest)
+	assert.Equal(t, http.StatusOK, jsonPatchRecorder.Code)
+	var jsonPatchBody map[string]interface{}
+	json.Unmarshal(jsonPatchRecorder.Body.Bytes(), &jsonPatchBody)
+	assert.Equal(t, "Erika", jsonPatchBody["firstname"])
+	assert.Equal(t, "Musterfrau", jsonPatchBody["lastname"])
+	assert.Nil(t, jsonPatchBody["phone"])
+	assert.Equal(t, "1970-05-06T00:00:00Z", jsonPatchBody["birthday"])
+
+	// clean up after the test
+	deleteContact(t, router, idAsString)
+}
+
+// TestUpdateContactVersionConflict tests two PUTs that both refer to the same version of the
+// contact. It verifies that the second PUT is rejected and that a GET with the current ETag does
+// not return the contact again.
+func TestUpdateContactVersionConflict(t *testing.T) {
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	postRecorder := httptest.NewRecorder()
+	postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`))
+	router.ServeHTTP(postRecorder, postRequest)
+	assert.Equal(t, http.StatusCreated, postRecorder.Code)
+	etag := postRecorder.Header().Get("ETag")
+	var postBody map[string]interface{}
+	json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+	idAsString := fmt.Sprintf("%.0f", postBody["id"])
+
+	firstRecorder := httptest.NewRecorder()
+	firstRequest, _ := http.NewRequest("PUT", "/contacts/"+idAsString, strings.NewReader(`{"firstname": "Rudi"}`))
+	firstRequest.Header.Set("If-Match", etag)
+	router.ServeHTTP(firstRecorder, firstRequest)
+	assert.Equal(t, http.StatusOK, firstRecorder.Code)
+	assert.NotEqual(t, etag, firstRecorder.Header().Get("ETag"))
+
+	secondRecorder := httptest.NewRecorder()
+	secondRequest, _ := http.NewRequest("PUT", "/contacts/"+idAsString, strings.NewReader(`{"firstname": "Hans"}`))
+	secondRequest.Header.Set("If-Match", etag)
+	router.ServeHTTP(secondRecorder, secondRequest)
+	assert.Equal(t, http.StatusPreconditionFailed, secondRecorder.Code)
+
+	getRecorder := httptest.NewRecorder()
+	getRequest, _ := http.NewRequest("GET", "/contacts/"+idAsString, nil)
+	getRequest.Header.Set("If-None-Match", firstRecorder.Header().Get("ETag"))
+	router.ServeHTTP(getRecorder, getRequest)
+	assert.Equal(t, http.StatusNotModified, getRecorder.Code)
+
+	// clean up after the test
+	deleteContact(t, router, idAsString)
+}
+
+// TestDeleteAndRestoreContact tests that a deleted contact is moved to the trash, that it can no
+// longer be found, and that it can be restored from the trash.
+func TestDeleteAndRestoreContact(t *testing.T) {
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	postRecorder := httptest.NewRecorder()
+	postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`))
+	router.ServeHTTP(postRecorder, postRequest)
+	assert.Equal(t, http.StatusCreated, postRecorder.Code)
+	var postBody map[string]interface{}
+	json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+	idAsFloat64 := postBody["id"]
+	idAsString := fmt.Sprintf("%.0f", idAsFloat64)
+
+	deleteContact(t, router, idAsString)
+
+	getRecorder := httptest.NewRecorder()
+	getRequest, _ := http.NewRequest("GET", "/contacts/"+idAsString, nil)
+	router.ServeHTTP(getRecorder, getRequest)
+	assert.Equal(t, http.StatusNotFound, getRecorder.Code)
+
+	trashRecorder := httptest.NewRecorder()
+	trashRequest, _ := http.NewRequest("GET", "/contacts/trash?limit=1", nil)
+	router.ServeHTTP(trashRecorder, trashRequest)
+	assert.Equal(t, http.StatusOK, trashRecorder.Code)
+	var trashBody []map[string]interface{}
+	json.Unmarshal(trashRecorder.Body.Bytes(), &trashBody)
+	assert.Equal(t, 1, len(trashBody))
+	assert.Equal(t, idAsFloat64, trashBody[0]["id"])
+	assert.NotNil(t, trashBody[0]["deleted_at"])
+
+	restoreRecorder := httptest.NewRecorder()
+	restoreRequest, _ := http.NewRequest("POST", "/contacts/"+idAsString+"/restore", nil)
+	router.ServeHTTP(restoreRecorder, restoreRequest)
+	assert.Equal(t, http.StatusOK, restoreRecorder.Code)
+	var restoreBody map[string]interface{}
+	json.Unmarshal(restoreRecorder.Body.Bytes(), &restoreBody)
+	assert.Equal(t, "Erika", restoreBody["firstname"])
+	assert.Nil(t, restoreBody["deleted_at"])
+
+	// clean up after the test
+	deleteContact(t, router, idAsString)
+}
+
+// TestContactHistory tests that creating, updating and deleting a contact is recorded in the
+// history of the contact, together with the actor and the request id.
+func TestContactHistory(t *testing.T) {
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	postRecorder := httptest.NewRecorder()
+	postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`))
+	postRequest.Header.Set("X-Actor", "alice")
+	router.ServeHTTP(postRecorder, postRequest)
+	assert.Equal(t, http.StatusCreated, postRecorder.Code)
+	var postBody map[string]interface{}
+	json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+	idAsString := fmt.Sprintf("%.0f", postBody["id"])
+
+	putRecorder := httptest.NewRecorder()
+	putRequest, _ := http.NewRequest("PUT", "/contacts/"+idAsString, strings.NewReader(`{"firstname": "Rudi"}`))
+	putRequest.Header.Set("X-Actor", "bob")
+	putRequest.Header.Set("X-Request-ID", "history-test")
+	router.ServeHTTP(putRecorder, putRequest)
+	assert.Equal(t, http.StatusOK, putRecorder.Code)
+
+	deleteContact(t, router, idAsString)
+
+	historyRecorder := httptest.NewRecorder()
+	historyRequest, _ := http.NewRequest("GET", "/contacts/"+idAsString+"/history", nil)
+	router.ServeHTTP(historyRecorder, historyRequest)
+	assert.Equal(t, http.StatusOK, historyRecorder.Code)
+	var entries []model.AuditEntry
+	json.Unmarshal(historyRecorder.Body.Bytes(), &entries)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, "create", entries[0].Action)
+	assert.Equal(t, "alice", entries[0].Actor)
+	assert.Nil(t, entries[0].Before)
+	assert.Equal(t, "update", entries[1].Action)
+	assert.Equal(t, "bob", entries[1].Actor)
+	assert.Equal(t, "history-test", entries[1].RequestId)
+	assert.Equal(t, "Erika", *entries[1].Before.FirstName)
+	assert.Equal(t, "Rudi", *entries[1].After.FirstName)
+	assert.Equal(t, "delete", entries[2].Action)
+	assert.Nil(t, entries[2].After)
+}
+
+// TestRevertContact tests that a contact can be looked up as it was before an update, and that it
+// can be reverted to the revision before the update.
+func TestRevertContact(t *testing.T) {
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	postRecorder := httptest.NewRecorder()
+	postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Erika", "phone": "0815"}`))
+	router.ServeHTTP(postRecorder, postRequest)
+	assert.Equal(t, http.StatusCreated, postRecorder.Code)
+	var postBody map[string]interface{}
+	json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+	idAsString := fmt.Sprintf("%.0f", postBody["id"])
+
+	// the audit log has microsecond precision, so make sure that the update happens later
+	time.Sleep(10 * time.Millisecond)
+	asOf := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(10 * time.Millisecond)
+
+	putRecorder := httptest.NewRecorder()
+	putRequest, _ := http.NewRequest("PUT", "/contacts/"+idAsString, strings.NewReader(`{"firstname": "Rudi"}`))
+	router.ServeHTTP(putRecorder, putRequest)
+	assert.Equal(t, http.StatusOK, putRecorder.Code)
+
+	asOfRecorder := httptest.NewRecorder()
+	asOfRequest, _ := http.NewRequest("GET", "/contacts/"+idAsString+"?as_of="+url.QueryEscape(asOf), nil)
+	router.ServeHTTP(asOfRecorder, asOfRequest)
+	assert.Equal(t, http.StatusOK, asOfRecorder.Code)
+	var asOfBody map[string]interface{}
+	json.Unmarshal(asOfRecorder.Body.Bytes(), &asOfBody)
+	assert.Equal(t, "Erika", asOfBody["firstname"])
+	assert.Equal(t, "0815", asOfBody["phone"])
+
+	revertRecorder := httptest.NewRecorder()
+	revertRequest, _ := http.NewRequest("POST", "/contacts/"+idAsString+"/revert?to=1", nil)
+	router.ServeHTTP(revertRecorder, revertRequest)
+	assert.Equal(t, http.StatusOK, revertRecorder.Code)
+	var revertBody map[string]interface{}
+	json.Unmarshal(revertRecorder.Body.Bytes(), &revertBody)
+	assert.Equal(t, "Erika", revertBody["firstname"])
+	assert.Equal(t, "0815", revertBody["phone"])
+	assert.Equal(t, 3.0, revertBody["version"])
+
+	// clean up after the test
+	deleteContact(t, router, idAsString)
+}
+
+// TestDuplicateContacts tests that a contact that probably already exists is reported when it is
+// created, that it is listed among the duplicates, and that it is rejected in strict mode.
+func TestDuplicateContacts(t *testing.T) {
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	firstRecorder := httptest.NewRecorder()
+	firstRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Quirinus", "lastname": "Zwetschkenbaum", "phone": "+49 815 471100"}`))
+	router.ServeHTTP(firstRecorder, firstRequest)
+	assert.Equal(t, http.StatusCreated, firstRecorder.Code)
+	var firstBody map[string]interface{}
+	json.Unmarshal(firstRecorder.Body.Bytes(), &firstBody)
+	firstId := fmt.Sprintf("%.0f", firstBody["id"])
+
+	secondRecorder := httptest.NewRecorder()
+	secondRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "quirinus", "lastname": "Zwetschenbaum", "phone": "0815 471100"}`))
+	router.ServeHTTP(secondRecorder, secondRequest)
+	assert.Equal(t, http.StatusCreated, secondRecorder.Code)
+	assert.Contains(t, secondRecorder.Header().Get("Warning"), "probable duplicate of contacts "+firstId)
+	var secondBody map[string]interface{}
+	json.Unmarshal(secondRecorder.Body.Bytes(), &secondBody)
+	secondId := fmt.Sprintf("%.0f", secondBody["id"])
+
+	duplicatesRecorder := httptest.NewRecorder()
+	duplicatesRequest, _ := http.NewRequest("GET", "/contacts/duplicates", nil)
+	router.ServeHTTP(duplicatesRecorder, duplicatesRequest)
+	assert.Equal(t, http.StatusOK, duplicatesRecorder.Code)
+	var groups []struct {
+		Confidence float64         `json:"confidence"`
+		Contacts   []model.Contact `json:"contacts"`
+	}
+	json.Unmarshal(duplicatesRecorder.Body.Bytes(), &groups)
+	found := false
+	for _, group := range groups {
+		for _, contact := range group.Contacts {
+			if fmt.Sprint(contact.Id) == firstId {
+				found = len(group.Contacts) >= 2
+			}
+		}
+	}
+	assert.True(t, found)
+
+	t.Setenv("DUPLICATE_CHECK", "strict")
+	strictRouter := service.SetupHttpRouter()
+	strictRecorder := httptest.NewRecorder()
+	strictRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Zwetschkenbaum", "lastname": "Quirinus"}`))
+	strictRouter.ServeHTTP(strictRecorder, strictRequest)
+	assert.Equal(t, http.StatusConflict, strictRecorder.Code)
+
+	// clean up after the test
+	deleteContact(t, router, firstId)
+	deleteContact(t, router, secondId)
+}
+
+// TestMergeContacts tests that two contacts can be merged, that the loser is moved to the trash,
+// and that the merge is recorded in the history of both contacts.
+func TestMergeContacts(t *testing.T) {
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	var ids []string
+	for _, body := range []string{`{"firstname": "Erika"}`, `{"firstname": "Erika Maria", "phone": "0815"}`} {
+		postRecorder := httptest.NewRecorder()
+		postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(body))
+		router.ServeHTTP(postRecorder, postRequest)
+		assert.Equal(t, http.StatusCreated, postRecorder.Code)
+		var postBody map[string]interface{}
+		json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+		ids = append(ids, fmt.Sprintf("%.0f", postBody["id"]))
+	}
+
+	mergeRecorder := httptest.NewRecorder()
+	mergeRequest, _ := http.NewRequest("POST", "/contacts/merge", strings.NewReader(
+		`{"survivor": `+ids[0]+`, "losers": [`+ids[1]+`], "rules": {"firstname": "longest", "phone": "first_non_null"}}`))
+	router.ServeHTTP(mergeRecorder, mergeRequest)
+	assert.Equal(t, http.StatusOK, mergeRecorder.Code)
+	var mergeBody map[string]interface{}
+	json.Unmarshal(mergeRecorder.Body.Bytes(), &mergeBody)
+	assert.Equal(t, "Erika Maria", mergeBody["firstname"])
+	assert.Equal(t, "0815", mergeBody["phone"])
+	assert.Equal(t, 2.0, mergeBody["version"])
+
+	getRecorder := httptest.NewRecorder()
+	getRequest, _ := http.NewRequest("GET", "/contacts/"+ids[1], nil)
+	router.ServeHTTP(getRecorder, getRequest)
+	assert.Equal(t, http.StatusNotFound, getRecorder.Code)
+
+	historyRecorder := httptest.NewRecorder()
+	historyRequest, _ := http.NewRequest("GET", "/contacts/"+ids[1]+"/history", nil)
+	router.ServeHTTP(historyRecorder, historyRequest)
+	assert.Equal(t, http.StatusOK, historyRecorder.Code)
+	var entries []model.AuditEntry
+	json.Unmarshal(historyRecorder.Body.Bytes(), &entries)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "merge", entries[1].Action)
+	assert.Equal(t, ids[0], fmt.Sprint(entries[1].MergedIds[0]))
+
+	// clean up after the test
+	deleteContact(t, router, ids[0])
+}
+
+// TestCreateContactIdempotencyKey tests that a repeated POST with the same Idempotency-Key header
+// returns the contact created by the first request, and that the key cannot be used for another
+// contact.
+func TestCreateContactIdempotencyKey(t *testing.T) {
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+	key := fmt.Sprintf("integration-test-%d", time.Now().UnixNano())
+
+	var ids []string
+	for range 2 {
+		postRecorder := httptest.NewRecorder()
+		postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`))
+		postRequest.Header.Set("Idempotency-Key", key)
+		router.ServeHTTP(postRecorder, postRequest)
+		assert.Equal(t, http.StatusCreated, postRecorder.Code)
+		var postBody map[string]interface{}
+		json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+		ids = append(ids, fmt.Sprintf("%.0f", postBody["id"]))
+	}
+	assert.Equal(t, ids[0], ids[1])
+
+	reusedRecorder := httptest.NewRecorder()
+	reusedRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Max"}`))
+	reusedRequest.Header.Set("Idempotency-Key", key)
+	router.ServeHTTP(reusedRecorder, reusedRequest)
+	assert.Equal(t, http.StatusUnprocessableEntity, reusedRecorder.Code)
+
+	// clean up after the test
+	deleteContact(t, router, ids[0])
+}
+
+// bootstrapKey is the bootstrap key with which the integration tests manage API keys.
+const bootstrapKey = "integration-test-bootstrap-key-0123456789"
+
+// TestAPIKeyLifecycle tests that an API key created with the bootstrap key can be used until it
+// is rotated, and that the rotated key can be used until it is revoked.
+func TestAPIKeyLifecycle(t *testing.T) {
+	t.Setenv("BOOTSTRAP_API_KEY", bootstrapKey)
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	createRecorder := httptest.NewRecorder()
+	createRequest, _ := http.NewRequest("POST", "/api-keys", strings.NewReader(`{"name": "integration test", "scopes": ["read"]}`))
+	createRequest.Header.Set("X-API-Key", bootstrapKey)
+	router.ServeHTTP(createRecorder, createRequest)
+	assert.Equal(t, http.StatusCreated, createRecorder.Code)
+	var created model.APIKey
+	json.Unmarshal(createRecorder.Body.Bytes(), &created)
+	id := fmt.Sprint(created.Id)
+	assert.Equal(t, http.StatusNotFound, requestWithAPIKey(router, "GET", "/contacts/0", created.Key))
+	assert.Equal(t, http.StatusForbidden, requestWithAPIKey(router, "DELETE", "/contacts/0", created.Key))
+
+	rotateRecorder := httptest.NewRecorder()
+	rotateRequest, _ := http.NewRequest("POST", "/api-keys/"+id+"/rotate", nil)
+	rotateRequest.Header.Set("X-API-Key", bootstrapKey)
+	router.ServeHTTP(rotateRecorder, rotateRequest)
+	assert.Equal(t, http.StatusOK, rotateRecorder.Code)
+	var rotated model.APIKey
+	json.Unmarshal(rotateRecorder.Body.Bytes(), &rotated)
+	assert.Equal(t, http.StatusUnauthorized, requestWithAPIKey(router, "GET", "/contacts/0", created.Key))
+	assert.Equal(t, http.StatusNotFound, requestWithAPIKey(router, "GET", "/contacts/0", rotated.Key))
+
+	revokeRecorder := httptest.NewRecorder()
+	revokeRequest, _ := http.NewRequest("DELETE", "/api-keys/"+id, nil)
+	revokeRequest.Header.Set("X-API-Key", bootstrapKey)
+	router.ServeHTTP(revokeRecorder, revokeRequest)
+	assert.Equal(t, http.StatusOK, revokeRecorder.Code)
+	assert.Equal(t, http.StatusUnauthorized, requestWithAPIKey(router, "GET", "/contacts/0", rotated.Key))
+}
+
+// requestWithAPIKey executes a request without body with the API key, and returns the status code
+// of the response.
+func requestWithAPIKey(router *gin.Engine, method string, url string, key string) int {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest(method, url, nil)
+	request.Header.Set("X-API-Key", key)
+	router.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+// TestTenantIsolation tests that a contact created for one tenant cannot be read, changed or
+// deleted on behalf of another tenant.
+func TestTenantIsolation(t *testing.T) {
+	t.Setenv("TRUST_TENANT_HEADER", "true")
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	postRecorder := httptest.NewRecorder()
+	postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`))
+	postRequest.Header.Set("X-Tenant-ID", "integration-test-a")
+	router.ServeHTTP(postRecorder, postRequest)
+	assert.Equal(t, http.StatusCreated, postRecorder.Code)
+	var postBody map[string]interface{}
+	json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+	id := fmt.Sprintf("%.0f", postBody["id"])
+
+	for _, request := range []struct {
+		method string
+		body   string
+	}{
+		{"GET", ""},
+		{"PUT", `{"firstname": "Mallory"}`},
+		{"DELETE", ""},
+	} {
+		recorder := httptest.NewRecorder()
+		httpRequest, _ := http.NewRequest(request.method, "/contacts/"+id, strings.NewReader(request.body))
+		httpRequest.Header.Set("X-Tenant-ID", "integration-test-b")
+		router.ServeHTTP(recorder, httpRequest)
+		assert.Equal(t, http.StatusNotFound, recorder.Code, request.method)
+	}
+	listRecorder := httptest.NewRecorder()
+	listRequest, _ := http.NewRequest("GET", "/contacts?firstname=Erika", nil)
+	listRequest.Header.Set("X-Tenant-ID", "integration-test-b")
+	router.ServeHTTP(listRecorder, listRequest)
+	assert.Equal(t, http.StatusNotFound, listRecorder.Code)
+
+	getRecorder := httptest.NewRecorder()
+	getRequest, _ := http.NewRequest("GET", "/contacts/"+id, nil)
+	getRequest.Header.Set("X-Tenant-ID", "integration-test-a")
+	router.ServeHTTP(getRecorder, getRequest)
+	assert.Equal(t, http.StatusOK, getRecorder.Code)
+	assert.Contains(t, getRecorder.Body.String(), `"firstname": "Erika"`)
+
+	// clean up after the test
+	deleteRecorder := httptest.NewRecorder()
+	deleteRequest, _ := http.NewRequest("DELETE", "/contacts/"+id, nil)
+	deleteRequest.Header.Set("X-Tenant-ID", "integration-test-a")
+	router.ServeHTTP(deleteRecorder, deleteRequest)
+	assert.Equal(t, http.StatusOK, deleteRecorder.Code)
+}
+
+// TestFindContactsUpdatedSince tests that a contact carries timestamps, and that it is only found
+// with the 'updated_since' URL parameter if it was updated at or after that time.
+func TestFindContactsUpdatedSince(t *testing.T) {
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	postRecorder := httptest.NewRecorder()
+	postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`))
+	router.ServeHTTP(postRecorder, postRequest)
+	assert.Equal(t, http.StatusCreated, postRecorder.Code)
+	var postBody model.Contact
+	json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+	assert.NotNil(t, postBody.CreatedAt)
+	assert.Equal(t, postBody.CreatedAt, postBody.UpdatedAt)
+	idAsString := fmt.Sprint(postBody.Id)
+
+	updatedSince := postBody.UpdatedAt.Add(time.Millisecond).Format(time.RFC3339Nano)
+	getRecorder := httptest.NewRecorder()
+	getRequest, _ := http.NewRequest("GET", "/contacts?orderby=updated_at&updated_since="+url.QueryEscape(updatedSince), nil)
+	router.ServeHTTP(getRecorder, getRequest)
+	var contacts []model.Contact
+	json.Unmarshal(getRecorder.Body.Bytes(), &contacts)
+	for _, contact := range contacts {
+		assert.NotEqual(t, postBody.Id, contact.Id)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	putRecorder := httptest.NewRecorder()
+	putRequest, _ := http.NewRequest("PUT", "/contacts/"+idAsString, strings.NewReader(`{"firstname": "Rudi"}`))
+	router.ServeHTTP(putRecorder, putRequest)
+	assert.Equal(t, http.StatusOK, putRecorder.Code)
+	var putBody model.Contact
+	json.Unmarshal(putRecorder.Body.Bytes(), &putBody)
+	assert.Equal(t, postBody.CreatedAt, putBody.CreatedAt)
+	assert.True(t, putBody.UpdatedAt.After(*postBody.UpdatedAt))
+
+	getRecorder = httptest.NewRecorder()
+	getRequest, _ = http.NewRequest("GET", "/contacts?orderby=updated_at&updated_since="+url.QueryEscape(updatedSince), nil)
+	router.ServeHTTP(getRecorder, getRequest)
+	assert.Equal(t, http.StatusOK, getRecorder.Code)
+	contacts = nil
+	json.Unmarshal(getRecorder.Body.Bytes(), &contacts)
+	found := false
+	for _, contact := range contacts {
+		found = found || contact.Id == postBody.Id
+	}
+	assert.True(t, found)
+
+	// clean up after the test
+	deleteContact(t, router, idAsString)
+}
+
+// TestContactChanges tests that created, updated and deleted contacts are reported as changes
+// since a token, and that the token for the next request is returned.
+func TestContactChanges(t *testing.T) {
+	// changes settle one second after the request timeout
+	t.Setenv("REQUEST_TIMEOUT", "1s")
+	sqlDB := service.CreateDatabase()
+	service.SetupDatabaseWrapper(sqlDB)
+	router := service.SetupHttpRouter()
+
+	// changes are only reported after they have settled
+	time.Sleep(3 * time.Second)
+	token := ""
+	for {
+		body := fetchChanges(t, router, token)
+		token = body["next"].(string)
+		if body["has_more"] != true {
+			break
+		}
+	}
+
+	var ids []float64
+	for _, firstname := range []string{"Erika", "Rudi"} {
+		postRecorder := httptest.NewRecorder()
+		postRequest, _ := http.NewRequest("POST", "/contacts", strings.NewReader(`{"firstname": "`+firstname+`"}`))
+		router.ServeHTTP(postRecorder, postRequest)
+		assert.Equal(t, http.StatusCreated, postRecorder.Code)
+		var postBody map[string]interface{}
+		json.Unmarshal(postRecorder.Body.Bytes(), &postBody)
+		ids = append(ids, postBody["id"].(float64))
+	}
+	deleteContact(t, router, fmt.Sprintf("%.0f", ids[1]))
+
+	time.Sleep(3 * time.Second)
+	body := fetchChanges(t, router, token)
+	assert.Contains(t, body["created"], ids[0])
+	assert.Contains(t, body["deleted"], ids[1])
+	assert.NotContains(t, body["created"], ids[1])
+	assert.NotEqual(t, token, body["next"])
+
+	body = fetchChanges(t, router, body["next"].(string))
+	assert.NotContains(t, body["created"], ids[0])
+
+	// clean up after the test
+	deleteContact(t, router, fmt.Sprintf("%.0f", ids[0]))
+}
+
+// fetchChanges requests the changes since the token and returns the response body.
+func fetchChanges(t *testing.T, router *gin.Engine, token string) map[string]interface{} {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/contacts/changes?since="+url.QueryEscape(token), nil)
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var body map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return body
+}
+
 // TestFindAllContacts retrieves all contacts and verifies that a previously created contact is
 // among them.
 func TestFindAllContacts(t *testing.T) {
@@ -0,0 +1,186 @@
+// Package jwtauth verifies JSON Web Tokens that are issued by an OpenID Connect provider.
+//
+// Tokens must be signed with RS256 or ES256. The public keys are taken from a JSON Web Key Set,
+// which is cached and reloaded when the provider rotates its keys. Tokens with other algorithms,
+// including unsigned tokens, are rejected.
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Supported signature algorithms.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// Verifier checks the signature and the standard claims of tokens.
+type Verifier struct {
+	// Keys are the public keys with which tokens are signed.
+	Keys *KeySet
+	// Issuer is the expected 'iss' claim. If it is empty, the issuer is not checked.
+	Issuer string
+	// Audience must be one of the values of the 'aud' claim. If it is empty, the audience is not
+	// checked.
+	Audience string
+	// Leeway is the tolerated difference between the clocks of the issuer and the verifier.
+	Leeway time.Duration
+
+	now func() time.Time
+}
+
+// Claims are the claims of a verified token.
+type Claims map[string]any
+
+// header is the JOSE header of a token.
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// NewVerifier creates a verifier for tokens that are signed with one of the keys.
+func NewVerifier(keys *KeySet, issuer string, audience string) *Verifier {
+	return &Verifier{Keys: keys, Issuer: issuer, Audience: audience, Leeway: time.Minute, now: time.Now}
+}
+
+// Verify checks the signature of the token in compact serialization, and its expiry, issuer and
+// audience. It returns the claims of the token.
+func (verifier *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var head header
+	if err := decodeSegment(parts[0], &head); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	key, err := verifier.Keys.Key(head.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(head.Alg, key, digest[:], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if err := verifier.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature checks the signature of the digest with the key, for the algorithm in the
+// header. The key type must match the algorithm.
+func verifySignature(alg string, key crypto.PublicKey, digest []byte, signature []byte) error {
+	switch alg {
+	case RS256:
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm RS256")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	case ES256:
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm ES256")
+		}
+		// the signature is the concatenation of r and s, not ASN.1
+		if len(signature) != 64 {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+	return nil
+}
+
+// validate checks the time, issuer and audience claims.
+func (verifier *Verifier) validate(claims Claims) error {
+	now := verifier.now()
+	expiry, found := claims.time("exp")
+	if !found {
+		return errors.New("token has no expiry")
+	}
+	if now.After(expiry.Add(verifier.Leeway)) {
+		return errors.New("token is expired")
+	}
+	if notBefore, found := claims.time("nbf"); found && now.Before(notBefore.Add(-verifier.Leeway)) {
+		return errors.New("token is not valid yet")
+	}
+	if verifier.Issuer != "" && claims.String("iss") != verifier.Issuer {
+		return errors.New("token has a wrong issuer")
+	}
+	if verifier.Audience != "" && !slices.Contains(claims.Strings("aud"), verifier.Audience) {
+		return errors.New("token has a wrong audience")
+	}
+	return nil
+}
+
+// String returns the value of a string claim, or an empty string.
+func (claims Claims) String(name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// Strings returns the values of a claim that is either an array of strings or a string of values
+// separated by spaces, like the 'scope' claim.
+func (claims Claims) Strings(name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		var values []string
+		for _, element := range value {
+			if str, ok := element.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// time returns the value of a numeric date claim.
+func (claims Claims) time(name string) (time.Time, bool) {
+	seconds, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, value any) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, value)
+}
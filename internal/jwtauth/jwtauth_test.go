@@ -0,0 +1,254 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rsaKey and ecKey are generated once, because generating RSA keys is slow.
+var (
+	rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// now is the point in time at which the tokens in the tests are verified.
+var now = time.Date(2023, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+// signToken creates a token with the claims, signed with the private key.
+func signToken(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]any) string {
+	head, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// jwks returns the JSON Web Key Set with the public keys.
+func jwks(keys map[string]crypto.PublicKey) []byte {
+	var document struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	encode := func(value *big.Int, size int) string {
+		return base64.RawURLEncoding.EncodeToString(value.FillBytes(make([]byte, size)))
+	}
+	for kid, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			document.Keys = append(document.Keys, map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig",
+				"n": encode(key.N, key.Size()), "e": encode(big.NewInt(int64(key.E)), 3)})
+		case *ecdsa.PublicKey:
+			document.Keys = append(document.Keys, map[string]string{
+				"kty": "EC", "kid": kid, "crv": "P-256", "x": encode(key.X, 32), "y": encode(key.Y, 32)})
+		}
+	}
+	data, _ := json.Marshal(document)
+	return data
+}
+
+// newTestVerifier creates a verifier for the keys, which are stored in a JWKS file. Tokens must be
+// issued by 'https://id.example.com' for the audience 'contacts'.
+func newTestVerifier(t *testing.T, keys map[string]crypto.PublicKey) *Verifier {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifier(NewKeySet(path), "https://id.example.com", "contacts")
+	verifier.now = func() time.Time { return now }
+	verifier.Keys.now = verifier.now
+	return verifier
+}
+
+// validClaims returns claims that pass the verification.
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss":   "https://id.example.com",
+		"aud":   []string{"contacts", "other"},
+		"sub":   "alice",
+		"scope": "openid contacts:read",
+		"exp":   now.Add(time.Hour).Unix(),
+		"nbf":   now.Add(-time.Hour).Unix(),
+	}
+}
+
+// TestVerify verifies tokens that are signed with RS256 and ES256. It expects that their claims
+// are returned.
+func TestVerify(t *testing.T) {
+	verifier := newTestVerifier(t, map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey})
+	for _, token := range []string{
+		signToken(t, RS256, "rsa", rsaKey, validClaims()),
+		signToken(t, ES256, "ec", ecKey, validClaims()),
+	} {
+		claims, err := verifier.Verify(token)
+		assert.Nil(t, err)
+		assert.Equal(t, "alice", claims.String("sub"))
+		assert.Equal(t, []string{"openid", "contacts:read"}, claims.Strings("scope"))
+	}
+}
+
+// TestVerifyInvalidTokens verifies tokens that are malformed, not signed correctly, or carry
+// invalid claims. It expects that all of them are rejected.
+func TestVerifyInvalidTokens(t *testing.T) {
+	verifier := newTestVerifier(t, map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey})
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	withClaim := func(name string, value any) map[string]any {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	valid := signToken(t, RS256, "rsa", rsaKey, validClaims())
+	parts := strings.Split(valid, ".")
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + parts[1] + "."
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","exp":9999999999}`)) + "." + parts[2]
+
+	invalidTokens := map[string]string{
+		"malformed":       "not a token",
+		"unsigned":        unsigned,
+		"tampered":        tampered,
+		"wrong algorithm": signToken(t, ES256, "rsa", ecKey, validClaims()),
+		"unknown key":     signToken(t, ES256, "other", otherKey, validClaims()),
+		"wrong key":       signToken(t, ES256, "ec", otherKey, validClaims()),
+		"expired":         signToken(t, RS256, "rsa", rsaKey, withClaim("exp", now.Add(-2*time.Minute).Unix())),
+		"no expiry":       signToken(t, RS256, "rsa", rsaKey, withClaim("exp", nil)),
+		"not yet valid":   signToken(t, RS256, "rsa", rsaKey, withClaim("nbf", now.Add(2*time.Minute).Unix())),
+		"wrong issuer":    signToken(t, RS256, "rsa", rsaKey, withClaim("iss", "https://evil.example.com")),
+		"wrong audience":  signToken(t, RS256, "rsa", rsaKey, withClaim("aud", "billing")),
+	}
+	for name, token := range invalidTokens {
+		_, err := verifier.Verify(token)
+		assert.NotNil(t, err, name)
+	}
+}
+
+// TestVerifyLeeway verifies a token that expired a moment ago. It expects that the token is
+// accepted, because the clocks of issuer and verifier may differ slightly.
+func TestVerifyLeeway(t *testing.T) {
+	verifier := newTestVerifier(t, map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey})
+	claims := validClaims()
+	claims["exp"] = now.Add(-30 * time.Second).Unix()
+	_, err := verifier.Verify(signToken(t, RS256, "", rsaKey, claims))
+	assert.Nil(t, err)
+}
+
+// TestKeyRotation serves a JWKS document whose keys are rotated. It expects that tokens signed
+// with the new key are accepted after the rotation without waiting for the cache to expire, and
+// that the document is not fetched more often than the minimum refresh interval.
+func TestKeyRotation(t *testing.T) {
+	var document atomic.Value
+	document.Store(jwks(map[string]crypto.PublicKey{"2023-04": &rsaKey.PublicKey}))
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(document.Load().([]byte))
+	}))
+	defer server.Close()
+	clock := now
+	keys := NewKeySet(server.URL)
+	keys.now = func() time.Time { return clock }
+	verifier := NewVerifier(keys, "", "")
+	verifier.now = keys.now
+
+	_, err := verifier.Verify(signToken(t, RS256, "2023-04", rsaKey, validClaims()))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), fetches.Load())
+
+	// the provider rotates in a new key, but the refresh interval has not passed yet
+	document.Store(jwks(map[string]crypto.PublicKey{"2023-04": &rsaKey.PublicKey, "2023-05": &ecKey.PublicKey}))
+	rotated := signToken(t, ES256, "2023-05", ecKey, validClaims())
+	_, err = verifier.Verify(rotated)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), fetches.Load())
+
+	clock = clock.Add(keys.MinRefreshInterval)
+	_, err = verifier.Verify(rotated)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// the cached keys are used while the provider is not available
+	server.Config.Handler = http.NotFoundHandler()
+	clock = clock.Add(keys.MaxAge)
+	_, err = verifier.Verify(rotated)
+	assert.Nil(t, err)
+}
+
+// TestKeyWhileRefreshing looks up a cached key while the key set is being reloaded for an unknown
+// key id. It expects that the cached key is returned without waiting for the slow provider.
+func TestKeyWhileRefreshing(t *testing.T) {
+	document := jwks(map[string]crypto.PublicKey{"2023-04": &rsaKey.PublicKey})
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		w.Write(document)
+	}))
+	defer server.Close()
+	defer close(release)
+	keys := NewKeySet(server.URL)
+	keys.MinRefreshInterval = 0
+
+	_, err := keys.Key("2023-04")
+	assert.Nil(t, err)
+	go keys.Key("unknown")
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	key, err := keys.Key("2023-04")
+	assert.Nil(t, err)
+	assert.Equal(t, &rsaKey.PublicKey, key)
+}
+
+// TestParseJWKS parses key sets with keys that are not used for signatures, have unsupported
+// types or are invalid. It expects that only the valid signing keys are returned, and that a set
+// without such keys is rejected.
+func TestParseJWKS(t *testing.T) {
+	keys, err := ParseJWKS([]byte(`{"keys": [
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+		{"kty": "EC", "kid": "p384", "crv": "P-384", "x": "", "y": ""},
+		{"kty": "EC", "kid": "bad", "crv": "P-256",
+			"x": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "y": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}
+	]}`))
+	assert.NotNil(t, err)
+	assert.Nil(t, keys)
+
+	document := jwks(map[string]crypto.PublicKey{"2023-05": &ecKey.PublicKey})
+	document = append([]byte(`{"keys": [{"kty": "RSA", "kid": "short", "n": "AQAB", "e": "AQAB"}, `), document[len(`{"keys":[`):]...)
+	keys, err = ParseJWKS(document)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keys))
+	assert.NotNil(t, keys["2023-05"])
+}
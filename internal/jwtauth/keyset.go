@@ -0,0 +1,258 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxJWKSSize is the maximum size of a JWKS document that is accepted.
+const maxJWKSSize = 1 << 20
+
+// KeySet holds the public keys of a JSON Web Key Set, which is read from a file or fetched from a
+// URL. The keys are cached and reloaded after MaxAge. If a token refers to a key id that is not in
+// the cache, the set is reloaded right away, so that keys that the issuer rotated in are picked
+// up, but not more often than every MinRefreshInterval.
+type KeySet struct {
+	// MaxAge is the time after which the keys are reloaded.
+	MaxAge time.Duration
+	// MinRefreshInterval is the minimum time between two reloads.
+	MinRefreshInterval time.Duration
+
+	source    string
+	client    *http.Client
+	fetching  sync.Mutex
+	mutex     sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	fetches   int
+	fetchErr  error
+	now       func() time.Time
+}
+
+// jsonWebKey is a key of a JWKS document. Only the members of RSA and elliptic curve keys are
+// included.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewKeySet creates a key set that is loaded from the source, which is either an http or https
+// URL or the path of a file. The keys are loaded when they are first needed.
+func NewKeySet(source string) *KeySet {
+	return &KeySet{
+		MaxAge:             time.Hour,
+		MinRefreshInterval: time.Minute,
+		source:             source,
+		client:             &http.Client{Timeout: 10 * time.Second},
+		now:                time.Now,
+	}
+}
+
+// Key returns the public key with the specified key id. If the key id is empty and the set
+// contains a single key, that key is returned.
+func (set *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	now := set.now()
+	keys, fetchedAt, fetches := set.cached()
+	if keys == nil || now.Sub(fetchedAt) >= set.MaxAge {
+		err := set.refresh(fetches)
+		keys, fetchedAt, fetches = set.cached()
+		// keep using the cached keys if the source is temporarily unavailable
+		if err != nil && keys == nil {
+			return nil, err
+		}
+	}
+	if key := lookup(keys, kid); key != nil {
+		return key, nil
+	}
+	if now.Sub(fetchedAt) >= set.MinRefreshInterval {
+		if err := set.refresh(fetches); err != nil {
+			return nil, err
+		}
+		keys, _, _ = set.cached()
+		if key := lookup(keys, kid); key != nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id '%s'", kid)
+}
+
+// cached returns the cached keys, the time when they were loaded and the number of attempts to
+// load them so far.
+func (set *KeySet) cached() (map[string]crypto.PublicKey, time.Time, int) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	return set.keys, set.fetchedAt, set.fetches
+}
+
+// lookup returns the key with the key id, or nil.
+func lookup(keys map[string]crypto.PublicKey, kid string) crypto.PublicKey {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return keys[kid]
+}
+
+// refresh loads the keys from the source and replaces the cached keys, unless they were loaded
+// again since the caller saw the number of attempts to load them. Only one caller loads the keys at
+// a time, and without holding the mutex, so that other callers can use the cached keys meanwhile;
+// callers that waited for the load share its result.
+func (set *KeySet) refresh(fetches int) error {
+	set.fetching.Lock()
+	defer set.fetching.Unlock()
+	set.mutex.Lock()
+	if set.fetches != fetches {
+		defer set.mutex.Unlock()
+		return set.fetchErr
+	}
+	set.mutex.Unlock()
+
+	keys, err := set.fetch()
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	set.fetches++
+	set.fetchErr = err
+	if err == nil {
+		set.keys = keys
+		set.fetchedAt = set.now()
+	}
+	return err
+}
+
+// fetch loads and parses the JWKS document from the source.
+func (set *KeySet) fetch() (map[string]crypto.PublicKey, error) {
+	data, err := set.load()
+	if err != nil {
+		return nil, fmt.Errorf("could not load JWKS from %s: %w", set.source, err)
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse JWKS from %s: %w", set.source, err)
+	}
+	return keys, nil
+}
+
+// load reads the JWKS document from the source.
+func (set *KeySet) load() ([]byte, error) {
+	if !strings.HasPrefix(set.source, "http://") && !strings.HasPrefix(set.source, "https://") {
+		return os.ReadFile(set.source)
+	}
+	response, err := set.client.Get(set.source)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded with status %d", response.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, maxJWKSSize))
+}
+
+// ParseJWKS parses a JSON Web Key Set and returns its signing keys by key id. RSA keys and
+// elliptic curve keys on the P-256 curve are supported; other keys, keys that are not meant for
+// signatures and invalid keys are skipped, so that a single bad key does not lock out the tokens
+// signed with the others. It fails if no usable key is left.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	var invalid []error
+	for _, jwk := range document.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch {
+		case jwk.Kty == "RSA":
+			key, err = jwk.rsaKey()
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			key, err = jwk.ecKey()
+		default:
+			continue
+		}
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("key '%s': %w", jwk.Kid, err))
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.Join(append([]error{errors.New("no usable signing key")}, invalid...)...)
+	}
+	return keys, nil
+}
+
+// rsaKey converts the JSON web key into an RSA public key.
+func (jwk jsonWebKey) rsaKey() (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA key")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+// ecKey converts the JSON web key into an elliptic curve public key on the P-256 curve.
+func (jwk jsonWebKey) ecKey() (*ecdsa.PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return nil, err
+	}
+	if len(x) != 32 || len(y) != 32 {
+		return nil, errors.New("invalid EC key")
+	}
+	// let crypto/ecdh check that the point is on the curve
+	if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+// decodeBigInt decodes a base64url encoded unsigned big-endian integer.
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 {
+		return nil, errors.New("empty integer")
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
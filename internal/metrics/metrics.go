@@ -0,0 +1,306 @@
+// Package metrics collects metrics of the service and writes them in the text format of
+// Prometheus, so that they can be scraped.
+//
+// Counters and histograms are kept in memory and updated by the service. Gauges and counters that
+// are kept elsewhere, like the statistics of the database pool, are read by a function whenever
+// the metrics are written.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets in seconds that suit the latency of
+// requests and queries.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector is a metric that can be written in the text format.
+type collector interface {
+	write(ctx context.Context, w io.Writer) error
+}
+
+// Registry holds the metrics of the service.
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds a metric to the registry.
+func (registry *Registry) register(metric collector) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.collectors = append(registry.collectors, metric)
+}
+
+// Write writes all metrics of the registry in the text format, in the order in which they were
+// created.
+func (registry *Registry) Write(ctx context.Context, w io.Writer) error {
+	registry.mutex.Lock()
+	collectors := append([]collector(nil), registry.collectors...)
+	registry.mutex.Unlock()
+	for _, metric := range collectors {
+		if err := metric.write(ctx, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// desc describes a metric with its name, help text and the names of its labels.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+// header writes the HELP and TYPE lines of the metric.
+func (d desc) header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+	return err
+}
+
+// labelPairs formats the labels with the values, followed by extra pairs, like '{a="1",b="2"}'.
+func (d desc) labelPairs(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, value := range values {
+		pairs = append(pairs, d.labels[i]+`="`+escapeLabel(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// checkValues panics if the number of label values does not match the labels, which is a bug.
+func (d desc) checkValues(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+}
+
+// key joins label values into a map key.
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// Counter is a value that only goes up, kept separately for every combination of label values.
+type Counter struct {
+	desc
+	mutex  sync.Mutex
+	series map[string]*counterSeries
+}
+
+// counterSeries is the value of a counter for a combination of label values.
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+// NewCounter creates a counter with the labels and adds it to the registry. The name should end
+// with '_total'.
+func (registry *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{desc: desc{name, help, "counter", labels}, series: make(map[string]*counterSeries)}
+	registry.register(counter)
+	return counter
+}
+
+// Inc adds one to the counter with the label values.
+func (counter *Counter) Inc(values ...string) {
+	counter.Add(1, values...)
+}
+
+// Add adds a non-negative amount to the counter with the label values.
+func (counter *Counter) Add(amount float64, values ...string) {
+	counter.checkValues(values)
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	series, found := counter.series[key(values)]
+	if !found {
+		series = &counterSeries{values: append([]string(nil), values...)}
+		counter.series[key(values)] = series
+	}
+	series.value += amount
+}
+
+// write implements the collector interface.
+func (counter *Counter) write(ctx context.Context, w io.Writer) error {
+	counter.mutex.Lock()
+	samples := make([]Sample, 0, len(counter.series))
+	for _, series := range counter.series {
+		samples = append(samples, Sample{Values: series.values, Value: series.value})
+	}
+	counter.mutex.Unlock()
+	return writeSamples(w, counter.desc, samples)
+}
+
+// Histogram counts observations, like request durations, in buckets, kept separately for every
+// combination of label values.
+type Histogram struct {
+	desc
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+// histogramSeries holds the observations of a histogram for a combination of label values.
+// counts[i] is the number of observations in bucket i, not including the lower buckets.
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the upper bounds of the buckets and the labels, and adds
+// it to the registry.
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: append([]float64(nil), buckets...),
+		series:  make(map[string]*histogramSeries),
+	}
+	sort.Float64s(histogram.buckets)
+	registry.register(histogram)
+	return histogram
+}
+
+// Observe adds an observation to the histogram with the label values.
+func (histogram *Histogram) Observe(value float64, values ...string) {
+	histogram.checkValues(values)
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	series, found := histogram.series[key(values)]
+	if !found {
+		series = &histogramSeries{values: append([]string(nil), values...), counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[key(values)] = series
+	}
+	if i := sort.SearchFloat64s(histogram.buckets, value); i < len(histogram.buckets) {
+		series.counts[i]++
+	}
+	series.count++
+	series.sum += value
+}
+
+// write implements the collector interface.
+func (histogram *Histogram) write(ctx context.Context, w io.Writer) error {
+	histogram.mutex.Lock()
+	series := make([]histogramSeries, 0, len(histogram.series))
+	for _, s := range histogram.series {
+		series = append(series, histogramSeries{s.values, append([]uint64(nil), s.counts...), s.count, s.sum})
+	}
+	histogram.mutex.Unlock()
+	sort.Slice(series, func(i, j int) bool { return key(series[i].values) < key(series[j].values) })
+
+	if err := histogram.header(w); err != nil {
+		return err
+	}
+	for _, s := range series {
+		var cumulative uint64
+		for i, bound := range histogram.buckets {
+			cumulative += s.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name,
+				histogram.labelPairs(s.values, "le", formatFloat(bound)), cumulative); err != nil {
+				return err
+			}
+		}
+		labels := histogram.labelPairs(s.values)
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			histogram.name, histogram.labelPairs(s.values, "le", "+Inf"), s.count,
+			histogram.name, labels, formatFloat(s.sum), histogram.name, labels, s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sample is the value of a metric for a combination of label values.
+type Sample struct {
+	Values []string
+	Value  float64
+}
+
+// funcCollector is a metric whose samples are read by a function whenever it is written.
+type funcCollector struct {
+	desc
+	collect func(ctx context.Context) []Sample
+}
+
+// NewGaugeFunc creates a gauge, a value that goes up and down, whose samples are read by the
+// function, and adds it to the registry.
+func (registry *Registry) NewGaugeFunc(name string, help string, collect func(ctx context.Context) []Sample, labels ...string) {
+	registry.register(&funcCollector{desc{name, help, "gauge", labels}, collect})
+}
+
+// NewCounterFunc creates a counter whose samples are read by the function, and adds it to the
+// registry.
+func (registry *Registry) NewCounterFunc(name string, help string, collect func(ctx context.Context) []Sample, labels ...string) {
+	registry.register(&funcCollector{desc{name, help, "counter", labels}, collect})
+}
+
+// write implements the collector interface.
+func (metric *funcCollector) write(ctx context.Context, w io.Writer) error {
+	samples := metric.collect(ctx)
+	for _, sample := range samples {
+		metric.checkValues(sample.Values)
+	}
+	return writeSamples(w, metric.desc, samples)
+}
+
+// writeSamples writes the header of the metric and its samples, sorted by their label values.
+func writeSamples(w io.Writer, d desc, samples []Sample) error {
+	sort.Slice(samples, func(i, j int) bool { return key(samples[i].Values) < key(samples[j].Values) })
+	if err := d.header(w); err != nil {
+		return err
+	}
+	for _, sample := range samples {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", d.name, d.labelPairs(sample.Values), formatFloat(sample.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatFloat formats a value like Prometheus does.
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// labelEscaper escapes label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value.
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// helpEscaper escapes help texts.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// escapeHelp escapes a help text.
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCounter verifies that counters are written per combination of label values, sorted, with
+// escaped label values.
+func TestCounter(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("requests_total", "Number of requests.", "method", "route")
+	counter.Inc("GET", "/contacts")
+	counter.Inc("GET", "/contacts")
+	counter.Add(0.5, "POST", `/say "hi"`)
+
+	var output strings.Builder
+	assert.Nil(t, registry.Write(context.Background(), &output))
+	assert.Equal(t, `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{method="GET",route="/contacts"} 2
+requests_total{method="POST",route="/say \"hi\""} 0.5
+`, output.String())
+}
+
+// TestHistogram verifies that histograms are written with cumulative buckets, sum and count.
+func TestHistogram(t *testing.T) {
+	registry := NewRegistry()
+	histogram := registry.NewHistogram("duration_seconds", "Duration.", []float64{0.1, 1}, "route")
+	histogram.Observe(0.05, "/a")
+	histogram.Observe(0.1, "/a")
+	histogram.Observe(0.5, "/a")
+	histogram.Observe(3, "/a")
+
+	var output strings.Builder
+	assert.Nil(t, registry.Write(context.Background(), &output))
+	assert.Equal(t, `# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="/a",le="0.1"} 2
+duration_seconds_bucket{route="/a",le="1"} 3
+duration_seconds_bucket{route="/a",le="+Inf"} 4
+duration_seconds_sum{route="/a"} 3.65
+duration_seconds_count{route="/a"} 4
+`, output.String())
+}
+
+// TestFuncs verifies that gauges and counters that are read by functions are written with the
+// samples of the function, and that metrics without labels are written without braces.
+func TestFuncs(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewGaugeFunc("connections", "Open connections.", func(ctx context.Context) []Sample {
+		return []Sample{{Values: []string{"idle"}, Value: 3}, {Values: []string{"in_use"}, Value: 1}}
+	}, "state")
+	registry.NewCounterFunc("waits_total", "Waits.", func(ctx context.Context) []Sample {
+		return []Sample{{Value: 7}}
+	})
+
+	var output strings.Builder
+	assert.Nil(t, registry.Write(context.Background(), &output))
+	assert.Equal(t, `# HELP connections Open connections.
+# TYPE connections gauge
+connections{state="idle"} 3
+connections{state="in_use"} 1
+# HELP waits_total Waits.
+# TYPE waits_total counter
+waits_total 7
+`, output.String())
+}
+
+// TestWrongLabelValues verifies that using a metric with the wrong number of label values panics.
+func TestWrongLabelValues(t *testing.T) {
+	counter := NewRegistry().NewCounter("requests_total", "Number of requests.", "method")
+	assert.Panics(t, func() { counter.Inc() })
+}
@@ -0,0 +1,246 @@
+package metrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"time"
+)
+
+// QueryObserver receives the type of every statement that was executed, like 'select' or
+// 'insert', and the time it took.
+type QueryObserver func(statement string, duration time.Duration)
+
+// InstrumentConnector wraps a database connector, so that the observer is told about every query
+// and every execution of a statement on its connections, including prepared statements and
+// statements within transactions.
+func InstrumentConnector(connector driver.Connector, observe QueryObserver) driver.Connector {
+	return &instrumentedConnector{connector, observe}
+}
+
+// StatementType returns the type of a SQL statement in lower case, which is its first keyword,
+// or 'other' for statements of other types than select, insert, update and delete.
+func StatementType(query string) string {
+	keyword, _, _ := strings.Cut(strings.TrimLeft(query, " \t\r\n("), " ")
+	keyword = strings.ToLower(strings.TrimSpace(keyword))
+	switch keyword {
+	case "select", "insert", "update", "delete":
+		return keyword
+	}
+	return "other"
+}
+
+// instrumentedConnector opens instrumented connections.
+type instrumentedConnector struct {
+	connector driver.Connector
+	observe   QueryObserver
+}
+
+// Connect implements the driver.Connector interface.
+func (c *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn, c.observe}, nil
+}
+
+// Driver implements the driver.Connector interface.
+func (c *instrumentedConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// instrumentedConn times the queries on a connection. The optional interfaces of the wrapped
+// connection are passed through; where it lacks one, driver.ErrSkip makes database/sql fall back
+// to the required interfaces.
+type instrumentedConn struct {
+	conn    driver.Conn
+	observe QueryObserver
+}
+
+// Prepare implements the driver.Conn interface.
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext implements the driver.ConnPrepareContext interface.
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt, StatementType(query), c.observe}, nil
+}
+
+// Close implements the driver.Conn interface.
+func (c *instrumentedConn) Close() error {
+	return c.conn.Close()
+}
+
+// Begin implements the driver.Conn interface.
+func (c *instrumentedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx implements the driver.ConnBeginTx interface.
+func (c *instrumentedConn) BeginTx(ctx context.Context, options driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, options)
+	}
+	//lint:ignore SA1019 fallback for drivers without BeginTx
+	return c.conn.Begin()
+}
+
+// ExecContext implements the driver.ExecerContext interface.
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.observe(StatementType(query), time.Since(start))
+	}
+	return result, err
+}
+
+// QueryContext implements the driver.QueryerContext interface.
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.observe(StatementType(query), time.Since(start))
+	}
+	return rows, err
+}
+
+// Ping implements the driver.Pinger interface.
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession implements the driver.SessionResetter interface.
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid implements the driver.Validator interface.
+func (c *instrumentedConn) IsValid() bool {
+	if validator, ok := c.conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue implements the driver.NamedValueChecker interface.
+func (c *instrumentedConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// instrumentedStmt times the executions of a prepared statement.
+type instrumentedStmt struct {
+	stmt      driver.Stmt
+	statement string
+	observe   QueryObserver
+}
+
+// Close implements the driver.Stmt interface.
+func (s *instrumentedStmt) Close() error {
+	return s.stmt.Close()
+}
+
+// NumInput implements the driver.Stmt interface.
+func (s *instrumentedStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+// Exec implements the driver.Stmt interface.
+func (s *instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	//lint:ignore SA1019 part of the driver.Stmt interface
+	result, err := s.stmt.Exec(args)
+	s.observe(s.statement, time.Since(start))
+	return result, err
+}
+
+// Query implements the driver.Stmt interface.
+func (s *instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	//lint:ignore SA1019 part of the driver.Stmt interface
+	rows, err := s.stmt.Query(args)
+	s.observe(s.statement, time.Since(start))
+	return rows, err
+}
+
+// ExecContext implements the driver.StmtExecContext interface.
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := s.stmt.(driver.StmtExecContext)
+	if !ok {
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Exec(values)
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, args)
+	s.observe(s.statement, time.Since(start))
+	return result, err
+}
+
+// QueryContext implements the driver.StmtQueryContext interface.
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := s.stmt.(driver.StmtQueryContext)
+	if !ok {
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Query(values)
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, args)
+	s.observe(s.statement, time.Since(start))
+	return rows, err
+}
+
+// CheckNamedValue implements the driver.NamedValueChecker interface.
+func (s *instrumentedStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := s.stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// namedValuesToValues converts arguments for drivers that do not support named arguments.
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("driver does not support named arguments")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
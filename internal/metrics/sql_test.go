@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// dsnConnector is a connector for a driver and a data source name.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+// Connect implements the driver.Connector interface.
+func (c dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+// Driver implements the driver.Connector interface.
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// TestStatementType verifies that statements are classified by their first keyword.
+func TestStatementType(t *testing.T) {
+	assert.Equal(t, "select", StatementType("SELECT * FROM contacts"))
+	assert.Equal(t, "insert", StatementType("\n\t\tINSERT INTO contacts (firstname) VALUES (?)"))
+	assert.Equal(t, "update", StatementType("update contacts set firstname = ?"))
+	assert.Equal(t, "select", StatementType("(SELECT 1) UNION (SELECT 2)"))
+	assert.Equal(t, "other", StatementType("CREATE TABLE contacts (id INT)"))
+	assert.Equal(t, "other", StatementType(""))
+}
+
+// TestInstrumentConnector executes queries, statements and prepared statements, within and outside
+// of transactions, on an instrumented connection. It expects that the observer is told about each
+// of them with its statement type.
+func TestInstrumentConnector(t *testing.T) {
+	mockDB, mock, err := sqlmock.NewWithDSN("instrumented")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+	var mutex sync.Mutex
+	var observed []string
+	connector := InstrumentConnector(dsnConnector{"instrumented", mockDB.Driver()}, func(statement string, duration time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		observed = append(observed, statement)
+	})
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	mock.ExpectQuery("SELECT firstname FROM contacts").
+		WillReturnRows(mock.NewRows([]string{"firstname"}).AddRow("Erika"))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM contacts").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	prepared := mock.ExpectPrepare("UPDATE contacts")
+	prepared.ExpectExec().
+		WithArgs("Hans", 42).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Run test and compare results
+	var firstname string
+	assert.Nil(t, db.QueryRowContext(context.Background(), "SELECT firstname FROM contacts WHERE id = ?", 42).Scan(&firstname))
+	assert.Equal(t, "Erika", firstname)
+	tx, err := db.Begin()
+	assert.Nil(t, err)
+	_, err = tx.Exec("DELETE FROM contacts WHERE id = ?", 42)
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+	stmt, err := db.Prepare("UPDATE contacts SET firstname = ? WHERE id = ?")
+	assert.Nil(t, err)
+	_, err = stmt.Exec("Hans", 42)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"select", "delete", "update"}, observed)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
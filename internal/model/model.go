@@ -1,13 +1,97 @@
 package model
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Contact is the data structure for a person that we know.
-// All fields with the exception of the Id field are optional.
+// All fields with the exception of the Id and Version fields are optional.
+// The Version field is maintained by the service and incremented with every change. The CreatedAt
+// and UpdatedAt fields are maintained by the database. The DeletedAt field is only set for
+// contacts in the trash. The TenantId field is maintained by the service and never exposed to
+// clients. The Owner field is the user who created the contact; it is nil for contacts that all
+// users of the tenant share. The VIP field marks contacts whose data only some roles may see.
 type Contact struct {
-	Id        int64      `json:"id"                  db:"id"`
-	FirstName *string    `json:"firstname,omitempty" db:"firstname"`
-	LastName  *string    `json:"lastname,omitempty"  db:"lastname"`
-	Phone     *string    `json:"phone,omitempty"     db:"phone"`
-	Birthday  *time.Time `json:"birthday,omitempty"  db:"birthday"`
+	Id        int64      `json:"id"                   db:"id"`
+	TenantId  string     `json:"-"                    db:"tenant_id"`
+	Owner     *string    `json:"owner,omitempty"      db:"owner"`
+	FirstName *string    `json:"firstname,omitempty"  db:"firstname"`
+	LastName  *string    `json:"lastname,omitempty"   db:"lastname"`
+	Phone     *string    `json:"phone,omitempty"      db:"phone"`
+	Birthday  *time.Time `json:"birthday,omitempty"   db:"birthday"`
+	VIP       bool       `json:"vip,omitempty"        db:"vip"`
+	Version   int64      `json:"version"              db:"version"`
+	CreatedAt *time.Time `json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty" db:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+}
+
+// AuditEntry records a single change of a contact: who changed it when, within which request,
+// and how the contact looked before and after the change. Before is nil for created contacts and
+// After is nil for deleted contacts. Version is the version of the contact after the change.
+// MergedIds lists the other contacts involved in a merge.
+type AuditEntry struct {
+	Id        int64     `json:"id"`
+	ContactId int64     `json:"contact_id"`
+	Action    string    `json:"action"`
+	Version   int64     `json:"version"`
+	Before    *Contact  `json:"before"`
+	After     *Contact  `json:"after"`
+	MergedIds []int64   `json:"merged_ids,omitempty"`
+	Actor     string    `json:"actor"`
+	RequestId string    `json:"request_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Share grants a user other than the owner access to a contact. Permission is 'read' or 'write'.
+type Share struct {
+	ContactId  int64     `json:"contact_id" db:"contact_id"`
+	Grantee    string    `json:"grantee"    db:"grantee"`
+	Permission string    `json:"permission" db:"permission"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// Webhook is a subscription of a downstream system to changes of contacts. The events are sent as
+// signed JSON to the URL. The secret is only returned when the webhook is created.
+type Webhook struct {
+	Id        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is an event that is sent, or still to be sent, to a webhook. Status is
+// 'pending' until the receiver accepted the event ('succeeded') or all attempts failed ('failed').
+// StatusCode and Error describe the outcome of the last attempt.
+type WebhookDelivery struct {
+	Id            int64           `json:"id"                    db:"id"`
+	WebhookId     int64           `json:"webhook_id"            db:"webhook_id"`
+	Event         string          `json:"event"                 db:"event"`
+	Key           string          `json:"idempotency_key"       db:"idempotency_key"`
+	Payload       json.RawMessage `json:"payload"               db:"payload"`
+	Status        string          `json:"status"                db:"status"`
+	Attempts      int             `json:"attempts"              db:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"       db:"next_attempt_at"`
+	StatusCode    *int            `json:"status_code,omitempty" db:"status_code"`
+	Error         *string         `json:"error,omitempty"       db:"error"`
+	CreatedAt     time.Time       `json:"created_at"            db:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"            db:"updated_at"`
+}
+
+// APIKey is a key with which clients authenticate. Key is the secret value of the key; it is only
+// returned when the key is created or rotated. Prefix is the beginning of the key, which helps to
+// recognize it. Scopes lists the permissions of the key: 'read', 'write' or 'admin'. Roles lists
+// the roles of the key, which restrict the endpoints and the fields of contacts that it may use.
+type APIKey struct {
+	Id         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	Roles      []string   `json:"roles,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
 }
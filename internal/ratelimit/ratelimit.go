@@ -0,0 +1,138 @@
+// Package ratelimit limits how often clients may call the service, with the token bucket
+// algorithm.
+//
+// Every client has a bucket that holds up to Count tokens and is refilled with Count tokens per
+// Period. Every request takes a token; requests that find the bucket empty are rejected. The
+// buckets are kept in a Store, either in the memory of the process or in a store that is shared by
+// all instances of the service.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the time between two sweeps of the memory store, which remove the buckets
+// that are full again.
+const sweepInterval = time.Minute
+
+// Limit is the number of requests that a client may send within a period of time. A client that
+// sent no requests for a while may send Count requests at once.
+type Limit struct {
+	Count  int
+	Period time.Duration
+}
+
+// units are the units of the periods of limits, by their abbreviations.
+var units = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+// ParseLimit parses a limit in the format '<count>/<unit>', where the unit is 's', 'm' or 'h', for
+// example '100/m' for 100 requests per minute.
+func ParseLimit(value string) (Limit, error) {
+	countPart, unitPart, found := strings.Cut(value, "/")
+	count, err := strconv.Atoi(countPart)
+	period, validUnit := units[unitPart]
+	if !found || err != nil || count < 1 || !validUnit {
+		return Limit{}, fmt.Errorf("invalid rate limit '%s'", value)
+	}
+	return Limit{Count: count, Period: period}, nil
+}
+
+// rate returns the number of tokens per second with which a bucket is refilled.
+func (limit Limit) rate() float64 {
+	return float64(limit.Count) / limit.Period.Seconds()
+}
+
+// Result is the outcome of taking a token from a bucket. Remaining is the number of tokens left in
+// the bucket. Reset is the time until the bucket is full again. RetryAfter is the time until the
+// next token is available if the request was not allowed, and zero otherwise.
+type Result struct {
+	Allowed    bool
+	Limit      Limit
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets of the clients. Implementations must be safe for concurrent use.
+type Store interface {
+	// Take takes a token from the bucket with the key, which is created full if it does not exist
+	// yet, and tells whether the request is allowed.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// bucket holds the tokens of a client at the time of the last update. The bucket is full again at
+// the time 'full'.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryStore is the store that keeps the buckets in the memory of the process. Every instance of
+// the service has its own buckets, so clients that are distributed over several instances may
+// send more requests than the limit.
+type MemoryStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// NewMemoryStore creates an empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Take implements the Store interface.
+func (store *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := store.now()
+	store.sweep(now)
+	b, found := store.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(limit.Count), updated: now}
+		store.buckets[key] = b
+	}
+	rate := limit.rate()
+	b.tokens = math.Min(float64(limit.Count), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	result := Result{Limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(limit.Count) - b.tokens) / rate)
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweep removes the buckets that are full again, since they are the same as new buckets, unless
+// the last sweep was less than a minute ago.
+func (store *MemoryStore) sweep(now time.Time) {
+	if now.Sub(store.swept) < sweepInterval {
+		return
+	}
+	for key, b := range store.buckets {
+		if !now.Before(b.full) {
+			delete(store.buckets, key)
+		}
+	}
+	store.swept = now
+}
+
+// seconds converts a number of seconds into a duration.
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
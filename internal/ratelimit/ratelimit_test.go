@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestStore creates a memory store whose clock is controlled by the test.
+func newTestStore(now *time.Time) *MemoryStore {
+	store := NewMemoryStore()
+	store.now = func() time.Time { return *now }
+	return store
+}
+
+// TestParseLimit verifies that valid limits are parsed and invalid limits are rejected.
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("100/m")
+	assert.Nil(t, err)
+	assert.Equal(t, Limit{Count: 100, Period: time.Minute}, limit)
+	limit, err = ParseLimit("5/s")
+	assert.Nil(t, err)
+	assert.Equal(t, Limit{Count: 5, Period: time.Second}, limit)
+
+	for _, value := range []string{"", "100", "100/d", "0/m", "-1/s", "x/h", "100/"} {
+		_, err := ParseLimit(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+// TestTake verifies that a client may send as many requests at once as the limit allows, is
+// rejected afterwards, and may send again once the bucket was refilled.
+func TestTake(t *testing.T) {
+	now := time.Date(2023, time.May, 1, 12, 0, 0, 0, time.UTC)
+	store := newTestStore(&now)
+	limit := Limit{Count: 3, Period: 3 * time.Second}
+
+	for i := 2; i >= 0; i-- {
+		result, err := store.Take(context.Background(), "client", limit)
+		assert.Nil(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, i, result.Remaining)
+	}
+	result, _ := store.Take(context.Background(), "client", limit)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, time.Second, result.RetryAfter)
+	assert.Equal(t, 3*time.Second, result.Reset)
+
+	result, _ = store.Take(context.Background(), "other client", limit)
+	assert.True(t, result.Allowed)
+
+	now = now.Add(time.Second)
+	result, _ = store.Take(context.Background(), "client", limit)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, time.Duration(0), result.RetryAfter)
+}
+
+// TestSweep verifies that buckets that are full again are removed from the store.
+func TestSweep(t *testing.T) {
+	now := time.Date(2023, time.May, 1, 12, 0, 0, 0, time.UTC)
+	store := newTestStore(&now)
+	limit := Limit{Count: 10, Period: time.Minute}
+
+	store.Take(context.Background(), "first", limit)
+	store.Take(context.Background(), "second", limit)
+	now = now.Add(sweepInterval - time.Second)
+	store.Take(context.Background(), "second", limit)
+	assert.Equal(t, 2, len(store.buckets))
+
+	now = now.Add(time.Second)
+	store.Take(context.Background(), "third", limit)
+	assert.Equal(t, 2, len(store.buckets))
+	assert.NotContains(t, store.buckets, "first")
+}
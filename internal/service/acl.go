@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/events"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// Permissions that the owner of a contact can grant to other users.
+const (
+	permissionRead  = "read"
+	permissionWrite = "write"
+)
+
+// maxGranteeLength is the maximum length of the name of a user with whom a contact is shared. It
+// matches the length of the actor in the audit log.
+const maxGranteeLength = 100
+
+// access is the level of access that a user has to a contact.
+type access int
+
+// Levels of access to a contact. Every level includes the lower ones.
+const (
+	accessNone access = iota
+	accessRead
+	accessWrite
+	accessOwner
+)
+
+// visibleContacts is the SQL condition on the contacts table that holds for the contacts that the
+// user of a request may see: all contacts for clients with the 'admin' scope, and otherwise the
+// shared contacts of the tenant, the user's own contacts and the contacts that were shared with
+// the user. Its arguments are returned by visibilityArgs.
+const visibleContacts = `(? OR owner IS NULL OR owner = ? OR id IN (SELECT contact_id FROM contact_shares WHERE grantee = ?))`
+
+// shareChanges counts the changes of shares made by this instance of the service. Event streams
+// forget the visibility of contacts that they cached when it changes; see visibilityCache.
+var shareChanges atomic.Int64
+
+// visibilityCacheTTL is the time after which event streams forget the visibility of contacts that
+// they cached, so that the changes of shares made by other instances of the service take effect.
+var visibilityCacheTTL = time.Minute
+
+// visibilityCache remembers for an event stream whether the contacts of other users were shared
+// with the user of the stream, so that the shares are not looked up for every event. The cache is
+// cleared when this instance of the service changes a share, and after visibilityCacheTTL.
+type visibilityCache struct {
+	shared  map[int64]bool
+	changes int64
+	expires time.Time
+}
+
+// newVisibilityCache creates an empty visibility cache for an event stream.
+func newVisibilityCache() *visibilityCache {
+	return &visibilityCache{}
+}
+
+// isShared tells whether the contact was shared with the user of the request, from the cache if
+// possible.
+func (cache *visibilityCache) isShared(c *gin.Context, contactId int64) bool {
+	// the counter is read before the share, so that a change in between clears the cache next time
+	if changes := shareChanges.Load(); cache.shared == nil || changes != cache.changes || time.Now().After(cache.expires) {
+		cache.shared = make(map[int64]bool)
+		cache.changes = changes
+		cache.expires = time.Now().Add(visibilityCacheTTL)
+	}
+	shared, found := cache.shared[contactId]
+	if !found {
+		shared = sharePermission(c.Request.Context(), contactId, user(c)) != ""
+		cache.shared[contactId] = shared
+	}
+	return shared
+}
+
+// user returns the authenticated user of the request, or an empty string if the client did not
+// authenticate.
+func user(c *gin.Context) string {
+	return c.GetString(actorKey)
+}
+
+// isAdmin tells whether the client of the request was granted the 'admin' scope. Admins have
+// access to all contacts of their tenant.
+func isAdmin(c *gin.Context) bool {
+	return hasScope(c.GetStringSlice(scopesKey), scopeAdmin)
+}
+
+// visibilityArgs returns the arguments of the visibleContacts condition for the request.
+func visibilityArgs(c *gin.Context) []interface{} {
+	return []interface{}{isAdmin(c), user(c), user(c)}
+}
+
+// accessTo returns the access that the user of the request has to the contact. The owner and
+// admins may do everything, including sharing the contact. Contacts without owner may be read and
+// changed by all users of the tenant. Other users have the access that the owner granted them.
+func accessTo(c *gin.Context, contact *model.Contact) access {
+	switch {
+	case isAdmin(c) || (contact.Owner != nil && *contact.Owner == user(c)):
+		return accessOwner
+	case contact.Owner == nil:
+		return accessWrite
+	}
+	switch sharePermission(c.Request.Context(), contact.Id, user(c)) {
+	case permissionWrite:
+		return accessWrite
+	case permissionRead:
+		return accessRead
+	}
+	return accessNone
+}
+
+// contactAccess returns the access that the user of the request has to the contact of the tenant
+// with the specified id, including contacts in the trash. Only admins have access to contacts that
+// do not exist anymore; their access is granted without looking up the contact.
+func contactAccess(c *gin.Context, id int64) access {
+	if isAdmin(c) {
+		return accessOwner
+	}
+	var contacts []model.Contact
+	if err := db.SelectContext(c.Request.Context(), &contacts, "SELECT * FROM contacts WHERE id = ? AND tenant_id = ?", id, tenant(c)); err != nil {
+		log.Panicln(err)
+	}
+	if len(contacts) == 0 {
+		return accessNone
+	}
+	return accessTo(c, &contacts[0])
+}
+
+// sharePermission returns the permission with which the contact was shared with the user, or an
+// empty string if it was not shared with the user.
+func sharePermission(ctx context.Context, contactId int64, grantee string) string {
+	var permission string
+	err := db.GetContext(ctx, &permission, "SELECT permission FROM contact_shares WHERE contact_id = ? AND grantee = ?",
+		contactId, grantee)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ""
+	}
+	if err != nil {
+		log.Panicln(err)
+	}
+	return permission
+}
+
+// mayReceive tells whether the user of the request may receive an event about a contact of the
+// user's tenant, i.e. whether the user may see the contact. Whether contacts were shared with the
+// user is kept in the cache of the event stream.
+func mayReceive(c *gin.Context, cache *visibilityCache, event events.Event) bool {
+	return isAdmin(c) || event.Owner == "" || event.Owner == user(c) || cache.isShared(c, event.ContactId)
+}
+
+// checkAccess compares the access that the user of the request was granted with the required
+// access. If the user may not even see the contact, the request is answered with the NOT FOUND
+// status code, so that the existence of the contact is not revealed. If the user may see the
+// contact but needs more access, it is answered with the FORBIDDEN status code. It returns whether
+// the access is sufficient.
+func checkAccess(c *gin.Context, granted access, required access, notFound string) bool {
+	switch {
+	case granted >= required:
+		return true
+	case granted == accessNone:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": notFound})
+	case required == accessOwner:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "only the owner may share the contact"})
+	default:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "no write access to contact"})
+	}
+	return false
+}
+
+// findContactShares responds with the list of users with whom the contact whose ID value matches
+// the id parameter of the request URL is shared. Only the owner of the contact may list its
+// shares.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/contacts/56/shares
+func findContactShares(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	contact := findContact(c.Request.Context(), selectWhereId, id, tenant(c))
+	if contact == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+		return
+	}
+	if !checkAccess(c, accessTo(c, contact), accessOwner, "contact not found") {
+		return
+	}
+	shares := []model.Share{}
+	ctx := c.Request.Context()
+	err := db.SelectContext(ctx, &shares, "SELECT * FROM contact_shares WHERE contact_id = ? ORDER BY grantee", id)
+	if err != nil {
+		log.Panicln(err)
+	}
+	c.IndentedJSON(http.StatusOK, shares)
+}
+
+// shareContact shares the contact whose ID value matches the id parameter of the request URL with
+// the user named by the grantee parameter. The 'permission' in the request's JSON is either
+// 'read' or 'write'. Sharing a contact again with the same user replaces the permission. Only the
+// owner of the contact may share it.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/contacts/56/shares/bob --request "PUT" --header "Content-Type: application/json" --data '{"permission": "read"}'
+func shareContact(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	grantee := c.Param("grantee")
+	if len(grantee) > maxGranteeLength {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid grantee"})
+		return
+	}
+	var share model.Share
+	if err := c.BindJSON(&share); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid JSON"})
+		return
+	}
+	if share.Permission != permissionRead && share.Permission != permissionWrite {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid permission"})
+		return
+	}
+	contact := findContact(c.Request.Context(), selectWhereId, id, tenant(c))
+	if contact == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+		return
+	}
+	if !checkAccess(c, accessTo(c, contact), accessOwner, "contact not found") {
+		return
+	}
+	_, err := db.ExecContext(c.Request.Context(), `
+		INSERT INTO contact_shares (contact_id, grantee, permission)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE permission = VALUES(permission)`, id, grantee, share.Permission)
+	if err != nil {
+		log.Panicln(err)
+	}
+	shareChanges.Add(1)
+	c.IndentedJSON(http.StatusOK, model.Share{ContactId: id, Grantee: grantee, Permission: share.Permission})
+}
+
+// unshareContact stops sharing the contact whose ID value matches the id parameter of the request
+// URL with the user named by the grantee parameter. Only the owner of the contact may do this.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/contacts/56/shares/bob --request "DELETE"
+func unshareContact(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	contact := findContact(c.Request.Context(), selectWhereId, id, tenant(c))
+	if contact == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+		return
+	}
+	if !checkAccess(c, accessTo(c, contact), accessOwner, "contact not found") {
+		return
+	}
+	result, err := db.ExecContext(c.Request.Context(), "DELETE FROM contact_shares WHERE contact_id = ? AND grantee = ?", id, c.Param("grantee"))
+	if err != nil {
+		log.Panicln(err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		log.Panicln(err)
+	}
+	if rowsAffected == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "share not found"})
+		return
+	}
+	shareChanges.Add(1)
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "share deleted"})
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// visibleContactsPattern matches the visibleContacts condition in the expected SQL statements.
+var visibleContactsPattern = regexp.QuoteMeta(visibleContacts)
+
+// testUser is the user of the API key in the tests of the access control.
+const testUser = "key:billing"
+
+// expectOwnedSelect instructs the mock object to expect that a contact with the specified owner is
+// selected.
+func expectOwnedSelect(mock sqlmock.Sqlmock, id int, owner string) {
+	rows := mock.NewRows([]string{"id", "owner", "firstname", "lastname", "version"}).
+		AddRow(id, owner, "Erika", "Mustermann", 1)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\?").
+		WithArgs(int64(id), defaultTenant).
+		WillReturnRows(rows)
+}
+
+// expectSharePermission instructs the mock object to expect that the permission with which a
+// contact was shared with the test user is selected. An empty permission means that the contact was
+// not shared with the user.
+func expectSharePermission(mock sqlmock.Sqlmock, id int, permission string) {
+	rows := mock.NewRows([]string{"permission"})
+	if permission != "" {
+		rows.AddRow(permission)
+	}
+	mock.ExpectQuery("SELECT permission FROM contact_shares WHERE contact_id = \\? AND grantee = \\?").
+		WithArgs(int64(id), testUser).
+		WillReturnRows(rows)
+}
+
+// TestGetContactOfOtherUser executes a GET request for a contact of another user that was not
+// shared with the client. It expects that the HTTP request is answered with the NOT FOUND status
+// code.
+func TestGetContactOfOtherUser(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read", time.Now().UTC())
+	expectOwnedSelect(mock, 42, "alice")
+	expectSharePermission(mock, 42, "")
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetSharedContact executes a GET request for a contact of another user that was shared with
+// the client. It expects that the contact is returned.
+func TestGetSharedContact(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read", time.Now().UTC())
+	expectOwnedSelect(mock, 42, "alice")
+	expectSharePermission(mock, 42, permissionRead)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var contact model.Contact
+	json.Unmarshal(recorder.Body.Bytes(), &contact)
+	assert.Equal(t, "alice", *contact.Owner)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetAllAsUser executes a GET request for all contacts with an API key without the 'admin'
+// scope. It expects that the query is restricted to the contacts that the user may see.
+func TestGetAllAsUser(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read", time.Now().UTC())
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL AND "+visibleContactsPattern).
+		WithArgs(defaultTenant, false, testUser, testUser, epoch, sqlmock.AnyArg(), "0").
+		WillReturnRows(mock.NewRows([]string{"id", "owner", "firstname"}).AddRow(7, testUser, "Aaron"))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPutWithReadShare executes a PUT request for a contact that was shared with the client for
+// reading only. It expects that nothing is changed, and that the HTTP request is answered with the
+// FORBIDDEN status code.
+func TestPutWithReadShare(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read,write", time.Now().UTC())
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE").
+		WithArgs(int64(42), defaultTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "owner", "firstname", "version"}).AddRow(42, "alice", "Erika", 1))
+	expectSharePermission(mock, 42, permissionRead)
+	mock.ExpectRollback()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PUT", "/contacts/42", strings.NewReader(`{"firstname": "Mallory"}`),
+		map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestShareContact executes a PUT request with which the owner shares a contact with another user.
+// It expects that the share is stored and returned.
+func TestShareContact(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read,write", time.Now().UTC())
+	expectOwnedSelect(mock, 42, testUser)
+	mock.ExpectExec("INSERT INTO contact_shares").
+		WithArgs(int64(42), "bob", permissionWrite).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PUT", "/contacts/42/shares/bob", strings.NewReader(`{"permission": "write"}`),
+		map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var share model.Share
+	json.Unmarshal(recorder.Body.Bytes(), &share)
+	assert.Equal(t, int64(42), share.ContactId)
+	assert.Equal(t, "bob", share.Grantee)
+	assert.Equal(t, permissionWrite, share.Permission)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestShareContactNotOwner executes a PUT request with which a user tries to share a contact that
+// another user shared with them for writing. It expects that the HTTP request is answered with the
+// FORBIDDEN status code.
+func TestShareContactNotOwner(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read,write", time.Now().UTC())
+	expectOwnedSelect(mock, 42, "alice")
+	expectSharePermission(mock, 42, permissionWrite)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PUT", "/contacts/42/shares/bob", strings.NewReader(`{"permission": "write"}`),
+		map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestShareContactInvalidPermission executes a PUT request with an unknown permission. It expects
+// that the HTTP request is answered with the BAD REQUEST status code.
+func TestShareContactInvalidPermission(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+	// Run test and compare results
+	recorder := runTest(db, "PUT", "/contacts/42/shares/bob", strings.NewReader(`{"permission": "admin"}`))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestFindContactShares executes a GET request for the shares of a contact by its owner. It
+// expects that the shares are returned.
+func TestFindContactShares(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read", time.Now().UTC())
+	expectOwnedSelect(mock, 42, testUser)
+	mock.ExpectQuery("SELECT \\* FROM contact_shares WHERE contact_id = \\? ORDER BY grantee").
+		WithArgs(int64(42)).
+		WillReturnRows(mock.NewRows([]string{"contact_id", "grantee", "permission", "created_at"}).
+			AddRow(42, "bob", permissionRead, createdAt).
+			AddRow(42, "carol", permissionWrite, createdAt))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42/shares", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var shares []model.Share
+	json.Unmarshal(recorder.Body.Bytes(), &shares)
+	assert.Equal(t, 2, len(shares))
+	assert.Equal(t, "carol", shares[1].Grantee)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestUnshareContactNotFound executes a DELETE request for a share that does not exist. It expects
+// that the HTTP request is answered with the NOT FOUND status code.
+func TestUnshareContactNotFound(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read,write", time.Now().UTC())
+	expectOwnedSelect(mock, 42, testUser)
+	mock.ExpectExec("DELETE FROM contact_shares WHERE contact_id = \\? AND grantee = \\?").
+		WithArgs(int64(42), "bob").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "DELETE", "/contacts/42/shares/bob", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestVisibilityCache asks an event stream's cache several times whether contacts were shared with
+// the user. It expects that every share is looked up once, and again after a share was changed.
+func TestVisibilityCache(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSharePermission(mock, 42, permissionRead)
+	expectSharePermission(mock, 43, "")
+	expectSharePermission(mock, 42, "")
+
+	// Run test and compare results
+	initializeContactsService(db)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("GET", "/contacts/events", nil)
+	c.Set(actorKey, testUser)
+	cache := newVisibilityCache()
+	assert.True(t, cache.isShared(c, 42))
+	assert.True(t, cache.isShared(c, 42))
+	assert.False(t, cache.isShared(c, 43))
+	assert.False(t, cache.isShared(c, 43))
+	shareChanges.Add(1)
+	assert.False(t, cache.isShared(c, 42))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
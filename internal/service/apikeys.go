@@ -0,0 +1,390 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// apiKeyPrefix is the beginning of all API keys. It makes keys easy to recognize, for example by
+// secret scanners.
+const apiKeyPrefix = "csk_"
+
+// apiKeyPrefixLength is the number of characters at the beginning of a key that are stored in
+// clear text to recognize the key.
+const apiKeyPrefixLength = 12
+
+// lastUsedPrecision is the precision with which the last use of an API key is tracked. Tracking
+// every single use would turn every request into a write.
+const lastUsedPrecision = time.Minute
+
+// minBootstrapKeyLength is the minimum length of the bootstrap key, so that it cannot be guessed.
+const minBootstrapKeyLength = 32
+
+// bootstrapKeyHash is the hash of the bootstrap key, or nil if there is none. It is read from the
+// BOOTSTRAP_API_KEY or BOOTSTRAP_API_KEY_FILE environment variable when the router is set up.
+var bootstrapKeyHash []byte
+
+// apiKeyRow is an API key as it is stored in the database. Only the hash of the key is stored;
+// the scopes and the roles are stored as comma separated lists. Clients that authenticate with
+// the key belong to its tenant.
+type apiKeyRow struct {
+	Id         int64      `db:"id"`
+	TenantId   string     `db:"tenant_id"`
+	Name       string     `db:"name"`
+	Prefix     string     `db:"prefix"`
+	KeyHash    string     `db:"key_hash"`
+	Scopes     string     `db:"scopes"`
+	Roles      string     `db:"roles"`
+	CreatedAt  time.Time  `db:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+}
+
+// toAPIKey converts an API key row into the API key that is returned to clients, without the key
+// itself.
+func (row apiKeyRow) toAPIKey() model.APIKey {
+	apiKey := model.APIKey{
+		Id:         row.Id,
+		Name:       row.Name,
+		Prefix:     row.Prefix,
+		Scopes:     strings.Split(row.Scopes, ","),
+		CreatedAt:  row.CreatedAt,
+		LastUsedAt: row.LastUsedAt,
+		RevokedAt:  row.RevokedAt,
+	}
+	if row.Roles != "" {
+		apiKey.Roles = strings.Split(row.Roles, ",")
+	}
+	return apiKey
+}
+
+// generateAPIKey returns a new random API key.
+func generateAPIKey() string {
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		log.Panicln(err)
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+}
+
+// hashAPIKey returns the hash under which an API key is stored. Keys are long random values, so a
+// plain hash without salt is sufficient.
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// setupBootstrapKey reads the bootstrap key from the BOOTSTRAP_API_KEY environment variable, or
+// from the file named by BOOTSTRAP_API_KEY_FILE, for example a mounted secret. The bootstrap key
+// may only manage API keys, so that operators can create the first keys of every tenant without
+// accepting unauthenticated admin requests; see authenticateBootstrapKey. Without it, API keys can
+// only be managed with other API keys and bearer tokens that have the admin scope.
+func setupBootstrapKey() {
+	bootstrapKeyHash = nil
+	key := os.Getenv("BOOTSTRAP_API_KEY")
+	if file := os.Getenv("BOOTSTRAP_API_KEY_FILE"); file != "" {
+		if key != "" {
+			log.Fatal("only one of the BOOTSTRAP_API_KEY and BOOTSTRAP_API_KEY_FILE env variables may be set")
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key = strings.TrimSpace(string(data))
+	}
+	if key == "" {
+		return
+	}
+	if len(key) < minBootstrapKeyLength {
+		log.Fatalf("bootstrap API key must have at least %d characters", minBootstrapKeyLength)
+	}
+	hash := sha256.Sum256([]byte(key))
+	bootstrapKeyHash = hash[:]
+}
+
+// isBootstrapKey tells whether the key is the bootstrap key. The hashes are compared in constant
+// time, so that the comparison does not reveal how much of the key is correct.
+func isBootstrapKey(key string) bool {
+	if bootstrapKeyHash == nil {
+		return false
+	}
+	hash := sha256.Sum256([]byte(key))
+	return subtle.ConstantTimeCompare(hash[:], bootstrapKeyHash) == 1
+}
+
+// withinClientPermissions tells whether a key with the scopes and the roles grants no more than
+// the client of the request has. Every scope must be granted to the client, and a client with
+// roles may only hand out some of its own roles; a key without roles would not be restricted.
+func withinClientPermissions(c *gin.Context, scopes []string, roles []string) bool {
+	granted := c.GetStringSlice(scopesKey)
+	for _, scope := range scopes {
+		if !hasScope(granted, scope) {
+			return false
+		}
+	}
+	own := c.GetStringSlice(rolesKey)
+	if len(own) == 0 {
+		return true
+	}
+	if len(roles) == 0 {
+		return false
+	}
+	for _, name := range roles {
+		if !contains(own, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// findActiveAPIKey returns the API key with the specified value, or nil if there is no such key or
+// if it was revoked.
+func findActiveAPIKey(ctx context.Context, key string) *apiKeyRow {
+	var row apiKeyRow
+	err := db.GetContext(ctx, &row, "SELECT * FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL", hashAPIKey(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		log.Panicln(err)
+	}
+	return &row
+}
+
+// trackAPIKeyUsage records that the API key was used now, unless its last use was recorded less
+// than a minute ago.
+func trackAPIKeyUsage(ctx context.Context, row *apiKeyRow) {
+	now := time.Now().UTC()
+	if row.LastUsedAt != nil && now.Sub(*row.LastUsedAt) < lastUsedPrecision {
+		return
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ?", now, row.Id); err != nil {
+		log.Panicln(err)
+	}
+}
+
+// createAPIKey issues a new API key with the 'name', the 'scopes' and the optional 'roles'
+// specified in the request's JSON, for the tenant of the request. The response carries the key,
+// which is not returned again later. The key may not have more permissions than the client that
+// creates it: its scopes must be granted to the client, and if the client has roles, the key must
+// have some of them. Otherwise, the request is answered with the FORBIDDEN status code.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/api-keys --request "POST" --header "Content-Type: application/json" --data '{"name": "billing", "scopes": ["read"]}'
+//	> curl http://localhost:8080/api-keys --request "POST" --header "Content-Type: application/json" --data '{"name": "helpdesk", "scopes": ["write"], "roles": ["support"]}'
+func createAPIKey(c *gin.Context) {
+	var apiKey model.APIKey
+	if err := c.BindJSON(&apiKey); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid JSON"})
+		return
+	}
+	if apiKey.Name == "" || len(apiKey.Name) > 100 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid name"})
+		return
+	}
+	if len(apiKey.Scopes) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid scopes"})
+		return
+	}
+	for _, scope := range apiKey.Scopes {
+		if !contains(allScopes, scope) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid scopes"})
+			return
+		}
+	}
+	slices.Sort(apiKey.Scopes)
+	apiKey.Scopes = slices.Compact(apiKey.Scopes)
+	if !validRoles(apiKey.Roles) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid roles"})
+		return
+	}
+	slices.Sort(apiKey.Roles)
+	apiKey.Roles = slices.Compact(apiKey.Roles)
+	if !withinClientPermissions(c, apiKey.Scopes, apiKey.Roles) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "api key would have more permissions than the client"})
+		return
+	}
+
+	apiKey.Key = generateAPIKey()
+	apiKey.Prefix = apiKey.Key[:apiKeyPrefixLength]
+	result, err := db.ExecContext(c.Request.Context(), `
+		INSERT INTO api_keys (tenant_id, name, prefix, key_hash, scopes, roles)
+		VALUES (?, ?, ?, ?, ?, ?)`, tenant(c), apiKey.Name, apiKey.Prefix, hashAPIKey(apiKey.Key),
+		strings.Join(apiKey.Scopes, ","), strings.Join(apiKey.Roles, ","))
+	if err != nil {
+		log.Panicln(err)
+	}
+	apiKey.Id, err = result.LastInsertId()
+	if err != nil {
+		log.Panicln(err)
+	}
+	apiKey.CreatedAt = time.Now().UTC()
+	apiKey.LastUsedAt = nil
+	apiKey.RevokedAt = nil
+	c.IndentedJSON(http.StatusCreated, apiKey)
+}
+
+// findAPIKeys responds with the list of API keys of the tenant as JSON, including revoked keys.
+// The keys themselves are not included.
+//
+// The URL parameters 'limit' and 'offset' can be used for paging, like for findContacts.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/api-keys
+func findAPIKeys(c *gin.Context) {
+	limit, offset, success := parseLimitAndOffset(c)
+	if !success {
+		return
+	}
+	var rows []apiKeyRow
+	ctx := c.Request.Context()
+	err := db.SelectContext(ctx, &rows, `
+		SELECT *
+		FROM api_keys
+		WHERE tenant_id = ?
+		ORDER BY id
+		LIMIT ?
+		OFFSET ?`, tenant(c), limit, offset)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(rows) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "api key not found"})
+		return
+	}
+	apiKeys := make([]model.APIKey, len(rows))
+	for i, row := range rows {
+		apiKeys[i] = row.toAPIKey()
+	}
+	c.IndentedJSON(http.StatusOK, apiKeys)
+}
+
+// findAPIKeyByID responds with the API key whose ID value matches the id parameter of the request
+// URL. The key itself is not included.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/api-keys/3
+func findAPIKeyByID(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	row := findAPIKey(c.Request.Context(), tenant(c), id)
+	if row == nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "api key not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, row.toAPIKey())
+}
+
+// rotateAPIKey replaces the API key whose ID value matches the id parameter of the request URL
+// with a new key. The name, the scopes and the roles stay the same. The old key stops working
+// immediately. The response carries the new key, which is not returned again later. Revoked keys
+// cannot be rotated, and like when keys are created, clients may only rotate keys that do not
+// have more permissions than they have.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/api-keys/3/rotate --request "POST"
+func rotateAPIKey(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	row := findAPIKey(c.Request.Context(), tenant(c), id)
+	if row == nil || row.RevokedAt != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "api key not found"})
+		return
+	}
+	apiKey := row.toAPIKey()
+	if !withinClientPermissions(c, apiKey.Scopes, apiKey.Roles) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "api key has more permissions than the client"})
+		return
+	}
+	key := generateAPIKey()
+	result, err := db.ExecContext(c.Request.Context(), `
+		UPDATE api_keys
+		SET prefix = ?, key_hash = ?, last_used_at = NULL
+		WHERE id = ? AND tenant_id = ? AND revoked_at IS NULL`, key[:apiKeyPrefixLength], hashAPIKey(key), id, tenant(c))
+	if err != nil {
+		log.Panicln(err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		log.Panicln(err)
+	} else if rows == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "api key not found"})
+		return
+	}
+	apiKey.Key = key
+	apiKey.Prefix = key[:apiKeyPrefixLength]
+	apiKey.LastUsedAt = nil
+	c.IndentedJSON(http.StatusOK, apiKey)
+}
+
+// revokeAPIKey revokes the API key whose ID value matches the id parameter of the request URL.
+// The key stops working immediately, but stays in the list of keys. Like when keys are rotated,
+// clients may only revoke keys that do not have more permissions than they have.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/api-keys/3 --request "DELETE"
+func revokeAPIKey(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	row := findAPIKey(c.Request.Context(), tenant(c), id)
+	if row == nil || row.RevokedAt != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "api key not found"})
+		return
+	}
+	apiKey := row.toAPIKey()
+	if !withinClientPermissions(c, apiKey.Scopes, apiKey.Roles) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "api key has more permissions than the client"})
+		return
+	}
+	result, err := db.ExecContext(c.Request.Context(), `
+		UPDATE api_keys
+		SET revoked_at = ?
+		WHERE id = ? AND tenant_id = ? AND revoked_at IS NULL`, time.Now().UTC(), id, tenant(c))
+	if err != nil {
+		log.Panicln(err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		log.Panicln(err)
+	} else if rows == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "api key not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "api key revoked"})
+}
+
+// findAPIKey returns the API key of the tenant with the specified id, or nil if there is none.
+func findAPIKey(ctx context.Context, tenant string, id int64) *apiKeyRow {
+	var rows []apiKeyRow
+	if err := db.SelectContext(ctx, &rows, "SELECT * FROM api_keys WHERE id = ? AND tenant_id = ?", id, tenant); err != nil {
+		log.Panicln(err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return &rows[0]
+}
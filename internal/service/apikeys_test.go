@@ -0,0 +1,385 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// testAPIKey is the API key that clients send in the tests.
+const testAPIKey = "csk_w9YbUeRZKqAS1n3VtP8xLcHdJ2mGfE7o"
+
+// testBootstrapKey is the bootstrap key in the tests.
+const testBootstrapKey = "bootstrap-Xq4hV8sLw2RmT6yNc9KdJ3pF"
+
+// expectAPIKeyLookup instructs the mock object to expect that the API key of the request is
+// looked up. The key is returned with the specified scopes and last use. If scopes is empty, the
+// key is not found.
+func expectAPIKeyLookup(mock sqlmock.Sqlmock, scopes string, lastUsedAt time.Time) {
+	rows := mock.NewRows([]string{"id", "tenant_id", "name", "prefix", "key_hash", "scopes", "created_at", "last_used_at", "revoked_at"})
+	if scopes != "" {
+		rows.AddRow(3, defaultTenant, "billing", testAPIKey[:12], hashAPIKey(testAPIKey), scopes, createdAt, lastUsedAt, nil)
+	}
+	mock.ExpectQuery("SELECT \\* FROM api_keys WHERE key_hash = \\? AND revoked_at IS NULL").
+		WithArgs(hashAPIKey(testAPIKey)).
+		WillReturnRows(rows)
+}
+
+// TestCreateAPIKey executes a POST request for a new API key. It expects that only the hash of the
+// key is stored, and that the key is returned.
+func TestCreateAPIKey(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	mock.ExpectExec("INSERT INTO api_keys").
+		WithArgs(defaultTenant, "billing", sqlmock.AnyArg(), sqlmock.AnyArg(), "read,write", "").
+		WillReturnResult(sqlmock.NewResult(3, 1))
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "POST", "/api-keys", strings.NewReader(`{"name": "billing", "scopes": ["write", "read", "write"]}`))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var apiKey model.APIKey
+	json.Unmarshal(recorder.Body.Bytes(), &apiKey)
+	assert.Equal(t, int64(3), apiKey.Id)
+	assert.Regexp(t, "^csk_[A-Za-z0-9_-]{32}$", apiKey.Key)
+	assert.Equal(t, apiKey.Key[:12], apiKey.Prefix)
+	assert.Equal(t, []string{"read", "write"}, apiKey.Scopes)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestCreateAPIKeyInvalidBodies executes POST requests for new API keys with invalid bodies. It
+// expects that the HTTP requests are answered with the BAD REQUEST status code.
+func TestCreateAPIKeyInvalidBodies(t *testing.T) {
+	invalidRequestBodies := []string{
+		"not JSON",
+		`{"scopes": ["read"]}`,
+		`{"name": "` + strings.Repeat("x", 101) + `", "scopes": ["read"]}`,
+		`{"name": "billing"}`,
+		`{"name": "billing", "scopes": ["delete"]}`,
+	}
+	for _, body := range invalidRequestBodies {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+		expectAdminKeyLookup(mock)
+
+		// Run test and compare results
+		recorder := runAdminTest(db, "POST", "/api-keys", strings.NewReader(body))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "request body: "+body)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+// TestRotateAPIKey executes a POST request to rotate an API key. It expects that the hash of a new
+// key is stored, and that the new key is returned.
+func TestRotateAPIKey(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	mock.ExpectQuery("SELECT \\* FROM api_keys WHERE id = \\? AND tenant_id = \\?").
+		WithArgs(int64(3), defaultTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "name", "prefix", "key_hash", "scopes", "created_at"}).
+			AddRow(3, "billing", "csk_oldprefi", "0000", "read", createdAt))
+	mock.ExpectExec("UPDATE api_keys SET prefix = \\?, key_hash = \\?, last_used_at = NULL WHERE id = \\? AND tenant_id = \\? AND revoked_at IS NULL").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), int64(3), defaultTenant).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "POST", "/api-keys/3/rotate", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var apiKey model.APIKey
+	json.Unmarshal(recorder.Body.Bytes(), &apiKey)
+	assert.NotEqual(t, testAPIKey, apiKey.Key)
+	assert.Regexp(t, "^csk_", apiKey.Key)
+	assert.Equal(t, apiKey.Key[:12], apiKey.Prefix)
+	assert.Equal(t, []string{"read"}, apiKey.Scopes)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// expectRestrictedAdminLookup instructs the mock object to expect that the API key of the tests is
+// looked up, and returns it with the 'admin' scope and the 'support' role.
+func expectRestrictedAdminLookup(mock sqlmock.Sqlmock) {
+	rows := mock.NewRows([]string{"id", "tenant_id", "name", "prefix", "key_hash", "scopes", "roles", "created_at", "last_used_at", "revoked_at"}).
+		AddRow(5, defaultTenant, "helpdesk-admin", testAPIKey[:12], hashAPIKey(testAPIKey), "admin", "support", createdAt, time.Now().UTC(), nil)
+	mock.ExpectQuery("SELECT \\* FROM api_keys WHERE key_hash = \\? AND revoked_at IS NULL").
+		WithArgs(hashAPIKey(testAPIKey)).
+		WillReturnRows(rows)
+}
+
+// TestCreateAPIKeyBeyondRoles executes POST requests for new API keys on behalf of a client with
+// the 'support' role. It expects that keys without roles or with other roles are rejected with
+// the FORBIDDEN status code, and that a key with the client's role is created.
+func TestCreateAPIKeyBeyondRoles(t *testing.T) {
+	forbiddenRequestBodies := []string{
+		`{"name": "unrestricted", "scopes": ["read"]}`,
+		`{"name": "auditor", "scopes": ["read"], "roles": ["auditor"]}`,
+	}
+	for _, body := range forbiddenRequestBodies {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+		t.Setenv("ROLES_FILE", writeRoles(t, `{"support": {"endpoints": ["*"]}, "auditor": {"endpoints": ["*"]}}`))
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock)
+		expectRestrictedAdminLookup(mock)
+
+		// Run test and compare results
+		recorder := runTestWithHeaders(db, "POST", "/api-keys", strings.NewReader(body), map[string]string{apiKeyHeader: testAPIKey})
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "request body: "+body)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("ROLES_FILE", writeRoles(t, `{"support": {"endpoints": ["*"]}}`))
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectRestrictedAdminLookup(mock)
+	mock.ExpectExec("INSERT INTO api_keys").
+		WithArgs(defaultTenant, "helpdesk", sqlmock.AnyArg(), sqlmock.AnyArg(), "write", "support").
+		WillReturnResult(sqlmock.NewResult(6, 1))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "POST", "/api-keys", strings.NewReader(`{"name": "helpdesk", "scopes": ["write"], "roles": ["support"]}`),
+		map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRotateAPIKeyBeyondRoles executes a POST request to rotate an API key without roles on behalf
+// of a client with the 'support' role. It expects that the key is not rotated, and that the HTTP
+// request is answered with the FORBIDDEN status code.
+func TestRotateAPIKeyBeyondRoles(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("ROLES_FILE", writeRoles(t, `{"support": {"endpoints": ["*"]}}`))
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectRestrictedAdminLookup(mock)
+	mock.ExpectQuery("SELECT \\* FROM api_keys WHERE id = \\? AND tenant_id = \\?").
+		WithArgs(int64(3), defaultTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "name", "prefix", "key_hash", "scopes", "created_at"}).
+			AddRow(3, "billing", "csk_oldprefi", "0000", "admin", createdAt))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "POST", "/api-keys/3/rotate", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestBootstrapKey executes a POST request for a new API key of another tenant with the bootstrap
+// key, and a GET request for contacts with the same key. It expects that the key is created for
+// the tenant in the X-Tenant-ID header without looking up the bootstrap key, and that the
+// bootstrap key cannot be used for contacts.
+func TestBootstrapKey(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("REQUIRE_AUTH", "true")
+	t.Setenv("BOOTSTRAP_API_KEY", testBootstrapKey)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectExec("INSERT INTO api_keys").
+		WithArgs(otherTenant, "acme-admin", sqlmock.AnyArg(), sqlmock.AnyArg(), "admin", "").
+		WillReturnResult(sqlmock.NewResult(7, 1))
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/api-keys", strings.NewReader(`{"name": "acme-admin", "scopes": ["admin"]}`))
+	request.Header.Set(apiKeyHeader, testBootstrapKey)
+	request.Header.Set(tenantHeader, otherTenant)
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/contacts", nil)
+	request.Header.Set(apiKeyHeader, testBootstrapKey)
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRevokeAPIKeyNotFound executes a DELETE request for an API key that does not exist or was
+// already revoked. It expects that the HTTP request is answered with the NOT FOUND status code.
+func TestRevokeAPIKeyNotFound(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	mock.ExpectQuery("SELECT \\* FROM api_keys WHERE id = \\? AND tenant_id = \\?").
+		WithArgs(int64(9999), defaultTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "name", "prefix", "key_hash", "scopes", "created_at"}))
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "DELETE", "/api-keys/9999", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRevokeAPIKeyBeyondRoles executes a DELETE request to revoke an API key without roles on
+// behalf of a client with the 'support' role. It expects that the key is not revoked, and that the
+// HTTP request is answered with the FORBIDDEN status code.
+func TestRevokeAPIKeyBeyondRoles(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("ROLES_FILE", writeRoles(t, `{"support": {"endpoints": ["*"]}}`))
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectRestrictedAdminLookup(mock)
+	mock.ExpectQuery("SELECT \\* FROM api_keys WHERE id = \\? AND tenant_id = \\?").
+		WithArgs(int64(3), defaultTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "name", "prefix", "key_hash", "scopes", "created_at"}).
+			AddRow(3, "billing", "csk_oldprefi", "0000", "admin", createdAt))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "DELETE", "/api-keys/3", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestAuthenticateWithAPIKey executes a GET request with an API key that has the read scope and
+// was not used recently. It expects that the request succeeds, and that the use is tracked.
+func TestAuthenticateWithAPIKey(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("REQUIRE_AUTH", "true")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read", createdAt)
+	mock.ExpectExec("UPDATE api_keys SET last_used_at = \\? WHERE id = \\?").
+		WithArgs(sqlmock.AnyArg(), int64(3)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+	expectSingleRowSelect(mock, 42, "Erika", "Mustermann", "4711", time.Date(1969, time.March, 4, 0, 0, 0, 0, time.UTC))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil, map[string]string{"X-API-Key": testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestAuthenticateInsufficientScope executes a DELETE request with an API key that only has the
+// read scope and was used a moment ago. It expects that the request is answered with the
+// FORBIDDEN status code, and that the recent use is not tracked again.
+func TestAuthenticateInsufficientScope(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read", time.Now().UTC())
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "DELETE", "/contacts/42", nil, map[string]string{"X-API-Key": testAPIKey})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestAuthenticateInvalidAPIKey executes a GET request with an unknown API key. It expects that
+// the request is answered with the UNAUTHORIZED status code.
+func TestAuthenticateInvalidAPIKey(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "", time.Time{})
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil, map[string]string{"X-API-Key": testAPIKey})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestAuthenticationRequired executes a GET request without an API key while authentication is
+// required. It expects that the request is answered with the UNAUTHORIZED status code.
+func TestAuthenticationRequired(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("REQUIRE_AUTH", "true")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/42", nil)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestAnonymousNotAdmin executes requests for admin endpoints without credentials while
+// authentication is not required. It expects that the HTTP requests are answered with the
+// FORBIDDEN status code, since clients without credentials are never admins.
+func TestAnonymousNotAdmin(t *testing.T) {
+	for _, url := range []string{"/api-keys", "/webhooks"} {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+		// Run test and compare results
+		recorder := runTest(db, "GET", url, nil)
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "url: "+url)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+// TestHasScope verifies that the write scope implies the read scope, and that the admin scope
+// implies all scopes.
+func TestHasScope(t *testing.T) {
+	assert.True(t, hasScope([]string{"read"}, scopeRead))
+	assert.False(t, hasScope([]string{"read"}, scopeWrite))
+	assert.True(t, hasScope([]string{"write"}, scopeRead))
+	assert.False(t, hasScope([]string{"write"}, scopeAdmin))
+	assert.True(t, hasScope([]string{"admin"}, scopeWrite))
+	assert.False(t, hasScope(nil, scopeRead))
+}
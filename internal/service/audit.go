@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// requestIDHeader is the HTTP header that carries the id of a request. If the client does not
+// send one, the service generates it. It is always returned in the response.
+const requestIDHeader = "X-Request-ID"
+
+// actorHeader is the HTTP header with which clients identify the person on whose behalf they
+// change contacts.
+const actorHeader = "X-Actor"
+
+// requestIDKey is the key under which the request id is stored in the gin context.
+const requestIDKey = "requestID"
+
+// actorKey is the key under which the authenticated actor is stored in the gin context.
+const actorKey = "actor"
+
+// anonymousActor is recorded in the audit log if the actor of a change is unknown.
+const anonymousActor = "anonymous"
+
+// Actions that are recorded in the audit log.
+const (
+	actionCreate  = "create"
+	actionUpdate  = "update"
+	actionDelete  = "delete"
+	actionRestore = "restore"
+	actionRevert  = "revert"
+	actionMerge   = "merge"
+)
+
+// auditRow is an entry of the audit log as it is stored in the database. The contact values
+// before and after the change, and the ids of merged contacts, are stored as JSON. The owner of the
+// contact is not stored in the audit log, but passed on to the outbox.
+type auditRow struct {
+	Id        int64          `db:"id"`
+	TenantId  string         `db:"tenant_id"`
+	ContactId int64          `db:"contact_id"`
+	Action    string         `db:"action"`
+	Version   int64          `db:"version"`
+	Before    sql.NullString `db:"before_value"`
+	After     sql.NullString `db:"after_value"`
+	MergedIds sql.NullString `db:"merged_ids"`
+	Actor     string         `db:"actor"`
+	RequestId string         `db:"request_id"`
+	CreatedAt time.Time      `db:"created_at"`
+	Owner     string         `db:"-"`
+}
+
+// requestID returns a middleware that makes sure that every request has an id. The id is taken
+// from the X-Request-ID header, or generated if the header is missing. It is stored in the gin
+// context and returned in the response header.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			random := make([]byte, 16)
+			if _, err := rand.Read(random); err != nil {
+				log.Panicln(err)
+			}
+			id = hex.EncodeToString(random)
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// actor returns the identity on whose behalf the request is executed. This is the authenticated
+// identity if there is one. Otherwise it is taken from the X-Actor header, and defaults to
+// 'anonymous'.
+func actor(c *gin.Context) string {
+	if authenticated := c.GetString(actorKey); authenticated != "" {
+		return authenticated
+	}
+	if header := c.GetHeader(actorHeader); header != "" && len(header) <= 100 {
+		return header
+	}
+	return anonymousActor
+}
+
+// recordAudit writes an entry to the audit log within the specified transaction. The before
+// contact is nil for created contacts, the after contact is nil for deleted contacts.
+func recordAudit(tx *sqlx.Tx, c *gin.Context, action string, before *model.Contact, after *model.Contact) {
+	writeAudit(c.Request.Context(), tx, newAuditRow(c, action, before, after))
+}
+
+// newAuditRow creates an entry of the audit log for a change of a contact.
+func newAuditRow(c *gin.Context, action string, before *model.Contact, after *model.Contact) auditRow {
+	row := auditRow{
+		TenantId:  tenant(c),
+		Action:    action,
+		Actor:     actor(c),
+		RequestId: c.GetString(requestIDKey),
+		Before:    marshalContact(before),
+		After:     marshalContact(after),
+	}
+	contact := after
+	if after != nil {
+		row.ContactId = after.Id
+		row.Version = after.Version
+	} else {
+		contact = before
+		row.ContactId = before.Id
+		row.Version = before.Version + 1
+	}
+	if contact.Owner != nil {
+		row.Owner = *contact.Owner
+	}
+	return row
+}
+
+// writeAudit inserts an entry into the audit log within the specified transaction, together with
+// the matching event in the outbox, so that the event is published if and only if the transaction
+// is committed.
+func writeAudit(ctx context.Context, tx *sqlx.Tx, row auditRow) {
+	if _, err := tx.NamedStmt(insertAudit).ExecContext(ctx, &row); err != nil {
+		log.Panicln(err)
+	}
+	outbox := newOutboxRow(row)
+	if _, err := tx.NamedStmt(insertOutbox).ExecContext(ctx, &outbox); err != nil {
+		log.Panicln(err)
+	}
+}
+
+// marshalContact converts a contact into the JSON that is stored in the audit log.
+func marshalContact(contact *model.Contact) sql.NullString {
+	if contact == nil {
+		return sql.NullString{}
+	}
+	marshalled, err := json.Marshal(contact)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return sql.NullString{String: string(marshalled), Valid: true}
+}
+
+// unmarshalContact converts the JSON that is stored in the audit log back into a contact.
+func unmarshalContact(value sql.NullString) *model.Contact {
+	if !value.Valid {
+		return nil
+	}
+	var contact model.Contact
+	if err := json.Unmarshal([]byte(value.String), &contact); err != nil {
+		log.Panicln(err)
+	}
+	return &contact
+}
+
+// marshalIds converts a list of contact ids into the JSON that is stored in the audit log.
+func marshalIds(ids []int64) sql.NullString {
+	if len(ids) == 0 {
+		return sql.NullString{}
+	}
+	marshalled, err := json.Marshal(ids)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return sql.NullString{String: string(marshalled), Valid: true}
+}
+
+// unmarshalIds converts the JSON that is stored in the audit log back into a list of contact ids.
+func unmarshalIds(value sql.NullString) []int64 {
+	if !value.Valid {
+		return nil
+	}
+	var ids []int64
+	if err := json.Unmarshal([]byte(value.String), &ids); err != nil {
+		log.Panicln(err)
+	}
+	return ids
+}
+
+// toAuditEntry converts an audit log row into the entry that is returned to clients.
+func (row auditRow) toAuditEntry() model.AuditEntry {
+	return model.AuditEntry{
+		Id:        row.Id,
+		ContactId: row.ContactId,
+		Action:    row.Action,
+		Version:   row.Version,
+		Before:    unmarshalContact(row.Before),
+		After:     unmarshalContact(row.After),
+		MergedIds: unmarshalIds(row.MergedIds),
+		Actor:     row.Actor,
+		RequestId: row.RequestId,
+		CreatedAt: row.CreatedAt,
+	}
+}
+
+// findContactHistory responds with the list of changes of the contact whose ID value matches the
+// id parameter of the request URL, oldest change first. The history is also available for
+// contacts in the trash.
+//
+// The URL parameters 'limit' and 'offset' can be used for paging, like for findContacts.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/contacts/56/history
+func findContactHistory(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	limit, offset, success := parseLimitAndOffset(c)
+	if !success {
+		return
+	}
+	if !checkAccess(c, contactAccess(c, id), accessRead, "contact not found") {
+		return
+	}
+	var rows []auditRow
+	ctx := c.Request.Context()
+	err := db.SelectContext(ctx, &rows, `
+		SELECT *
+		FROM audit_log
+		WHERE contact_id = ? AND tenant_id = ?
+		ORDER BY id
+		LIMIT ?
+		OFFSET ?`, id, tenant(c), limit, offset)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(rows) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+		return
+	}
+	entries := make([]model.AuditEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = row.toAuditEntry()
+		for _, contact := range []*model.Contact{entries[i].Before, entries[i].After} {
+			if contact != nil {
+				*contact = redactContact(c, *contact)
+			}
+		}
+	}
+	c.IndentedJSON(http.StatusOK, entries)
+}
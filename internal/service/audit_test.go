@@ -0,0 +1,101 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// TestGetHistory executes a GET request for the history of a contact. It expects that the JSON
+// for the list of audit entries is returned, including the contact values before and after each
+// change.
+func TestGetHistory(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	rows := mock.NewRows(auditColumns).
+		AddRow(1, 29, "create", 1, nil, `{"id": 29, "firstname": "Erika", "version": 1}`, "alice", "req-1", createdAt).
+		AddRow(5, 29, "update", 2, `{"id": 29, "firstname": "Erika", "version": 1}`, `{"id": 29, "firstname": "Rudi", "version": 2}`, "bob", "req-2", createdAt.Add(time.Hour))
+	mock.ExpectQuery("SELECT \\* FROM audit_log WHERE contact_id = \\?").
+		WithArgs(int64(29), defaultTenant, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "GET", "/contacts/29/history", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var entries []model.AuditEntry
+	json.Unmarshal(recorder.Body.Bytes(), &entries)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "create", entries[0].Action)
+	assert.Nil(t, entries[0].Before)
+	assert.Equal(t, "Erika", *entries[0].After.FirstName)
+	assert.Equal(t, "alice", entries[0].Actor)
+	assert.Equal(t, "req-1", entries[0].RequestId)
+	assert.Equal(t, createdAt, entries[0].CreatedAt)
+	assert.Equal(t, "update", entries[1].Action)
+	assert.Equal(t, "Erika", *entries[1].Before.FirstName)
+	assert.Equal(t, "Rudi", *entries[1].After.FirstName)
+	assert.Equal(t, int64(2), entries[1].Version)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetHistoryNotFound executes a GET request for the history of a contact that never existed.
+// It expects that the HTTP request is answered with the NOT FOUND status code.
+func TestGetHistoryNotFound(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	mock.ExpectQuery("SELECT \\* FROM audit_log WHERE contact_id = \\?").
+		WithArgs(int64(9999), defaultTenant, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"id", "contact_id", "action"}))
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "GET", "/contacts/9999/history", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestAuditActorAndRequestID executes a POST request with an actor and a request id. It expects
+// that both are recorded in the audit log, and that the request id is returned in the response.
+func TestAuditActorAndRequestID(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectDuplicateCandidates(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO contacts").
+		WillReturnResult(sqlmock.NewResult(42, 1))
+	expectCreatedSelect(mock, 42, "Erika", nil, nil, nil)
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(defaultTenant, int64(42), "create", int64(1), nil, sqlmock.AnyArg(), nil, "alice", "req-42").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectOutbox(mock, 42, "created")
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`),
+		map[string]string{"X-Actor": "alice", "X-Request-ID": "req-42"})
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "req-42", recorder.Header().Get("X-Request-ID"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
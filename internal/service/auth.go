@@ -0,0 +1,217 @@
+package service
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/jwtauth"
+)
+
+// Scopes that grant permissions to clients. A client with the 'write' scope may also read, and a
+// client with the 'admin' scope may do everything.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+// apiKeyHeader is the HTTP header with which clients send their API key.
+const apiKeyHeader = "X-API-Key"
+
+// Defaults for the mapping of token claims to scopes.
+const (
+	defaultScopeClaim  = "scope"
+	defaultScopePrefix = "contacts:"
+)
+
+// scopesKey is the key under which the scopes of the client are stored in the gin context.
+const scopesKey = "scopes"
+
+// bootstrapKey is the key under which the gin context records that the client authenticated with
+// the bootstrap key.
+const bootstrapKey = "bootstrap"
+
+// bootstrapActor is the actor and the client of requests with the bootstrap key.
+const bootstrapActor = "key:bootstrap"
+
+// allScopes are the scopes that can be granted to clients.
+var allScopes = []string{scopeRead, scopeWrite, scopeAdmin}
+
+// anonymousScopes are the scopes of clients without credentials while authentication is not
+// required. They may read and change contacts, but not administer the tenant.
+var anonymousScopes = []string{scopeRead, scopeWrite}
+
+// requireAuth tells whether clients must authenticate. It is taken from the REQUIRE_AUTH
+// environment variable when the router is set up.
+var requireAuth = false
+
+// tokenVerifier verifies the bearer tokens of clients, or is nil if bearer tokens are not
+// accepted. It is set up from the JWT_* environment variables when the router is set up.
+var tokenVerifier *jwtauth.Verifier
+
+// scopeClaim is the claim of a bearer token that holds the client's scopes.
+var scopeClaim = defaultScopeClaim
+
+// scopePrefix is the prefix of the values of the scope claim that are scopes of this service.
+var scopePrefix = defaultScopePrefix
+
+// setupTokenVerification reads the configuration of bearer tokens from environment variables.
+// Bearer tokens are accepted if JWT_JWKS is set to the URL or the path of the JSON Web Key Set of
+// the OpenID Connect provider. JWT_ISSUER and JWT_AUDIENCE are the expected 'iss' and 'aud'
+// claims. JWT_SCOPE_CLAIM names the claim that holds the scopes and defaults to 'scope'. Only
+// the values with the prefix in JWT_SCOPE_PREFIX, which defaults to 'contacts:', are mapped to
+// scopes, so 'contacts:read' grants the read scope.
+func setupTokenVerification() {
+	tokenVerifier = nil
+	if jwks := os.Getenv("JWT_JWKS"); jwks != "" {
+		if os.Getenv("JWT_ISSUER") == "" || os.Getenv("JWT_AUDIENCE") == "" {
+			log.Fatal("JWT_ISSUER and JWT_AUDIENCE env variables are required with JWT_JWKS")
+		}
+		tokenVerifier = jwtauth.NewVerifier(jwtauth.NewKeySet(jwks), os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"))
+	}
+	scopeClaim = defaultScopeClaim
+	if value := os.Getenv("JWT_SCOPE_CLAIM"); value != "" {
+		scopeClaim = value
+	}
+	scopePrefix = defaultScopePrefix
+	if value, found := os.LookupEnv("JWT_SCOPE_PREFIX"); found {
+		scopePrefix = value
+	}
+}
+
+// authenticate returns a middleware that identifies the client of a request by its API key or its
+// bearer token, and stores the client's scopes in the gin context. The name of the key or the
+// subject of the token becomes the actor in the audit log. Requests with an unknown or revoked
+// key, or with an invalid token, are answered with the UNAUTHORIZED status code. Requests without
+// credentials are answered the same way if authentication is required, and are granted the read
+// and write scopes otherwise, so that the service can be used as before until keys are issued.
+// They are never granted the admin scope, which would give them access to all contacts and to the
+// management of webhooks and API keys.
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); found {
+			authenticateToken(c, token)
+			return
+		}
+		key := c.GetHeader(apiKeyHeader)
+		if key == "" {
+			if requireAuth {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "authentication required"})
+				return
+			}
+			c.Set(scopesKey, anonymousScopes)
+			c.Next()
+			return
+		}
+		if isBootstrapKey(key) {
+			authenticateBootstrapKey(c)
+			return
+		}
+		row := findActiveAPIKey(c.Request.Context(), key)
+		if row == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid API key"})
+			return
+		}
+		trackAPIKeyUsage(c.Request.Context(), row)
+		c.Set(actorKey, "key:"+row.Name)
+		c.Set(clientKey, "key:"+strconv.FormatInt(row.Id, 10))
+		c.Set(scopesKey, row.toAPIKey().Scopes)
+		c.Set(rolesKey, row.toAPIKey().Roles)
+		c.Set(tenantKey, row.TenantId)
+		c.Next()
+	}
+}
+
+// authenticateBootstrapKey grants the admin scope to a client with the bootstrap key, but only on
+// the endpoints that manage API keys; other requests are answered with the FORBIDDEN status code.
+// The client is not bound to a tenant and selects it with the X-Tenant-ID header, so that the
+// first keys of every tenant can be created.
+func authenticateBootstrapKey(c *gin.Context) {
+	if !strings.HasPrefix(c.FullPath(), "/api-keys") {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "bootstrap key may only manage API keys"})
+		return
+	}
+	c.Set(actorKey, bootstrapActor)
+	c.Set(clientKey, bootstrapActor)
+	c.Set(scopesKey, []string{scopeAdmin})
+	c.Set(bootstrapKey, true)
+	c.Next()
+}
+
+// authenticateToken verifies the bearer token of the request and stores the subject, the scopes,
+// the roles and the tenant of the token in the gin context. If no tenant claim is configured, all
+// tokens belong to the default tenant.
+func authenticateToken(c *gin.Context, token string) {
+	if tokenVerifier == nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "bearer tokens are not accepted"})
+		return
+	}
+	claims, err := tokenVerifier.Verify(token)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid bearer token"})
+		return
+	}
+	subject := claims.String("sub")
+	if subject == "" || len(subject) > 100 {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid bearer token"})
+		return
+	}
+	tokenTenant := defaultTenant
+	if tenantClaim != "" {
+		tokenTenant = claims.String(tenantClaim)
+		if !validTenant.MatchString(tokenTenant) {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid bearer token"})
+			return
+		}
+	}
+	c.Set(actorKey, subject)
+	c.Set(clientKey, "token:"+tokenTenant+"/"+subject)
+	c.Set(scopesKey, tokenScopes(claims))
+	if roleClaim != "" {
+		c.Set(rolesKey, claims.Strings(roleClaim))
+	}
+	c.Set(tenantKey, tokenTenant)
+	c.Next()
+}
+
+// tokenScopes maps the values of the scope claim of a token to the scopes of this service.
+func tokenScopes(claims jwtauth.Claims) []string {
+	var scopes []string
+	for _, value := range claims.Strings(scopeClaim) {
+		if scope, found := strings.CutPrefix(value, scopePrefix); found && contains(allScopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// requireScope returns a middleware that answers requests with the FORBIDDEN status code if the
+// client was not granted the scope.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasScope(c.GetStringSlice(scopesKey), scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "insufficient scope, " + scope + " required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// hasScope tells whether the granted scopes include the required scope, either directly or by a
+// scope that implies it.
+func hasScope(granted []string, required string) bool {
+	for _, scope := range granted {
+		if scope == required || scope == scopeAdmin || (scope == scopeWrite && required == scopeRead) {
+			return true
+		}
+	}
+	return false
+}
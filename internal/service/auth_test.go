@@ -0,0 +1,144 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/jwtauth"
+)
+
+// tokenKey is the key with which the bearer tokens in the tests are signed.
+var tokenKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+// setupTokenTest configures the service to accept bearer tokens that are signed with tokenKey.
+func setupTokenTest(t *testing.T) {
+	encode := func(value []byte) string { return base64.RawURLEncoding.EncodeToString(value) }
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "EC", "kid": "test", "crv": "P-256",
+		"x": encode(tokenKey.X.FillBytes(make([]byte, 32))), "y": encode(tokenKey.Y.FillBytes(make([]byte, 32))),
+	}}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_JWKS", path)
+	t.Setenv("JWT_ISSUER", "https://id.example.com")
+	t.Setenv("JWT_AUDIENCE", "contacts")
+}
+
+// bearerToken returns a token for the subject 'alice' with the scopes, signed with tokenKey.
+func bearerToken(t *testing.T, scope string) string {
+	head, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "test"})
+	payload, _ := json.Marshal(map[string]any{
+		"iss": "https://id.example.com", "aud": "contacts", "sub": "alice", "scope": scope,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, tokenKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return "Bearer " + signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// TestAuthenticateWithBearerToken executes a GET request with a bearer token that grants the read
+// scope. It expects that the request succeeds.
+func TestAuthenticateWithBearerToken(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupTokenTest(t)
+	t.Setenv("REQUIRE_AUTH", "true")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSingleRowSelect(mock, 42, "Erika", "Mustermann", "4711", time.Date(1969, time.March, 4, 0, 0, 0, 0, time.UTC))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil,
+		map[string]string{"Authorization": bearerToken(t, "openid contacts:read")})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestAuthenticateBearerTokenInsufficientScope executes a DELETE request with a bearer token that
+// only grants the read scope. It expects that the request is answered with the FORBIDDEN status
+// code.
+func TestAuthenticateBearerTokenInsufficientScope(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupTokenTest(t)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "DELETE", "/contacts/42", nil,
+		map[string]string{"Authorization": bearerToken(t, "contacts:read write")})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestAuthenticateInvalidBearerTokens executes GET requests with bearer tokens that are invalid,
+// or that are sent while bearer tokens are not accepted. It expects that the requests are answered
+// with the UNAUTHORIZED status code.
+func TestAuthenticateInvalidBearerTokens(t *testing.T) {
+	valid := func(t *testing.T) string { return bearerToken(t, "contacts:read") }
+	requests := []struct {
+		name   string
+		token  func(t *testing.T) string
+		accept bool
+	}{
+		{"malformed", func(t *testing.T) string { return "Bearer abc" }, true},
+		{"tampered", func(t *testing.T) string { return valid(t) + "x" }, true},
+		{"not accepted", valid, false},
+	}
+	for _, request := range requests {
+		t.Run(request.name, func(t *testing.T) {
+			db, mock := createMockObjects(t)
+			defer db.Close()
+			if request.accept {
+				setupTokenTest(t)
+			}
+
+			// Define expectations on SQL statements
+			expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+			// Run test and compare results
+			recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil,
+				map[string]string{"Authorization": request.token(t)})
+			assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+			assert.Equal(t, `Bearer error="invalid_token"`, recorder.Header().Get("WWW-Authenticate"))
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+// TestTokenScopes maps the scope claims of tokens to scopes. It expects that only the values with
+// the configured prefix are mapped, from a string or an array claim.
+func TestTokenScopes(t *testing.T) {
+	defer func() { scopeClaim, scopePrefix = defaultScopeClaim, defaultScopePrefix }()
+	assert.Equal(t, []string{"read", "admin"},
+		tokenScopes(jwtauth.Claims{"scope": "openid contacts:read contacts:admin contacts:delete read"}))
+
+	scopeClaim, scopePrefix = "roles", ""
+	assert.Equal(t, []string{"write"}, tokenScopes(jwtauth.Claims{"roles": []any{"write", "billing", 42}}))
+	assert.Empty(t, tokenScopes(jwtauth.Claims{"scope": "read"}))
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// changeTokenPrefix marks the change tokens of this format, so that the format can be changed
+// later without breaking clients that still hold old tokens.
+const changeTokenPrefix = "c1:"
+
+// defaultChangesLimit is the maximum number of audit log entries that are examined for a single
+// request if the client does not specify a limit.
+const defaultChangesLimit = 1000
+
+// changeSettleMargin is the time that a change is reported after the request timeout; see
+// changeSettleTime.
+const changeSettleMargin = time.Second
+
+// changeSettleTime returns the time that passes before a change is reported. Audit log ids are
+// assigned when a transaction writes its entry, not when it commits, so a transaction that started
+// earlier can commit an entry with a lower id after a later one. Every entry is written within a
+// request, whose transaction is rolled back once the request times out, so after the request
+// timeout and a margin for the commit, no entry with a lower id can appear any more, and clients do
+// not skip changes. This holds only for entries that the service writes itself: entries that are
+// written to the database directly, or by a request that outlives its timeout because the
+// database does not cancel it, may still be skipped.
+func changeSettleTime() time.Duration {
+	return requestTimeout + changeSettleMargin
+}
+
+// changeRow is the part of an audit log entry that is needed to compute the changes since a token.
+type changeRow struct {
+	Id        int64  `db:"id"`
+	ContactId int64  `db:"contact_id"`
+	Action    string `db:"action"`
+	Deleted   bool   `db:"deleted"`
+}
+
+// changes is the response to a request for the changes since a token. Every contact is listed at
+// most once, with its net change. HasMore is true if there are more changes to fetch with the
+// next token.
+type changes struct {
+	Created []int64 `json:"created"`
+	Updated []int64 `json:"updated"`
+	Deleted []int64 `json:"deleted"`
+	Next    string  `json:"next"`
+	HasMore bool    `json:"has_more"`
+}
+
+// findContactChanges responds with the ids of the contacts that were created, updated or deleted
+// since the point in time represented by the 'since' URL parameter, together with the token for
+// the next request. Without a token, all changes from the beginning are returned. Changes are
+// only reported once they are older than the request timeout; see changeSettleTime. Deleted
+// contacts, including contacts in the trash and merged contacts, are reported as tombstones, so
+// that clients can remove them. Contacts that are restored from the trash are reported as
+// updated, so clients must be prepared to fetch updated contacts that they do not know yet.
+//
+// The URL parameter 'limit' restricts the number of changes that are examined. If there are more
+// changes, 'has_more' is true and the client continues with the next token.
+//
+// Example REST API calls:
+//
+//	> curl "http://localhost:8080/contacts/changes"
+//	> curl "http://localhost:8080/contacts/changes?since=YzE6MTIzNA&limit=100"
+func findContactChanges(c *gin.Context) {
+	since, success := parseChangeToken(c.Query("since"))
+	if !success {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid since parameter"})
+		return
+	}
+	limit := defaultChangesLimit
+	if value := c.Query("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > defaultChangesLimit {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid limit parameter"})
+			return
+		}
+	}
+
+	var rows []changeRow
+	ctx := c.Request.Context()
+	err := db.SelectContext(ctx, &rows, `
+		SELECT id, contact_id, action, after_value IS NULL AS deleted
+		FROM audit_log
+		WHERE tenant_id = ? AND id > ? AND created_at < NOW(6) - INTERVAL ? MICROSECOND
+			AND (? OR contact_id IN (SELECT id FROM contacts WHERE `+visibleContacts+`))
+		ORDER BY id
+		LIMIT ?`, append(append([]interface{}{tenant(c), since, changeSettleTime().Microseconds(), isAdmin(c)},
+		visibilityArgs(c)...), limit)...)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	result := changes{Created: []int64{}, Updated: []int64{}, Deleted: []int64{}, Next: changeToken(since)}
+	created := make(map[int64]bool)
+	deleted := make(map[int64]bool)
+	var order []int64
+	for _, row := range rows {
+		if _, seen := created[row.ContactId]; !seen {
+			order = append(order, row.ContactId)
+			created[row.ContactId] = row.Action == actionCreate
+		}
+		deleted[row.ContactId] = row.Deleted
+		result.Next = changeToken(row.Id)
+	}
+	for _, id := range order {
+		switch {
+		case deleted[id]:
+			result.Deleted = append(result.Deleted, id)
+		case created[id]:
+			result.Created = append(result.Created, id)
+		default:
+			result.Updated = append(result.Updated, id)
+		}
+	}
+	result.HasMore = len(rows) == limit
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+// changeToken returns the opaque token that represents the position in the audit log after the
+// entry with the specified id.
+func changeToken(auditId int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(changeTokenPrefix + strconv.FormatInt(auditId, 10)))
+}
+
+// parseChangeToken returns the audit log id that the token represents. An empty token represents
+// the beginning of the audit log.
+func parseChangeToken(token string) (auditId int64, success bool) {
+	if token == "" {
+		return 0, true
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, false
+	}
+	value, found := strings.CutPrefix(string(decoded), changeTokenPrefix)
+	if !found {
+		return 0, false
+	}
+	auditId, err = strconv.ParseInt(value, 10, 64)
+	if err != nil || auditId < 0 {
+		return 0, false
+	}
+	return auditId, true
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGetChanges executes a GET request for the changes since a token. It expects that every
+// contact is reported once with its net change, and that the token for the next request points
+// after the last examined audit log entry.
+func TestGetChanges(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	rows := mock.NewRows([]string{"id", "contact_id", "action", "deleted"}).
+		AddRow(11, 7, "create", false).
+		AddRow(12, 8, "update", false).
+		AddRow(13, 7, "update", false).
+		AddRow(14, 9, "create", false).
+		AddRow(15, 9, "delete", true).
+		AddRow(16, 5, "merge", true)
+	mock.ExpectQuery("SELECT id, contact_id, action, after_value IS NULL AS deleted FROM audit_log WHERE tenant_id = \\? AND id > \\?").
+		WithArgs(defaultTenant, int64(10), int64(11000000), false, false, "", "", 1000).
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/changes?since="+changeToken(10), nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var body changes
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	assert.Equal(t, []int64{7}, body.Created)
+	assert.Equal(t, []int64{8}, body.Updated)
+	assert.Equal(t, []int64{9, 5}, body.Deleted)
+	assert.Equal(t, changeToken(16), body.Next)
+	assert.False(t, body.HasMore)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetChangesNoChanges executes a GET request for the changes since a token when nothing has
+// changed. It expects that only changes older than the request timeout are examined, empty lists
+// and the same token for the next request.
+func TestGetChangesNoChanges(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("REQUEST_TIMEOUT", "30s")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT id, contact_id, action, after_value IS NULL AS deleted FROM audit_log WHERE tenant_id = \\? AND id > \\?").
+		WithArgs(defaultTenant, int64(42), int64(31000000), false, false, "", "", 2).
+		WillReturnRows(mock.NewRows([]string{"id", "contact_id", "action", "deleted"}))
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/changes?limit=2&since="+changeToken(42), nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var body changes
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	assert.Equal(t, []int64{}, body.Created)
+	assert.Equal(t, []int64{}, body.Updated)
+	assert.Equal(t, []int64{}, body.Deleted)
+	assert.Equal(t, changeToken(42), body.Next)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetChangesHasMore executes a GET request for the changes with a limit that is reached. It
+// expects that the client is told to fetch more changes.
+func TestGetChangesHasMore(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	rows := mock.NewRows([]string{"id", "contact_id", "action", "deleted"}).
+		AddRow(1, 7, "create", false).
+		AddRow(2, 8, "create", false)
+	mock.ExpectQuery("SELECT id, contact_id, action, after_value IS NULL AS deleted FROM audit_log WHERE tenant_id = \\? AND id > \\?").
+		WithArgs(defaultTenant, int64(0), sqlmock.AnyArg(), false, false, "", "", 2).
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/changes?limit=2", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var body changes
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	assert.Equal(t, []int64{7, 8}, body.Created)
+	assert.Equal(t, changeToken(2), body.Next)
+	assert.True(t, body.HasMore)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetChangesInvalidParameters executes GET requests for the changes with invalid tokens and
+// limits. It expects that the HTTP requests are answered with the BAD REQUEST status code.
+func TestGetChangesInvalidParameters(t *testing.T) {
+	invalidQueries := []string{
+		"since=garbage!",
+		"since=" + changeToken(-1),
+		"since=MTIz", // not a change token
+		"limit=0",
+		"limit=1001",
+		"limit=many",
+	}
+	for _, query := range invalidQueries {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+		// Run test and compare results
+		recorder := runTest(db, "GET", "/contacts/changes?"+query, nil)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "query: "+query)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/duplicates"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// defaultDuplicateThreshold is the minimum score for two contacts to be considered duplicates if
+// the environment variable DUPLICATE_THRESHOLD is not set.
+const defaultDuplicateThreshold = 0.85
+
+// Modes of the duplicate check when contacts are created.
+const (
+	duplicateCheckOff    = "off"
+	duplicateCheckWarn   = "warn"
+	duplicateCheckStrict = "strict"
+)
+
+// duplicateFields are the fields of contacts that the duplicate detection compares.
+var duplicateFields = []string{"firstname", "lastname", "phone", "birthday"}
+
+// maxDuplicateCandidates is the maximum number of existing contacts that a new contact is
+// compared with.
+const maxDuplicateCandidates = 1000
+
+// duplicateThreshold is the minimum score for two contacts to be considered duplicates. It is
+// taken from the DUPLICATE_THRESHOLD environment variable when the router is set up.
+var duplicateThreshold = defaultDuplicateThreshold
+
+// duplicateCheck is the mode of the duplicate check when contacts are created. It is taken from
+// the DUPLICATE_CHECK environment variable when the router is set up.
+var duplicateCheck = duplicateCheckWarn
+
+// setupDuplicateCheck reads the configuration of the duplicate detection from the environment
+// variables DUPLICATE_THRESHOLD and DUPLICATE_CHECK.
+func setupDuplicateCheck() {
+	duplicateThreshold = defaultDuplicateThreshold
+	if value := os.Getenv("DUPLICATE_THRESHOLD"); value != "" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			log.Fatal("could not parse DUPLICATE_THRESHOLD env variable ", value)
+		}
+		duplicateThreshold = threshold
+	}
+	duplicateCheck = duplicateCheckWarn
+	if value := strings.ToLower(os.Getenv("DUPLICATE_CHECK")); value != "" {
+		if !contains([]string{duplicateCheckOff, duplicateCheckWarn, duplicateCheckStrict}, value) {
+			log.Fatal("could not parse DUPLICATE_CHECK env variable ", value)
+		}
+		duplicateCheck = value
+	}
+}
+
+// findDuplicateContacts responds with groups of contacts that probably describe the same person,
+// together with the confidence of each group. The groups with the highest confidence come first.
+//
+// The URL parameter 'threshold' overrides the configured minimum score between 0 and 1. The URL
+// parameters 'limit' and 'offset' can be used for paging through the groups. Address books with
+// more than 10000 contacts are not searched, since the comparison takes quadratic time. Clients
+// whose roles hide any of the compared fields on some contacts get the FORBIDDEN status code,
+// since the groups would reveal the hidden values.
+//
+// Example REST API calls:
+//
+//	> curl "http://localhost:8080/contacts/duplicates"
+//	> curl "http://localhost:8080/contacts/duplicates?threshold=0.95&limit=10"
+func findDuplicateContacts(c *gin.Context) {
+	threshold := duplicateThreshold
+	if value := c.Query("threshold"); value != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid threshold parameter"})
+			return
+		}
+	}
+	limitParam, offsetParam, success := parseLimitAndOffset(c)
+	if !success {
+		return
+	}
+	limit, _ := strconv.Atoi(limitParam)
+	offset, _ := strconv.Atoi(offsetParam)
+	if !checkFieldFilters(c, duplicateFields) {
+		return
+	}
+
+	var contacts []model.Contact
+	args := append([]interface{}{tenant(c)}, visibilityArgs(c)...)
+	ctx := c.Request.Context()
+	args = append(args, maxDuplicateScan+1)
+	err := db.SelectContext(ctx, &contacts, "SELECT * FROM contacts WHERE tenant_id = ? AND deleted_at IS NULL AND "+visibleContacts+" ORDER BY id LIMIT ?", args...)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(contacts) > maxDuplicateScan {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprintf("too many contacts to search for duplicates, maximum is %d", maxDuplicateScan)})
+		return
+	}
+	groups := duplicates.FindGroups(contacts, threshold)
+	if offset >= len(groups) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "no duplicates found"})
+		return
+	}
+	groups = groups[offset:]
+	if limit < len(groups) {
+		groups = groups[:limit]
+	}
+	for _, group := range groups {
+		redactContacts(c, group.Contacts)
+	}
+	c.IndentedJSON(http.StatusOK, groups)
+}
+
+// checkDuplicates compares a new contact with the existing contacts that have similar names. In
+// warn mode, probable duplicates are reported in a Warning header and the contact is created
+// anyway. In strict mode, the request is answered with the CONFLICT status code and the list of
+// probable duplicates. Only the fields of the existing contacts that the client may read are
+// compared. It returns false if the contact must not be created.
+func checkDuplicates(c *gin.Context, contact model.Contact) bool {
+	if duplicateCheck == duplicateCheckOff {
+		return true
+	}
+	candidates := findDuplicateCandidates(c, contact)
+	if len(candidates) == 0 {
+		return true
+	}
+	redactContacts(c, candidates)
+	matches := duplicates.FindMatches(contact, candidates, duplicateThreshold)
+	if len(matches) == 0 {
+		return true
+	}
+	if duplicateCheck == duplicateCheckStrict {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "probable duplicate", "duplicates": matches})
+		return false
+	}
+	ids := make([]string, len(matches))
+	for i, match := range matches {
+		ids[i] = strconv.FormatInt(match.Contact.Id, 10)
+	}
+	c.Header("Warning", fmt.Sprintf(`199 contacts-service "probable duplicate of contacts %s"`, strings.Join(ids, ", ")))
+	return true
+}
+
+// findDuplicateCandidates selects the existing contacts of the contact's tenant that the user of
+// the request may see, and whose first or last names start like the first or last name of the
+// contact. Names may be swapped, so both columns are searched for both names. Contacts without any
+// name are never considered duplicates.
+func findDuplicateCandidates(c *gin.Context, contact model.Contact) []model.Contact {
+	var prefixes []interface{}
+	for _, name := range []*string{contact.FirstName, contact.LastName} {
+		if name == nil {
+			continue
+		}
+		runes := []rune(strings.TrimSpace(*name))
+		if len(runes) == 0 {
+			continue
+		}
+		prefix := escapeLike(string(runes[:min(len(runes), 2)])) + "%"
+		prefixes = append(prefixes, prefix, prefix)
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	conditions := strings.TrimSuffix(strings.Repeat("firstname LIKE ? OR lastname LIKE ? OR ", len(prefixes)/2), " OR ")
+	args := append(append([]interface{}{contact.TenantId}, visibilityArgs(c)...), prefixes...)
+	var candidates []model.Contact
+	err := db.SelectContext(c.Request.Context(), &candidates, `
+		SELECT *
+		FROM contacts
+		WHERE tenant_id = ? AND deleted_at IS NULL AND `+visibleContacts+` AND (`+conditions+`)
+		LIMIT `+strconv.Itoa(maxDuplicateCandidates), args...)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return candidates
+}
+
+// escapeLike escapes the wildcard characters of a LIKE pattern.
+func escapeLike(str string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(str)
+}
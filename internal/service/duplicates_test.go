@@ -0,0 +1,169 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/duplicates"
+)
+
+// TestGetDuplicates executes a GET request for duplicate contacts. It expects that contacts with
+// similar names and equal phone numbers are grouped, and that other contacts are left out.
+func TestGetDuplicates(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "phone", "version"}).
+		AddRow(3, "Erika", "Mustermann", "+49 815 471100", 1).
+		AddRow(7, "Hans", "Wurst", nil, 1).
+		AddRow(12, "erika", "Musterman", "0815 471100", 2)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL AND " + visibleContactsPattern + " ORDER BY id LIMIT \\?").
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/duplicates", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var groups []duplicates.Group
+	json.Unmarshal(recorder.Body.Bytes(), &groups)
+	assert.Equal(t, 1, len(groups))
+	assert.Equal(t, 2, len(groups[0].Contacts))
+	assert.Equal(t, int64(3), groups[0].Contacts[0].Id)
+	assert.Equal(t, int64(12), groups[0].Contacts[1].Id)
+	assert.Greater(t, groups[0].Confidence, 0.9)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetDuplicatesNotFound executes a GET request for duplicate contacts with a threshold that
+// none of the contacts reach. It expects that the HTTP request is answered with the NOT FOUND
+// status code.
+func TestGetDuplicatesNotFound(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "version"}).
+		AddRow(3, "Erika", "Mustermann", 1).
+		AddRow(12, "Erika", "Musterfrau", 1)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL AND " + visibleContactsPattern + " ORDER BY id LIMIT \\?").
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/duplicates?threshold=0.99", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetDuplicatesInvalidThreshold executes GET requests for duplicate contacts with invalid
+// thresholds. It expects that the HTTP requests are answered with the BAD REQUEST status code.
+func TestGetDuplicatesInvalidThreshold(t *testing.T) {
+	for _, threshold := range []string{"abc", "0", "1.5", "-0.5"} {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+		// Run test and compare results
+		recorder := runTest(db, "GET", "/contacts/duplicates?threshold="+threshold, nil)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "threshold: "+threshold)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+// TestPostDuplicateWarning executes a POST request for a contact that probably already exists. It
+// expects that the contact is created anyway, and that the duplicate is reported in a Warning
+// header.
+func TestPostDuplicateWarning(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL AND "+visibleContactsPattern+" AND \\(firstname LIKE").
+		WithArgs(defaultTenant, false, "", "", "Er%", "Er%", "Mu%", "Mu%").
+		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "version"}).
+			AddRow(12, "Erika", "Mustermann", 1).
+			AddRow(15, "Ernst", "Mueller", 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO contacts").
+		WillReturnResult(sqlmock.NewResult(42, 1))
+	expectCreatedSelect(mock, 42, "Erika", "Mustermann", nil, nil)
+	expectAudit(mock, 42, "create", 1)
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runTest(db, "POST", "/contacts", strings.NewReader(`{"firstname": "Erika", "lastname": "Mustermann"}`))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, `199 contacts-service "probable duplicate of contacts 12"`, recorder.Header().Get("Warning"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPostDuplicateStrict executes a POST request for a contact that probably already exists while
+// the duplicate check is strict. It expects that the HTTP request is answered with the CONFLICT
+// status code and the list of probable duplicates, and that no contact is created.
+func TestPostDuplicateStrict(t *testing.T) {
+	t.Setenv("DUPLICATE_CHECK", "strict")
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL AND "+visibleContactsPattern+" AND \\(firstname LIKE").
+		WithArgs(defaultTenant, false, "", "", "Er%", "Er%", "Mu%", "Mu%").
+		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "version"}).
+			AddRow(12, "Mustermann", "Erika", 1))
+
+	// Run test and compare results
+	recorder := runTest(db, "POST", "/contacts", strings.NewReader(`{"firstname": "Erika", "lastname": "Mustermann"}`))
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	var body struct {
+		Duplicates []duplicates.Match `json:"duplicates"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	assert.Equal(t, 1, len(body.Duplicates))
+	assert.Equal(t, int64(12), body.Duplicates[0].Contact.Id)
+	assert.Equal(t, 1.0, body.Duplicates[0].Confidence)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPostDuplicateCheckOff executes a POST request while the duplicate check is turned off. It
+// expects that the contact is created without looking for duplicates.
+func TestPostDuplicateCheckOff(t *testing.T) {
+	t.Setenv("DUPLICATE_CHECK", "off")
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO contacts").
+		WillReturnResult(sqlmock.NewResult(42, 1))
+	expectCreatedSelect(mock, 42, "Erika", "Mustermann", nil, nil)
+	expectAudit(mock, 42, "create", 1)
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runTest(db, "POST", "/contacts", strings.NewReader(`{"firstname": "Erika", "lastname": "Mustermann"}`))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "", recorder.Header().Get("Warning"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// anyVersion is passed to the update and delete statements instead of a version number if the
+// client did not make the request conditional on a specific version of the contact.
+const anyVersion = int64(0)
+
+// requireIfMatch specifies whether PUT, PATCH and DELETE requests must carry an If-Match header.
+// It is taken from the REQUIRE_IF_MATCH environment variable when the router is set up.
+var requireIfMatch bool
+
+// contactETag returns the strong entity tag of a contact, which is derived from its version.
+func contactETag(contact model.Contact) string {
+	return fmt.Sprintf(`"%d"`, contact.Version)
+}
+
+// listETag returns a weak entity tag for a list of contacts, which is derived from a hash of its
+// JSON representation.
+func listETag(contacts []model.Contact) string {
+	marshalled, err := json.Marshal(contacts)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(marshalled)
+	return `W/"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// parseIfMatch inspects the If-Match header and determines the version that the client expects
+// the contact to have. If the header is missing or '*', any version is accepted, unless the
+// header is required. In that case the request is answered with the PRECONDITION REQUIRED status
+// code. A header that cannot match any version is answered with the PRECONDITION FAILED status
+// code.
+func parseIfMatch(c *gin.Context) (version int64, success bool) {
+	ifMatch := strings.TrimSpace(c.GetHeader("If-Match"))
+	if ifMatch == "" {
+		if requireIfMatch {
+			c.AbortWithStatusJSON(http.StatusPreconditionRequired, gin.H{"message": "If-Match header required"})
+			return anyVersion, false
+		}
+		return anyVersion, true
+	}
+	if ifMatch == "*" {
+		return anyVersion, true
+	}
+	unquoted, err := strconv.Unquote(ifMatch)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"message": "contact version does not match"})
+		return anyVersion, false
+	}
+	version, err = strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version <= anyVersion {
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"message": "contact version does not match"})
+		return anyVersion, false
+	}
+	return version, true
+}
+
+// matchesIfNoneMatch returns true if the If-None-Match header of the request contains the entity
+// tag, or is '*'. Entity tags are compared with the weak comparison function, so a 'W/' prefix is
+// ignored.
+func matchesIfNoneMatch(c *gin.Context, etag string) bool {
+	ifNoneMatch := strings.TrimSpace(c.GetHeader("If-None-Match"))
+	if ifNoneMatch == "" {
+		return false
+	}
+	if ifNoneMatch == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
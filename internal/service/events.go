@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/events"
+)
+
+// eventHistorySize is the number of recent events that are kept for clients that resume their
+// event stream.
+const eventHistorySize = 1000
+
+// heartbeatInterval is the time between two heartbeat pings on an idle event stream. The pings
+// keep proxies from closing the connection and let clients detect broken connections.
+var heartbeatInterval = 15 * time.Second
+
+// eventBus distributes the changes of contacts to the clients of the event stream.
+var eventBus = events.NewBus(eventHistorySize)
+
+// eventStreamRelay publishes the events in the outbox to the clients of the event stream of this
+// instance of the service, whichever instance dispatches them to the sinks. It remembers the
+// events that it published, so that every event is published once; after a restart, the events
+// of the last moments are published again.
+type eventStreamRelay struct {
+	published map[int64]bool
+}
+
+// newEventStreamRelay creates a relay that did not publish any events yet.
+func newEventStreamRelay() *eventStreamRelay {
+	return &eventStreamRelay{published: make(map[int64]bool)}
+}
+
+// publish publishes the events that were written to the outbox and not published yet, in the order
+// in which they were written. It examines the events of the settle time of the changes, since
+// events with lower ids may be committed later than this; see changeSettleTime. Older events were
+// published before. It returns the number of published events.
+func (relay *eventStreamRelay) publish(ctx context.Context) (int, error) {
+	var rows []outboxRow
+	err := db.SelectContext(ctx, &rows, `
+		SELECT * FROM outbox
+		WHERE created_at > NOW(6) - INTERVAL ? MICROSECOND
+		ORDER BY id`, changeSettleTime().Microseconds())
+	if err != nil {
+		return 0, err
+	}
+	// events that are no longer examined are forgotten, since they will not be selected again
+	published := make(map[int64]bool, len(rows))
+	count := 0
+	for _, row := range rows {
+		published[row.Id] = true
+		if relay.published[row.Id] {
+			continue
+		}
+		event, err := row.toEvent()
+		if err != nil {
+			log.Println("could not publish event to the event stream:", err)
+			continue
+		}
+		eventBus.Publish(event)
+		count++
+	}
+	relay.published = published
+	return count, nil
+}
+
+// streamContactEvents streams the changes of the tenant's contacts to the client as Server-Sent
+// Events. Every event carries the type of the change, which is 'created', 'updated' or 'deleted',
+// and as data the contact after the change.
+//
+// The URL parameter 'types' is a comma separated list of the types of events that the client is
+// interested in. The URL parameter 'ids' is a comma separated list of contact ids; if it is
+// given, only events for these contacts are sent.
+//
+// Every event carries the id of the event in the outbox, which is the same on all instances of
+// the service. Clients that reconnect, to this or to another instance, send the id of the last
+// event they received in the Last-Event-ID header, and receive the later events they missed. If these events are no longer available, the stream starts
+// with a 'reset' event, and the client must catch up with the /contacts/changes endpoint. Idle
+// streams carry a heartbeat comment every 15 seconds. Streams end when the service shuts down.
+//
+// Example REST API calls:
+//
+//	> curl --no-buffer "http://localhost:8080/contacts/events"
+//	> curl --no-buffer "http://localhost:8080/contacts/events?types=created,deleted&ids=12,15"
+func streamContactEvents(c *gin.Context) {
+	types, ids, success := parseEventFilters(c)
+	if !success {
+		return
+	}
+	var lastEventId int64
+	resume := false
+	if header := c.GetHeader("Last-Event-ID"); header != "" {
+		var err error
+		lastEventId, err = strconv.ParseInt(header, 10, 64)
+		if err != nil || lastEventId < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid Last-Event-ID header"})
+			return
+		}
+		resume = true
+	}
+
+	subscription, missed, complete := eventBus.Subscribe(lastEventId, resume)
+	defer eventBus.Unsubscribe(subscription)
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	if !complete {
+		c.Render(-1, sse.Event{Event: "reset", Data: gin.H{"message": "events were missed"}})
+	}
+	visibility := newVisibilityCache()
+	send := func(event events.Event) {
+		if event.TenantId == tenant(c) && (len(types) == 0 || contains(types, event.Type)) && (len(ids) == 0 || ids[event.ContactId]) && mayReceive(c, visibility, event) {
+			if event.Contact != nil {
+				// the event is shared with the other subscribers, so only its copy is redacted
+				redacted := redactContact(c, *event.Contact)
+				event.Contact = &redacted
+			}
+			c.Render(-1, sse.Event{Id: strconv.FormatInt(event.Id, 10), Event: event.Type, Data: event})
+		}
+	}
+	for _, event := range missed {
+		send(event)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-drained():
+			// the service shuts down, the client has to reconnect to another instance
+			return
+		case event, open := <-subscription.C:
+			if !open {
+				// the client fell behind, it has to reconnect
+				return
+			}
+			send(event)
+		case <-heartbeat.C:
+			c.Writer.WriteString(": ping\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+// parseEventFilters inspects the URL parameters 'types' and 'ids' of the event stream.
+func parseEventFilters(c *gin.Context) (types []string, ids map[int64]bool, success bool) {
+	if value := c.Query("types"); value != "" {
+		types = strings.Split(value, ",")
+		for _, eventType := range types {
+			if !contains([]string{events.Created, events.Updated, events.Deleted}, eventType) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid types parameter"})
+				return nil, nil, false
+			}
+		}
+	}
+	if value := c.Query("ids"); value != "" {
+		ids = make(map[int64]bool)
+		for _, idAsString := range strings.Split(value, ",") {
+			id, err := strconv.ParseInt(idAsString, 10, 64)
+			if err != nil || id < 1 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid ids parameter"})
+				return nil, nil, false
+			}
+			ids[id] = true
+		}
+	}
+	return types, ids, true
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/events"
+)
+
+// openEventStream connects to the event stream of the server with the specified query and
+// headers, and returns a reader for the stream. The stream is closed when the test ends.
+func openEventStream(t *testing.T, server *httptest.Server, query string, headers map[string]string) *bufio.Reader {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	request, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/contacts/events"+query, nil)
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("could not connect to the event stream: %s", err)
+	}
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/event-stream;charset=utf-8", response.Header.Get("Content-Type"))
+	return bufio.NewReader(response.Body)
+}
+
+// readEvent reads the next event or comment from the stream and returns its lines.
+func readEvent(t *testing.T, reader *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read from the event stream: %s", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// useTestEventBus replaces the event bus with an empty one for the test, so that the ids of the
+// events that the test publishes do not depend on other tests.
+func useTestEventBus(t *testing.T) {
+	previous := eventBus
+	eventBus = events.NewBus(eventHistorySize)
+	t.Cleanup(func() { eventBus = previous })
+}
+
+// TestEventStream opens the event stream and creates a contact. It expects that an event for the
+// new contact is sent to the client.
+func TestEventStream(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectDuplicateCandidates(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO contacts").
+		WillReturnResult(sqlmock.NewResult(42, 1))
+	expectCreatedSelect(mock, 42, "Erika", nil, nil, nil)
+	expectAudit(mock, 42, "create", 1)
+	mock.ExpectCommit()
+	expectOutboxRelay(mock, 42, "created", `{"id": 42, "firstname": "Erika", "version": 1}`)
+
+	// Run test and compare results
+	server := httptest.NewServer(initializeContactsService(db))
+	t.Cleanup(server.Close) // runs after the event stream is closed
+	reader := openEventStream(t, server, "?types=created", nil)
+	response, err := http.Post(server.URL+"/contacts", "application/json", strings.NewReader(`{"firstname": "Erika"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	published, err := newEventStreamRelay().publish(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, published)
+	lines := readEvent(t, reader)
+	assert.Equal(t, 3, len(lines))
+	assert.Regexp(t, "^id:[0-9]+$", lines[0])
+	assert.Equal(t, "event:created", lines[1])
+	assert.Contains(t, lines[2], `"key":"0123456789abcdef0123456789abcdef"`)
+	assert.Contains(t, lines[2], `"contact_id":42`)
+	assert.Contains(t, lines[2], `"firstname":"Erika"`)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestEventStreamRollback deletes a contact with a version that does not match. It expects that
+// no event is written to the outbox, because the transaction is rolled back.
+func TestEventStreamRollback(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	expectLockedSelect(mock, 42, 3)
+	mock.ExpectRollback()
+
+	// Run test and compare results
+	subscription, _, _ := eventBus.Subscribe(0, false)
+	defer eventBus.Unsubscribe(subscription)
+	recorder := runTestWithHeaders(db, "DELETE", "/contacts/42", nil, map[string]string{"If-Match": `"2"`})
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	select {
+	case event := <-subscription.C:
+		t.Errorf("unexpected event %v", event)
+	default:
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestEventStreamResume opens the event stream with the Last-Event-ID header of an event that the
+// client received, possibly from another instance. It expects that the missed events after that id
+// are sent with their ids in the outbox, filtered by the requested contact ids.
+func TestEventStreamResume(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	server := httptest.NewServer(initializeContactsService(db))
+	t.Cleanup(server.Close) // runs after the event stream is closed
+	useTestEventBus(t)
+	eventBus.Publish(events.Event{Id: 11, TenantId: defaultTenant, Type: events.Updated, ContactId: 7})
+	eventBus.Publish(events.Event{Id: 12, TenantId: defaultTenant, Type: events.Updated, ContactId: 8})
+	eventBus.Publish(events.Event{Id: 14, TenantId: defaultTenant, Type: events.Deleted, ContactId: 9})
+
+	reader := openEventStream(t, server, "?ids=9", map[string]string{"Last-Event-ID": "11"})
+	lines := readEvent(t, reader)
+	assert.Equal(t, "id:14", lines[0])
+	assert.Equal(t, "event:deleted", lines[1])
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestEventStreamHeartbeat opens the event stream and waits. It expects that heartbeat pings are
+// sent while there are no events.
+func TestEventStreamHeartbeat(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	heartbeatInterval = 10 * time.Millisecond
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	server := httptest.NewServer(initializeContactsService(db))
+	t.Cleanup(server.Close) // runs after the event stream is closed
+	reader := openEventStream(t, server, "?ids=999999", nil)
+	assert.Equal(t, []string{": ping"}, readEvent(t, reader))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestEventStreamInvalidParameters opens the event stream with invalid filters and headers. It
+// expects that the HTTP requests are answered with the BAD REQUEST status code.
+func TestEventStreamInvalidParameters(t *testing.T) {
+	invalidRequests := []struct {
+		query       string
+		lastEventId string
+	}{
+		{"?types=renamed", ""},
+		{"?ids=abc", ""},
+		{"?ids=0", ""},
+		{"", "yesterday"},
+	}
+	for _, request := range invalidRequests {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock)
+
+		// Run test and compare results
+		recorder := runTestWithHeaders(db, "GET", "/contacts/events"+request.query, nil,
+			map[string]string{"Last-Event-ID": request.lastEventId})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "request: "+request.query+request.lastEventId)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthCheckTimeout is the time after which the checks of the readiness endpoint give up.
+const healthCheckTimeout = 2 * time.Second
+
+// readinessCacheTime is the time for which the result of the readiness checks is reused, so that
+// frequent probes do not put load on the database.
+var readinessCacheTime = time.Second
+
+// Status values of the readiness endpoint and its components.
+const (
+	statusReady       = "ready"
+	statusUnavailable = "unavailable"
+	statusDraining    = "draining"
+	statusUp          = "up"
+	statusDown        = "down"
+)
+
+// schema lists the tables of the database with the columns that the service uses. The readiness
+// endpoint checks that they exist, i.e. that scripts/database.sql was applied in its current
+// version.
+var schema = []struct {
+	table   string
+	columns []string
+}{
+	{"contacts", []string{"id", "tenant_id", "owner", "firstname", "lastname", "phone", "birthday", "vip", "version", "created_at", "updated_at", "deleted_at"}},
+	{"contact_shares", []string{"contact_id", "grantee", "permission", "created_at"}},
+	{"audit_log", []string{"id", "tenant_id", "contact_id", "action", "version", "before_value", "after_value", "merged_ids", "actor", "request_id", "created_at"}},
+	{"webhooks", []string{"id", "tenant_id", "url", "secret", "events", "created_at"}},
+	{"webhook_deliveries", []string{"id", "webhook_id", "event", "idempotency_key", "payload", "status", "attempts", "next_attempt_at", "status_code", "error", "created_at", "updated_at"}},
+	{"outbox", []string{"id", "idempotency_key", "tenant_id", "owner", "event_type", "contact_id", "payload", "created_at", "dispatched_at"}},
+	{"idempotency_keys", []string{"tenant_id", "idempotency_key", "request_hash", "status_code", "etag", "response", "created_at"}},
+	{"api_keys", []string{"id", "tenant_id", "name", "prefix", "key_hash", "scopes", "roles", "created_at", "last_used_at", "revoked_at"}},
+}
+
+// statementsPrepared tells whether the prepared statements are ready for use.
+var statementsPrepared atomic.Bool
+
+// componentStatus is the status of a component that the service depends on. Why a component is
+// down is only logged, so that the endpoint, which needs no credentials, does not reveal details
+// of the database.
+type componentStatus struct {
+	Status string `json:"status"`
+}
+
+// checkLiveness responds that the process is alive. It does not check any dependencies, so that
+// the process is not restarted when the database is not available.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/healthz
+func checkLiveness(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+// checkReadiness returns a handler that responds whether the service accepts requests, together
+// with the status of the components it depends on: the connection to the 'database', the
+// 'schema' of the database and the prepared 'statements'. It responds with the SERVICE
+// UNAVAILABLE status code if a component is down, or once the service started to shut down. The
+// components are checked at most once per readinessCacheTime; concurrent probes wait for the
+// running check and share its result.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/readyz
+func checkReadiness() gin.HandlerFunc {
+	var mutex sync.Mutex
+	var checkedAt time.Time
+	var code int
+	var components map[string]componentStatus
+	return func(c *gin.Context) {
+		select {
+		case <-drained():
+			c.IndentedJSON(http.StatusServiceUnavailable, gin.H{"status": statusDraining})
+			return
+		default:
+		}
+		mutex.Lock()
+		if components == nil || time.Since(checkedAt) >= readinessCacheTime {
+			// the result is shared, so it must not depend on whether this client goes away
+			components = checkComponents(context.WithoutCancel(c.Request.Context()))
+			checkedAt = time.Now()
+			code = http.StatusOK
+			for _, component := range components {
+				if component.Status != statusUp {
+					code = http.StatusServiceUnavailable
+				}
+			}
+		}
+		status, result := statusReady, components
+		if code != http.StatusOK {
+			status = statusUnavailable
+		}
+		mutex.Unlock()
+		c.IndentedJSON(code, gin.H{"status": status, "components": result})
+	}
+}
+
+// checkComponents checks the components that the service depends on and returns their status.
+func checkComponents(ctx context.Context) map[string]componentStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	components := map[string]componentStatus{
+		"database":   checkComponent("database", db.PingContext(ctx)),
+		"schema":     checkComponent("schema", checkSchema(ctx)),
+		"statements": {Status: statusUp},
+	}
+	if !statementsPrepared.Load() {
+		log.Println("readiness check: statements are not prepared")
+		components["statements"] = componentStatus{Status: statusDown}
+	}
+	return components
+}
+
+// checkComponent returns the status of the named component whose check returned the error, and
+// logs the error.
+func checkComponent(name string, err error) componentStatus {
+	if err != nil {
+		log.Printf("readiness check: %s is down: %v\n", name, err)
+		return componentStatus{Status: statusDown}
+	}
+	return componentStatus{Status: statusUp}
+}
+
+// checkSchema selects no rows from every table of the schema, which fails if a table or column
+// does not exist.
+func checkSchema(ctx context.Context) error {
+	for _, table := range schema {
+		rows, err := db.QueryContext(ctx, "SELECT "+strings.Join(table.columns, ", ")+" FROM "+table.table+" LIMIT 0")
+		if err != nil {
+			return err
+		}
+		rows.Close()
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// readiness is the response of the readiness endpoint.
+type readiness struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+// expectSchemaCheck instructs the mock object to expect that no rows are selected from every
+// table of the schema.
+func expectSchemaCheck(mock sqlmock.Sqlmock) {
+	for _, table := range schema {
+		mock.ExpectQuery("SELECT .* FROM " + regexp.QuoteMeta(table.table) + " LIMIT 0").
+			WillReturnRows(mock.NewRows(table.columns))
+	}
+}
+
+// TestLiveness executes a GET request for the liveness with authentication turned on. It expects
+// that the process is reported alive without credentials and without touching the database.
+func TestLiveness(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("REQUIRE_AUTH", "true")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/healthz", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"status": "alive"`)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestReadinessReady executes a GET request for the readiness with authentication turned on. It
+// expects that the schema is checked and that all components are reported up.
+func TestReadinessReady(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("REQUIRE_AUTH", "true")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSchemaCheck(mock)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/readyz", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response readiness
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Equal(t, "ready", response.Status)
+	assert.Equal(t, map[string]componentStatus{
+		"database":   {Status: "up"},
+		"schema":     {Status: "up"},
+		"statements": {Status: "up"},
+	}, response.Components)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestReadinessSchemaOutdated executes a GET request for the readiness while a column of the
+// schema is missing. It expects that the schema is reported down without revealing the error.
+func TestReadinessSchemaOutdated(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT .* FROM contacts LIMIT 0").
+		WillReturnError(errors.New("Unknown column 'vip' in 'field list'"))
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/readyz", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	var response readiness
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Equal(t, "unavailable", response.Status)
+	assert.Equal(t, "up", response.Components["database"].Status)
+	assert.Equal(t, "down", response.Components["schema"].Status)
+	assert.NotContains(t, recorder.Body.String(), "vip")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestReadinessDatabaseDown executes a GET request for the readiness while the database does not
+// answer and the prepared statements were closed. It expects that both are reported down.
+func TestReadinessDatabaseDown(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectPing().
+		WillReturnError(errors.New("connection refused"))
+	expectSchemaCheck(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	statementsPrepared.Store(false)
+	recorder := serveFrom(router, "/readyz", "192.0.2.1")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	var response readiness
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Equal(t, componentStatus{Status: "down"}, response.Components["database"])
+	assert.NotContains(t, recorder.Body.String(), "refused")
+	assert.Equal(t, "down", response.Components["statements"].Status)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestReadinessCached executes two GET requests for the readiness in quick succession. It expects
+// that the components are checked only once.
+func TestReadinessCached(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSchemaCheck(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	assert.Equal(t, http.StatusOK, serveFrom(router, "/readyz", "192.0.2.1").Code)
+	assert.Equal(t, http.StatusOK, serveFrom(router, "/readyz", "192.0.2.1").Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
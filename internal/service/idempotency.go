@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// defaultIdempotencyTTL is the time during which an idempotency key is remembered if the
+// environment variable IDEMPOTENCY_TTL is not set.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyPurgeInterval is the time between two runs of the job that removes expired
+// idempotency keys.
+const idempotencyPurgeInterval = time.Hour
+
+// maxIdempotencyKeyLength is the maximum length of the value of an Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// idempotentReplayHeader marks responses that were replayed for a repeated request.
+const idempotentReplayHeader = "Idempotent-Replayed"
+
+// mysqlDuplicateEntry is the MySQL error number for a violated unique key.
+const mysqlDuplicateEntry = 1062
+
+// idempotencyTTL is the time during which an idempotency key is remembered. It is taken from the
+// IDEMPOTENCY_TTL environment variable when the router is set up.
+var idempotencyTTL = defaultIdempotencyTTL
+
+// idempotencyRow is the stored response to a request with an idempotency key. RequestHash
+// identifies the request, so that a key that is reused for a different request can be detected.
+// Keys are unique per tenant.
+type idempotencyRow struct {
+	TenantId    string         `db:"tenant_id"`
+	Key         string         `db:"idempotency_key"`
+	RequestHash string         `db:"request_hash"`
+	StatusCode  int            `db:"status_code"`
+	ETag        sql.NullString `db:"etag"`
+	Response    string         `db:"response"`
+	CreatedAt   time.Time      `db:"created_at"`
+}
+
+// setupIdempotency reads the time during which idempotency keys are remembered from the
+// environment variable IDEMPOTENCY_TTL.
+func setupIdempotency() {
+	idempotencyTTL = readIdempotencyTTL()
+}
+
+// readIdempotencyTTL returns the time during which idempotency keys are remembered. It is taken
+// from the environment variable IDEMPOTENCY_TTL, which must be a duration like '24h'. It defaults
+// to one day.
+func readIdempotencyTTL() time.Duration {
+	value := os.Getenv("IDEMPOTENCY_TTL")
+	if value == "" {
+		return defaultIdempotencyTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Fatal("could not parse IDEMPOTENCY_TTL env variable ", value)
+	}
+	return ttl
+}
+
+// parseIdempotencyKey returns the value of the Idempotency-Key header of the request, or an empty
+// string if there is none. If the value is too long or contains other characters than printable
+// ASCII, the request is answered with the BAD REQUEST status code.
+func parseIdempotencyKey(c *gin.Context) (key string, success bool) {
+	key = c.GetHeader("Idempotency-Key")
+	valid := len(key) <= maxIdempotencyKeyLength
+	for _, char := range key {
+		valid = valid && char > ' ' && char <= '~'
+	}
+	if !valid {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid Idempotency-Key header"})
+		return "", false
+	}
+	return key, true
+}
+
+// hashRequest returns the hash that identifies a request. It is computed from the parsed request,
+// so that requests that differ only in the formatting of their JSON are considered the same.
+func hashRequest(request any) string {
+	marshalled, err := json.Marshal(request)
+	if err != nil {
+		log.Panicln(err)
+	}
+	hash := sha256.Sum256(marshalled)
+	return hex.EncodeToString(hash[:])
+}
+
+// replayIdempotentResponse looks up the response that was stored for the idempotency key of the
+// tenant within its time to live. If there is one, the request is answered with it, or with the
+// UNPROCESSABLE ENTITY status code if the key was used for a different request. It returns whether
+// the request was answered.
+func replayIdempotentResponse(c *gin.Context, key string, requestHash string) bool {
+	var row idempotencyRow
+	err := db.GetContext(c.Request.Context(), &row, `
+		SELECT * FROM idempotency_keys WHERE tenant_id = ? AND idempotency_key = ? AND created_at >= ?`,
+		tenant(c), key, time.Now().Add(-idempotencyTTL).UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		log.Panicln(err)
+	}
+	if row.RequestHash != requestHash {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity,
+			gin.H{"message": "idempotency key was already used for a different request"})
+		return true
+	}
+	if row.ETag.Valid {
+		c.Header("ETag", row.ETag.String)
+	}
+	c.Header(idempotentReplayHeader, "true")
+	c.IndentedJSON(row.StatusCode, json.RawMessage(row.Response))
+	return true
+}
+
+// storeIdempotentResponse stores the response to a request of a tenant with an idempotency key
+// within the transaction that processes the request. An expired entry for the same key is
+// replaced. It returns false if another request with the same key was processed concurrently, in
+// which case the transaction must be rolled back.
+func storeIdempotentResponse(ctx context.Context, tx *sqlx.Tx, tenant string, key string, requestHash string, statusCode int, etag string, response any) bool {
+	marshalled, err := json.Marshal(response)
+	if err != nil {
+		log.Panicln(err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM idempotency_keys WHERE tenant_id = ? AND idempotency_key = ? AND created_at < ?`,
+		tenant, key, time.Now().Add(-idempotencyTTL).UTC())
+	if err != nil {
+		log.Panicln(err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (tenant_id, idempotency_key, request_hash, status_code, etag, response)
+		VALUES (?, ?, ?, ?, ?, ?)`, tenant, key, requestHash, statusCode, etag, marshalled)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return false
+	}
+	if err != nil {
+		log.Panicln(err)
+	}
+	return true
+}
+
+// PurgeIdempotencyKeys removes all idempotency keys that are older than the time to live. It
+// returns the number of removed keys.
+func PurgeIdempotencyKeys(ctx context.Context, ttl time.Duration) (int64, error) {
+	result, err := db.ExecContext(ctx, `
+		DELETE FROM idempotency_keys WHERE created_at < ?`, time.Now().Add(-ttl).UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StartIdempotencyKeyPurger starts a background job that removes expired idempotency keys every
+// hour until the context is cancelled. The time to live is taken from the environment variable
+// IDEMPOTENCY_TTL.
+func StartIdempotencyKeyPurger(ctx context.Context) {
+	ttl := readIdempotencyTTL()
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		ticker := time.NewTicker(idempotencyPurgeInterval)
+		defer ticker.Stop()
+		for {
+			if _, err := PurgeIdempotencyKeys(ctx, ttl); err != nil {
+				log.Println("could not purge idempotency keys:", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
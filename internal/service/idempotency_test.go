@@ -0,0 +1,167 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// idempotencyKey is the value of the Idempotency-Key header in the tests.
+const idempotencyKey = "4f1c2d7e-8b3a-4e5f-9c6d-0a1b2c3d4e5f"
+
+// erikaHash is the request hash of a new contact with the first name Erika.
+var erikaHash = hashRequest(model.Contact{FirstName: stringPointer("Erika")})
+
+// stringPointer returns a pointer to the string.
+func stringPointer(str string) *string {
+	return &str
+}
+
+// expectIdempotencyLookup instructs the mock object to expect that the stored response for the
+// idempotency key is looked up. If hash is empty, no response is found.
+func expectIdempotencyLookup(mock sqlmock.Sqlmock, hash string) {
+	rows := mock.NewRows([]string{"tenant_id", "idempotency_key", "request_hash", "status_code", "etag", "response", "created_at"})
+	if hash != "" {
+		rows.AddRow(defaultTenant, idempotencyKey, hash, http.StatusCreated, `"1"`, `{"id": 42, "firstname": "Erika", "version": 1}`, createdAt)
+	}
+	mock.ExpectQuery("SELECT \\* FROM idempotency_keys WHERE tenant_id = \\? AND idempotency_key = \\? AND created_at >= \\?").
+		WithArgs(defaultTenant, idempotencyKey, sqlmock.AnyArg()).
+		WillReturnRows(rows)
+}
+
+// expectIdempotentCreate instructs the mock object to expect that a contact is created and that
+// the response is stored with the idempotency key. The storing fails with the specified error.
+func expectIdempotentCreate(mock sqlmock.Sqlmock, err error) {
+	expectDuplicateCandidates(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO contacts").
+		WillReturnResult(sqlmock.NewResult(42, 1))
+	expectCreatedSelect(mock, 42, "Erika", nil, nil, nil)
+	expectAudit(mock, 42, "create", 1)
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE tenant_id = \\? AND idempotency_key = \\? AND created_at < \\?").
+		WithArgs(defaultTenant, idempotencyKey, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(-1, 0))
+	insert := mock.ExpectExec("INSERT INTO idempotency_keys").
+		WithArgs(defaultTenant, idempotencyKey, erikaHash, http.StatusCreated, `"1"`, sqlmock.AnyArg())
+	if err != nil {
+		insert.WillReturnError(err)
+		mock.ExpectRollback()
+	} else {
+		insert.WillReturnResult(sqlmock.NewResult(-1, 1))
+		mock.ExpectCommit()
+	}
+}
+
+// TestPostIdempotencyKey executes a POST request with an Idempotency-Key header that was not used
+// before. It expects that the contact is created and that the response is stored with the key.
+func TestPostIdempotencyKey(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectIdempotencyLookup(mock, "")
+	expectIdempotentCreate(mock, nil)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`),
+		map[string]string{"Idempotency-Key": idempotencyKey})
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "", recorder.Header().Get("Idempotent-Replayed"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPostIdempotentReplay repeats a POST request with the same Idempotency-Key header and an
+// equivalent body. It expects that the stored response is replayed without creating a contact.
+func TestPostIdempotentReplay(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectIdempotencyLookup(mock, erikaHash)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "POST", "/contacts", strings.NewReader(`{ "firstname" : "Erika" }`),
+		map[string]string{"Idempotency-Key": idempotencyKey})
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "true", recorder.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, `"1"`, recorder.Header().Get("ETag"))
+	var contact model.Contact
+	json.Unmarshal(recorder.Body.Bytes(), &contact)
+	assert.Equal(t, int64(42), contact.Id)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPostIdempotencyKeyReused executes a POST request with an Idempotency-Key header that was
+// used for a different body. It expects that the request is answered with the UNPROCESSABLE
+// ENTITY status code.
+func TestPostIdempotencyKeyReused(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectIdempotencyLookup(mock, erikaHash)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "POST", "/contacts", strings.NewReader(`{"firstname": "Max"}`),
+		map[string]string{"Idempotency-Key": idempotencyKey})
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPostIdempotencyKeyConcurrent executes a POST request with an Idempotency-Key header while
+// another request with the same key creates the contact first. It expects that the transaction is
+// rolled back and that the response of the other request is replayed.
+func TestPostIdempotencyKeyConcurrent(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectIdempotencyLookup(mock, "")
+	expectIdempotentCreate(mock, &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	expectIdempotencyLookup(mock, erikaHash)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`),
+		map[string]string{"Idempotency-Key": idempotencyKey})
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "true", recorder.Header().Get("Idempotent-Replayed"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPostInvalidIdempotencyKey executes POST requests with invalid Idempotency-Key headers. It
+// expects that the HTTP requests are answered with the BAD REQUEST status code.
+func TestPostInvalidIdempotencyKey(t *testing.T) {
+	for _, key := range []string{strings.Repeat("k", 256), "two words", "schlüssel"} {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+		// Run test and compare results
+		recorder := runTestWithHeaders(db, "POST", "/contacts", strings.NewReader(`{"firstname": "Erika"}`),
+			map[string]string{"Idempotency-Key": key})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "key: "+key)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults for the limits that keep single requests from exhausting the service or the database.
+const (
+	defaultMaxPageSize    = 1000
+	defaultMaxOffset      = 10000
+	defaultMaxBodySize    = 1 << 20
+	defaultRequestTimeout = 10 * time.Second
+)
+
+// maxSearchLength is the maximum length of the names that contacts are searched for. Longer names
+// cannot match, since the names of contacts are not longer.
+const maxSearchLength = 50
+
+// maxDuplicateScan is the maximum number of contacts that are compared with each other to find
+// duplicates. The comparison takes quadratic time, so larger address books are rejected.
+const maxDuplicateScan = 10000
+
+// maxPageSize is the maximum number of items that a list endpoint returns, and the number that it
+// returns if the client does not specify a limit.
+var maxPageSize = defaultMaxPageSize
+
+// maxOffset is the maximum number of items that a list endpoint skips. Large offsets make the
+// database read and discard all skipped rows.
+var maxOffset = defaultMaxOffset
+
+// maxBodySize is the maximum size of the body of a request in bytes.
+var maxBodySize int64 = defaultMaxBodySize
+
+// statusClientClosedRequest is the non-standard status code with which requests are logged that
+// were cancelled because the client closed the connection.
+const statusClientClosedRequest = 499
+
+// requestTimeout is the time after which requests are cancelled, together with their queries.
+var requestTimeout = defaultRequestTimeout
+
+// unlimitedRoutes are the routes, as method and path, that may take longer than the request
+// timeout, since they stream responses until the client disconnects.
+var unlimitedRoutes = map[string]bool{"GET /contacts/events": true}
+
+// setupLimits reads the limits of requests from environment variables. MAX_PAGE_SIZE and
+// MAX_OFFSET limit the 'limit' and 'offset' URL parameters of list endpoints, MAX_BODY_SIZE limits
+// the size of request bodies in bytes, and REQUEST_TIMEOUT, a duration like '10s', limits the time
+// that a request and its database queries may take.
+func setupLimits() {
+	maxPageSize = readPositiveInt("MAX_PAGE_SIZE", defaultMaxPageSize)
+	maxOffset = readPositiveInt("MAX_OFFSET", defaultMaxOffset)
+	maxBodySize = int64(readPositiveInt("MAX_BODY_SIZE", defaultMaxBodySize))
+	requestTimeout = defaultRequestTimeout
+	if value := os.Getenv("REQUEST_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			log.Fatalf("could not parse REQUEST_TIMEOUT env variable %s", value)
+		}
+		requestTimeout = timeout
+	}
+}
+
+// readPositiveInt returns the positive number in the environment variable, or the default value
+// if the variable is not set.
+func readPositiveInt(variable string, defaultValue int) int {
+	value := os.Getenv(variable)
+	if value == "" {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		log.Fatalf("could not parse %s env variable %s", variable, value)
+	}
+	return number
+}
+
+// limitBodySize returns a middleware that rejects requests whose body is larger than the maximum
+// size with the REQUEST ENTITY TOO LARGE status code. Bodies without a declared length are cut off
+// after the maximum size, so that reading them fails.
+func limitBodySize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBodySize {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"message": "request body too large"})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBodySize)
+		c.Next()
+	}
+}
+
+// limitRequestTime returns a middleware that cancels the context of the request after the request
+// timeout, which cancels its database queries as well. Handlers panic if a query fails; if the
+// context of the request was cancelled by then, the request is answered with the GATEWAY TIMEOUT
+// status code after the timeout, and logged with the status code 499 if the client went away.
+func limitRequestTime() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !unlimitedRoutes[c.Request.Method+" "+c.FullPath()] {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+			defer cancel()
+			c.Request = c.Request.WithContext(ctx)
+		}
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				switch c.Request.Context().Err() {
+				case context.DeadlineExceeded:
+					c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"message": "request timed out"})
+				case context.Canceled:
+					c.AbortWithStatus(statusClientClosedRequest)
+				default:
+					panic(recovered)
+				}
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGetDefaultLimit executes a GET request without a limit. It expects that the query is limited
+// to the configured maximum page size.
+func TestGetDefaultLimit(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("MAX_PAGE_SIZE", "25")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT \\* FROM contacts").
+		WithArgs(defaultTenant, false, "", "", sqlmock.AnyArg(), "25", "0").
+		WillReturnRows(mock.NewRows([]string{"id", "firstname"}).AddRow(1, "Aaron"))
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetLimitTooLarge executes GET requests whose limit or offset exceed their maximum. It
+// expects that they are rejected with the BAD REQUEST status code without reaching the database.
+func TestGetLimitTooLarge(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("MAX_PAGE_SIZE", "25")
+	t.Setenv("MAX_OFFSET", "100")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	recorder := serveFrom(router, "/contacts?limit=26", "192.0.2.1")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "limit parameter exceeds maximum of 25")
+	recorder = serveFrom(router, "/contacts?offset=101", "192.0.2.1")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "offset parameter exceeds maximum of 100")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetNameWithWildcards executes a GET request for a first name that contains wildcards of LIKE
+// patterns. It expects that the wildcards are escaped, so that they are matched literally.
+func TestGetNameWithWildcards(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT \\* FROM contacts").
+		WithArgs(defaultTenant, false, "", "", sqlmock.AnyArg(), `\%a\_%`, "%", sqlmock.AnyArg(), "0").
+		WillReturnRows(mock.NewRows([]string{"id", "firstname"}))
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts?firstname=%25a_", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetNameTooLong executes a GET request for a last name that is longer than any name can be.
+// It expects that it is rejected with the BAD REQUEST status code.
+func TestGetNameTooLong(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts?lastname="+strings.Repeat("a", 51), nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPostBodyTooLarge executes a POST request whose body is larger than the maximum body size.
+// It expects that it is rejected with the REQUEST ENTITY TOO LARGE status code.
+func TestPostBodyTooLarge(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("MAX_BODY_SIZE", "16")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	body := strings.NewReader(`{"firstname": "Hubert", "lastname": "Blaine"}`)
+	recorder := runTestWithHeaders(db, "POST", "/contacts", body, map[string]string{"Content-Type": "application/json"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetTooManyContactsForDuplicates executes a GET request for duplicates in an address book
+// with more contacts than are compared. It expects that it is rejected with the UNPROCESSABLE
+// ENTITY status code.
+func TestGetTooManyContactsForDuplicates(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	rows := mock.NewRows([]string{"id", "firstname"})
+	for i := 0; i <= maxDuplicateScan; i++ {
+		rows.AddRow(i+1, "Erika")
+	}
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL AND "+visibleContactsPattern+" ORDER BY id LIMIT \\?").
+		WithArgs(defaultTenant, false, "", "", maxDuplicateScan+1).
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/duplicates", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRequestTimeout executes a GET request whose query takes longer than the request timeout. It
+// expects that the query is cancelled and the request is answered with the GATEWAY TIMEOUT status
+// code.
+func TestRequestTimeout(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("REQUEST_TIMEOUT", "20ms")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\?").
+		WillDelayFor(time.Second).
+		WillReturnRows(mock.NewRows([]string{"id", "firstname"}))
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/42", nil)
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestClientClosedRequest executes a GET request whose client goes away while the query runs. It
+// expects that the query is cancelled and the request is logged with the status code 499.
+func TestClientClosedRequest(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\?").
+		WillDelayFor(time.Second).
+		WillReturnRows(mock.NewRows([]string{"id", "firstname"}))
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequestWithContext(ctx, "GET", "/contacts/42", nil)
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, statusClientClosedRequest, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// Rules for resolving the value of a property when contacts are merged. Instead of a rule, the id
+// of one of the merged contacts can be given to take the value from that contact.
+const (
+	ruleSurvivor     = "survivor"
+	ruleFirstNonNull = "first_non_null"
+	ruleLongest      = "longest"
+)
+
+// maxMergeLosers is the maximum number of contacts that can be merged into a survivor at once.
+const maxMergeLosers = 100
+
+// mergeRequest is the body of a request for merging contacts.
+type mergeRequest struct {
+	Survivor int64                      `json:"survivor"`
+	Losers   []int64                    `json:"losers"`
+	Rules    map[string]json.RawMessage `json:"rules"`
+}
+
+// mergeRule determines which of the merged contacts a property value is taken from. Either the
+// name of a rule or the id of a contact is set.
+type mergeRule struct {
+	name string
+	id   int64
+}
+
+// mergeContacts merges several contacts that describe the same person into one. The request body
+// names the survivor, which is kept, and the losers, which are moved to the trash. For every
+// property, a rule determines which value the survivor gets:
+//
+//   - 'survivor' keeps the value of the survivor. This is the default.
+//   - 'first_non_null' takes the first value that is not null, looking at the survivor first and
+//     then at the losers in the order given.
+//   - 'longest' takes the longest value. It cannot be used for the birthday and the VIP flag.
+//   - the id of one of the merged contacts takes the value of that contact.
+//
+// Rules may only take the values of fields from the losers that the client may read; see
+// checkMergeReads.
+//
+// The merge happens in a single transaction and is recorded in the audit log of all merged
+// contacts, including the ids of the contacts they were merged with. The audit log entries of the
+// losers stay with the losers. The shares of the losers are moved to the survivor within the same
+// transaction, so that their grantees keep access to the merged contact; see moveShares. Other
+// related data, such as tags or notes, would have to be re-pointed to the survivor likewise.
+//
+// An If-Match header makes the request conditional on the version of the survivor. The response
+// carries the merged survivor.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/contacts/merge --request "POST" --header "Content-Type: application/json" --data '{"survivor": 12, "losers": [15, 17], "rules": {"phone": "first_non_null", "birthday": 17}}'
+func mergeContacts(c *gin.Context) {
+	var request mergeRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid JSON"})
+		return
+	}
+	rules, err := request.validate()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid merge request: " + err.Error()})
+		return
+	}
+	version, success := parseIfMatch(c)
+	if !success {
+		return
+	}
+
+	var after *model.Contact
+	ctx := c.Request.Context()
+	committed := withTransaction(ctx, func(tx *sqlx.Tx) bool {
+		// lock the contacts in the order of their ids to avoid deadlocks with concurrent merges
+		ids := append([]int64{request.Survivor}, request.Losers...)
+		locked := make(map[int64]*model.Contact)
+		for _, id := range slices.Sorted(slices.Values(ids)) {
+			contact := findContact(ctx, tx.Stmtx(selectWhereIdForUpdate), id, tenant(c))
+			if contact == nil {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("contact %d not found", id)})
+				return false
+			}
+			if !checkAccess(c, accessTo(c, contact), accessWrite, fmt.Sprintf("contact %d not found", id)) {
+				return false
+			}
+			locked[id] = contact
+		}
+		survivor := locked[request.Survivor]
+		if version != anyVersion && version != survivor.Version {
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"message": "contact version does not match"})
+			return false
+		}
+
+		if !checkMergeReads(c, rules, request.Losers, locked) {
+			return false
+		}
+
+		contacts := make([]model.Contact, len(ids))
+		for i, id := range ids {
+			contacts[i] = *locked[id]
+		}
+		merged, err := resolveMerge(contacts, rules)
+		if err != nil {
+			log.Panicln(err)
+		}
+		merged.Id = survivor.Id
+		merged.TenantId = tenant(c)
+		merged.Version = survivor.Version
+		if !checkFieldWrites(c, survivor, &merged) {
+			return false
+		}
+		if _, err := tx.NamedStmt(updateWhereId).ExecContext(ctx, &merged); err != nil {
+			log.Panicln(err)
+		}
+		after = findContact(ctx, tx.Stmtx(selectWhereId), survivor.Id, tenant(c))
+		row := newAuditRow(c, actionMerge, survivor, after)
+		row.MergedIds = marshalIds(request.Losers)
+		writeAudit(ctx, tx, row)
+
+		for _, id := range request.Losers {
+			loser := locked[id]
+			if _, err := tx.Stmtx(deleteWhereId).ExecContext(ctx, id, tenant(c), loser.Version, loser.Version); err != nil {
+				log.Panicln(err)
+			}
+			row := newAuditRow(c, actionMerge, loser, nil)
+			row.MergedIds = marshalIds([]int64{survivor.Id})
+			writeAudit(ctx, tx, row)
+			moveShares(ctx, tx, id, survivor.Id)
+		}
+		return true
+	})
+	if committed {
+		shareChanges.Add(1)
+		c.Header("ETag", contactETag(*after))
+		c.IndentedJSON(http.StatusOK, redactContact(c, *after))
+	}
+}
+
+// moveShares moves the shares of a merged contact to the survivor. A grantee with whom both
+// contacts were shared keeps the higher of both permissions.
+func moveShares(ctx context.Context, tx *sqlx.Tx, loserId int64, survivorId int64) {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO contact_shares (contact_id, grantee, permission)
+		SELECT ?, loser.grantee, loser.permission FROM contact_shares AS loser WHERE loser.contact_id = ?
+		ON DUPLICATE KEY UPDATE permission = IF(contact_shares.permission = ?, contact_shares.permission, VALUES(permission))`,
+		survivorId, loserId, permissionWrite)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM contact_shares WHERE contact_id = ?", loserId); err != nil {
+		log.Panicln(err)
+	}
+}
+
+// validate checks the ids and the rules of a merge request, and returns the parsed rules.
+func (request mergeRequest) validate() (map[string]mergeRule, error) {
+	if request.Survivor < 1 {
+		return nil, errors.New("survivor must be a contact id")
+	}
+	if len(request.Losers) == 0 || len(request.Losers) > maxMergeLosers {
+		return nil, fmt.Errorf("losers must contain between 1 and %d contact ids", maxMergeLosers)
+	}
+	ids := []int64{request.Survivor}
+	for _, id := range request.Losers {
+		if id < 1 || slices.Contains(ids, id) {
+			return nil, fmt.Errorf("loser %d is not a valid contact id or is given twice", id)
+		}
+		ids = append(ids, id)
+	}
+
+	rules := make(map[string]mergeRule)
+	for field, value := range request.Rules {
+		if !contains(patchableFields, field) {
+			return nil, fmt.Errorf("property '%s' cannot be merged", field)
+		}
+		var rule mergeRule
+		if json.Unmarshal(value, &rule.name) == nil {
+			if !contains([]string{ruleSurvivor, ruleFirstNonNull, ruleLongest}, rule.name) {
+				return nil, fmt.Errorf("unknown rule '%s' for property '%s'", rule.name, field)
+			}
+			if rule.name == ruleLongest && (field == "birthday" || field == "vip") {
+				return nil, fmt.Errorf("rule '%s' cannot be used for property '%s'", rule.name, field)
+			}
+		} else if json.Unmarshal(value, &rule.id) == nil {
+			if !slices.Contains(ids, rule.id) {
+				return nil, fmt.Errorf("contact %d of property '%s' is not merged", rule.id, field)
+			}
+		} else {
+			return nil, fmt.Errorf("rule for property '%s' must be a string or a contact id", field)
+		}
+		rules[field] = rule
+	}
+	return rules, nil
+}
+
+// checkMergeReads makes sure that the client may read the fields that the rules take from the
+// losers, since the merged survivor would reveal their values. Fields that a rule may take from
+// every loser are checked on all of them. Otherwise, the request is answered with the FORBIDDEN
+// status code. It returns whether all fields may be read.
+func checkMergeReads(c *gin.Context, rules map[string]mergeRule, losers []int64, locked map[int64]*model.Contact) bool {
+	for _, field := range slices.Sorted(maps.Keys(rules)) {
+		if _, found := contactFields[field]; !found {
+			continue
+		}
+		rule := rules[field]
+		for _, id := range losers {
+			fromLoser := rule.id == id || (rule.id == 0 && rule.name != ruleSurvivor)
+			if fromLoser && !checkFieldReads(c, locked[id], []string{field}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resolveMerge combines the contacts according to the rules and returns the merged contact. The
+// survivor is the first contact, followed by the losers.
+func resolveMerge(contacts []model.Contact, rules map[string]mergeRule) (model.Contact, error) {
+	docs := make([]document, len(contacts))
+	for i, contact := range contacts {
+		doc, err := contactToDocument(contact)
+		if err != nil {
+			return model.Contact{}, err
+		}
+		docs[i] = doc
+	}
+
+	merged := docs[0]
+	for field, rule := range rules {
+		switch {
+		case rule.id != 0:
+			for i, contact := range contacts {
+				if contact.Id == rule.id {
+					setField(merged, field, valueOrNull(docs[i], field))
+				}
+			}
+		case rule.name == ruleFirstNonNull:
+			for _, doc := range docs {
+				if value, found := doc[field]; found {
+					setField(merged, field, value)
+					break
+				}
+			}
+		case rule.name == ruleLongest:
+			longest := valueOrNull(merged, field)
+			for _, doc := range docs[1:] {
+				if value, found := doc[field]; found && stringLength(value) > stringLength(longest) {
+					longest = value
+				}
+			}
+			setField(merged, field, longest)
+		}
+	}
+	return documentToContact(merged)
+}
+
+// stringLength returns the number of characters of a JSON string, or 0 for other JSON values.
+func stringLength(value json.RawMessage) int {
+	var str string
+	if json.Unmarshal(value, &str) != nil {
+		return 0
+	}
+	return len([]rune(str))
+}
+
+// valueOrNull returns the value of a property in the document, or null if it is not set.
+func valueOrNull(doc document, field string) json.RawMessage {
+	if value, found := doc[field]; found {
+		return value
+	}
+	return jsonNull
+}
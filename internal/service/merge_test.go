@@ -0,0 +1,198 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// expectMergeLockedSelect instructs the mock object to expect that a contact with the specified
+// values is selected and locked within a transaction.
+func expectMergeLockedSelect(mock sqlmock.Sqlmock, id int, firstname string, phone interface{}, birthday interface{}) {
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday", "version"}).
+		AddRow(id, firstname, "Mustermann", phone, birthday, 1)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE").
+		WithArgs(int64(id), defaultTenant).
+		WillReturnRows(rows)
+}
+
+// expectMoveShares instructs the mock object to expect that the shares of a loser are moved to the
+// survivor.
+func expectMoveShares(mock sqlmock.Sqlmock, loserId int64, survivorId int64) {
+	mock.ExpectExec("INSERT INTO contact_shares \\(contact_id, grantee, permission\\) SELECT \\?, loser.grantee, loser.permission FROM contact_shares AS loser").
+		WithArgs(survivorId, loserId, permissionWrite).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM contact_shares WHERE contact_id = \\?").
+		WithArgs(loserId).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// TestMerge executes a POST request for merging two contacts into a survivor. It expects that the
+// survivor is updated according to the rules, that the losers are moved to the trash with their
+// shares moved to the survivor, and that the merge is recorded in the audit log of all contacts.
+func TestMerge(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	expectMergeLockedSelect(mock, 12, "Erika", nil, nil)
+	expectMergeLockedSelect(mock, 15, "Erika Maria", "0815", nil)
+	expectMergeLockedSelect(mock, 17, "Eri", "4711", time.Date(1969, time.March, 2, 0, 0, 0, 0, time.UTC))
+	mock.ExpectExec("UPDATE contacts SET firstname").
+		WithArgs("Erika Maria", "Mustermann", "4711", sqlmock.AnyArg(), false, int64(12), defaultTenant, int64(1), int64(1)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\?").
+		WithArgs(int64(12), defaultTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "phone", "version"}).
+			AddRow(12, "Erika Maria", "Mustermann", "4711", 2))
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(defaultTenant, int64(12), "merge", int64(2), sqlmock.AnyArg(), sqlmock.AnyArg(), "[17,15]", "anonymous", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectOutbox(mock, 12, "updated")
+	for _, id := range []int64{17, 15} {
+		mock.ExpectExec("UPDATE contacts SET deleted_at = NOW\\(6\\)").
+			WithArgs(id, defaultTenant, int64(1), int64(1)).
+			WillReturnResult(sqlmock.NewResult(-1, 1))
+		mock.ExpectExec("INSERT INTO audit_log").
+			WithArgs(defaultTenant, id, "merge", int64(2), sqlmock.AnyArg(), nil, "[12]", "anonymous", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectOutbox(mock, int(id), "deleted")
+		expectMoveShares(mock, id, 12)
+	}
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runTest(db, "POST", "/contacts/merge", strings.NewReader(`
+		{
+			"survivor": 12,
+			"losers": [17, 15],
+			"rules": {"firstname": "longest", "phone": "first_non_null"}
+		}
+	`))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `"2"`, recorder.Header().Get("ETag"))
+	var merged model.Contact
+	json.Unmarshal(recorder.Body.Bytes(), &merged)
+	assert.Equal(t, "Erika Maria", *merged.FirstName)
+	assert.Equal(t, "4711", *merged.Phone)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestMergeNotFound executes a POST request for merging a contact that does not exist. It expects
+// that the HTTP request is answered with the NOT FOUND status code, and that nothing is changed.
+func TestMergeNotFound(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	expectMergeLockedSelect(mock, 12, "Erika", nil, nil)
+	expectLockedSelectNotFound(mock, 9999)
+	mock.ExpectRollback()
+
+	// Run test and compare results
+	recorder := runTest(db, "POST", "/contacts/merge", strings.NewReader(`{"survivor": 12, "losers": [9999]}`))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestMergeVersionMismatch executes a POST request for merging contacts with an If-Match header
+// that does not match the version of the survivor. It expects that the HTTP request is answered
+// with the PRECONDITION FAILED status code.
+func TestMergeVersionMismatch(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	expectMergeLockedSelect(mock, 12, "Erika", nil, nil)
+	expectMergeLockedSelect(mock, 15, "Erika", nil, nil)
+	mock.ExpectRollback()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "POST", "/contacts/merge", strings.NewReader(`{"survivor": 12, "losers": [15]}`),
+		map[string]string{"If-Match": `"3"`})
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestMergeInvalidBodies executes POST requests for merging contacts with invalid bodies. It
+// expects that the HTTP requests are answered with the BAD REQUEST status code.
+func TestMergeInvalidBodies(t *testing.T) {
+	invalidRequestBodies := []string{
+		"",
+		"not JSON",
+		`{"losers": [15]}`,
+		`{"survivor": 12}`,
+		`{"survivor": 12, "losers": [12]}`,
+		`{"survivor": 12, "losers": [15, 15]}`,
+		`{"survivor": 12, "losers": [15], "rules": {"id": "survivor"}}`,
+		`{"survivor": 12, "losers": [15], "rules": {"phone": "newest"}}`,
+		`{"survivor": 12, "losers": [15], "rules": {"phone": 99}}`,
+		`{"survivor": 12, "losers": [15], "rules": {"birthday": "longest"}}`,
+		`{"survivor": 12, "losers": [15], "rules": {"vip": "longest"}}`,
+		`{"survivor": 12, "losers": [15], "rules": {"phone": true}}`,
+	}
+	for _, body := range invalidRequestBodies {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+		// Run test and compare results
+		recorder := runTest(db, "POST", "/contacts/merge", strings.NewReader(body))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "request body: "+body)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+// TestResolveMerge verifies that the values of the merged contact are taken from the contacts
+// given by the rules.
+func TestResolveMerge(t *testing.T) {
+	erika, erikaMaria, phone, other := "Erika", "Erika Maria", "0815", "4711"
+	contacts := []model.Contact{
+		{Id: 12, FirstName: &erika},
+		{Id: 15, FirstName: &erikaMaria, Phone: &phone},
+		{Id: 17, Phone: &other},
+	}
+
+	merged, err := resolveMerge(contacts, map[string]mergeRule{})
+	assert.Nil(t, err)
+	assert.Equal(t, "Erika", *merged.FirstName)
+	assert.Nil(t, merged.Phone)
+
+	merged, err = resolveMerge(contacts, map[string]mergeRule{
+		"firstname": {name: ruleLongest},
+		"phone":     {name: ruleFirstNonNull},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "Erika Maria", *merged.FirstName)
+	assert.Equal(t, "0815", *merged.Phone)
+
+	merged, err = resolveMerge(contacts, map[string]mergeRule{
+		"firstname": {id: 17},
+		"phone":     {id: 17},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, merged.FirstName)
+	assert.Equal(t, "4711", *merged.Phone)
+}
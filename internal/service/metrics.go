@@ -0,0 +1,206 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/metrics"
+)
+
+// registry holds the metrics of the service, which are exposed at /metrics.
+var registry = metrics.NewRegistry()
+
+// requestsTotal counts the HTTP requests by method, route and status code.
+var requestsTotal = registry.NewCounter("contacts_service_http_requests_total",
+	"Number of HTTP requests by method, route and status code.", "method", "route", "status")
+
+// requestDuration observes the time it takes to answer HTTP requests.
+var requestDuration = registry.NewHistogram("contacts_service_http_request_duration_seconds",
+	"Time it took to answer HTTP requests by method, route and status code.", metrics.DefaultBuckets,
+	"method", "route", "status")
+
+// queryDuration observes the time it takes to execute database statements.
+var queryDuration = registry.NewHistogram("contacts_service_db_query_duration_seconds",
+	"Time it took to execute database statements by statement type.", metrics.DefaultBuckets, "statement")
+
+// contactCountInterval is the time between two counts of the contacts for the metrics.
+var contactCountInterval = time.Minute
+
+// contactCounts holds the samples of the last count of the contacts, or nil before the first count.
+var contactCounts atomic.Pointer[[]metrics.Sample]
+
+// init adds the metrics that are read whenever the metrics are scraped to the registry: the
+// statistics of the database pool and the last count of the contacts.
+func init() {
+	registry.NewGaugeFunc("contacts_service_db_connections",
+		"Number of open database connections by state.", func(ctx context.Context) []metrics.Sample {
+			stats, ok := databaseStats()
+			if !ok {
+				return nil
+			}
+			return []metrics.Sample{
+				{Values: []string{"idle"}, Value: float64(stats.Idle)},
+				{Values: []string{"in_use"}, Value: float64(stats.InUse)},
+			}
+		}, "state")
+	registry.NewGaugeFunc("contacts_service_db_max_open_connections",
+		"Maximum number of open database connections.", func(ctx context.Context) []metrics.Sample {
+			stats, ok := databaseStats()
+			if !ok {
+				return nil
+			}
+			return []metrics.Sample{{Value: float64(stats.MaxOpenConnections)}}
+		})
+	registry.NewCounterFunc("contacts_service_db_wait_count_total",
+		"Number of times a database connection was waited for.", func(ctx context.Context) []metrics.Sample {
+			stats, ok := databaseStats()
+			if !ok {
+				return nil
+			}
+			return []metrics.Sample{{Value: float64(stats.WaitCount)}}
+		})
+	registry.NewCounterFunc("contacts_service_db_wait_duration_seconds_total",
+		"Time spent waiting for database connections.", func(ctx context.Context) []metrics.Sample {
+			stats, ok := databaseStats()
+			if !ok {
+				return nil
+			}
+			return []metrics.Sample{{Value: stats.WaitDuration.Seconds()}}
+		})
+	registry.NewCounterFunc("contacts_service_db_closed_connections_total",
+		"Number of database connections that were closed by reason.", func(ctx context.Context) []metrics.Sample {
+			stats, ok := databaseStats()
+			if !ok {
+				return nil
+			}
+			return []metrics.Sample{
+				{Values: []string{"max_idle"}, Value: float64(stats.MaxIdleClosed)},
+				{Values: []string{"max_idle_time"}, Value: float64(stats.MaxIdleTimeClosed)},
+				{Values: []string{"max_lifetime"}, Value: float64(stats.MaxLifetimeClosed)},
+			}
+		}, "reason")
+	registry.NewGaugeFunc("contacts_service_contacts",
+		"Number of contacts of all tenants, by whether they are active or in the trash.", func(ctx context.Context) []metrics.Sample {
+			if samples := contactCounts.Load(); samples != nil {
+				return *samples
+			}
+			return nil
+		}, "state")
+}
+
+// databaseStats returns the statistics of the database pool, if the database was set up.
+func databaseStats() (stats sql.DBStats, ok bool) {
+	if db == nil {
+		return stats, false
+	}
+	return db.Stats(), true
+}
+
+// countContacts returns the number of active contacts and of contacts in the trash. If the
+// database cannot be queried, no samples are returned.
+func countContacts(ctx context.Context) []metrics.Sample {
+	if db == nil {
+		return nil
+	}
+	var rows []struct {
+		Deleted bool  `db:"deleted"`
+		Count   int64 `db:"count"`
+	}
+	err := db.SelectContext(ctx, &rows, `
+		SELECT deleted_at IS NOT NULL AS deleted, COUNT(*) AS count
+		FROM contacts
+		GROUP BY deleted_at IS NOT NULL`)
+	if err != nil {
+		log.Println("could not count contacts:", err)
+		return nil
+	}
+	samples := []metrics.Sample{{Values: []string{"active"}}, {Values: []string{"trash"}}}
+	for _, row := range rows {
+		if row.Deleted {
+			samples[1].Value = float64(row.Count)
+		} else {
+			samples[0].Value = float64(row.Count)
+		}
+	}
+	return samples
+}
+
+// refreshContactCounts counts the contacts and keeps the result for the metrics. If the database
+// cannot be queried, the previous count is kept.
+func refreshContactCounts(ctx context.Context) {
+	if samples := countContacts(ctx); samples != nil {
+		contactCounts.Store(&samples)
+	}
+}
+
+// StartContactCounter starts a background job that counts the contacts for the metrics every
+// minute until the context is cancelled, so that scrapes do not query the database.
+func StartContactCounter(ctx context.Context) {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		ticker := time.NewTicker(contactCountInterval)
+		defer ticker.Stop()
+		for {
+			refreshContactCounts(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// observeQuery records the duration of a database statement.
+func observeQuery(statement string, duration time.Duration) {
+	queryDuration.Observe(duration.Seconds(), statement)
+}
+
+// instrumentRequests returns a middleware that counts the requests and observes their durations by
+// method, route and status code. Requests that match no route are recorded with the route
+// 'unmatched', so that arbitrary paths do not create new series.
+func instrumentRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		record := func(status int) {
+			route := c.FullPath()
+			if route == "" {
+				route = "unmatched"
+			}
+			code := strconv.Itoa(status)
+			requestsTotal.Inc(c.Request.Method, route, code)
+			requestDuration.Observe(time.Since(start).Seconds(), c.Request.Method, route, code)
+		}
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				// the recovery middleware answers with the INTERNAL SERVER ERROR status code
+				record(http.StatusInternalServerError)
+				panic(recovered)
+			}
+		}()
+		c.Next()
+		record(c.Writer.Status())
+	}
+}
+
+// exposeMetrics responds with the metrics of the service in the text format of Prometheus. The
+// metrics require the 'admin' scope, unless the environment variable PUBLIC_METRICS is set to
+// 'true'; see SetupHttpRouter.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/metrics --header "X-API-Key: csk_..."
+func exposeMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := registry.Write(c.Request.Context(), c.Writer); err != nil {
+		log.Println("could not write metrics:", err)
+	}
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMetrics executes a GET request for a contact that does not exist, followed by a GET request
+// for the metrics with authentication and public metrics turned on. It expects that the metrics
+// are exposed without credentials, and that they contain the request, the pool statistics and the
+// last count of the contacts.
+func TestMetrics(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectContactNotFound(mock)
+	mock.ExpectQuery("SELECT deleted_at IS NOT NULL AS deleted, COUNT\\(\\*\\) AS count FROM contacts").
+		WillReturnRows(mock.NewRows([]string{"deleted", "count"}).AddRow(false, 12).AddRow(true, 3))
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	recorder := serveFrom(router, "/contacts/42", "192.0.2.1")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	refreshContactCounts(context.Background())
+	t.Setenv("REQUIRE_AUTH", "true")
+	t.Setenv("PUBLIC_METRICS", "true")
+	router = SetupHttpRouter()
+	recorder = serveFrom(router, "/metrics", "192.0.2.1")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+	body := recorder.Body.String()
+	assert.Contains(t, body, `contacts_service_http_requests_total{method="GET",route="/contacts/:id",status="404"}`)
+	assert.Contains(t, body, `contacts_service_http_request_duration_seconds_count{method="GET",route="/contacts/:id",status="404"}`)
+	assert.Contains(t, body, `contacts_service_db_connections{state="idle"}`)
+	assert.Contains(t, body, "contacts_service_db_max_open_connections 0")
+	assert.Contains(t, body, `contacts_service_contacts{state="active"} 12`)
+	assert.Contains(t, body, `contacts_service_contacts{state="trash"} 3`)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestMetricsRequireAdmin executes GET requests for the metrics without credentials and with an
+// admin key. It expects that only the admin key gets the metrics, and that the contacts are not
+// counted on a scrape.
+func TestMetricsRequireAdmin(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	assert.Equal(t, http.StatusForbidden, serveFrom(router, "/metrics", "192.0.2.1").Code)
+	recorder := serveWithHeaders(router, "/metrics", "192.0.2.1", map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "contacts_service_http_requests_total")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/events"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// outboxBatchSize is the maximum number of outbox events that are dispatched in one run.
+const outboxBatchSize = 100
+
+// outboxRetention is the time that dispatched events are kept in the outbox before they are
+// removed.
+const outboxRetention = 24 * time.Hour
+
+// outboxPurgeInterval is the time between two purges of dispatched events from the outbox.
+const outboxPurgeInterval = time.Hour
+
+// outboxPollInterval is the time between two runs of the outbox dispatcher if it is not woken up
+// by a committed transaction.
+var outboxPollInterval = time.Second
+
+// outboxSignal wakes up the outbox dispatcher. It holds at most one pending signal.
+var outboxSignal = make(chan struct{}, 1)
+
+// OutboxSink receives the events that the outbox dispatcher relays. An event is relayed at least
+// once; after a failure or a crash, the same event may be relayed again with the same key, so
+// sinks must either tolerate duplicates or discard them by their key.
+type OutboxSink interface {
+	// Deliver hands the event to the sink. If it returns an error, the event is relayed to all
+	// sinks again in the next run of the dispatcher.
+	Deliver(ctx context.Context, event events.Event) error
+}
+
+// LogSink is the outbox sink that writes events to the log.
+type LogSink struct{}
+
+// Deliver implements the OutboxSink interface.
+func (LogSink) Deliver(ctx context.Context, event events.Event) error {
+	log.Printf("contact %d %s (event %s)\n", event.ContactId, event.Type, event.Key)
+	return nil
+}
+
+// outboxRow is an event as it is stored in the outbox. The payload is the contact after the
+// change, or null if the contact was deleted. The owner is empty for contacts without owner.
+type outboxRow struct {
+	Id           int64          `db:"id"`
+	Key          string         `db:"idempotency_key"`
+	TenantId     string         `db:"tenant_id"`
+	Owner        string         `db:"owner"`
+	EventType    string         `db:"event_type"`
+	ContactId    int64          `db:"contact_id"`
+	Payload      sql.NullString `db:"payload"`
+	CreatedAt    time.Time      `db:"created_at"`
+	DispatchedAt *time.Time     `db:"dispatched_at"`
+}
+
+// newOutboxRow creates the outbox event that matches an audit log entry. Every event gets a new
+// random key.
+func newOutboxRow(row auditRow) outboxRow {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		log.Panicln(err)
+	}
+	outbox := outboxRow{Key: hex.EncodeToString(key), TenantId: row.TenantId, Owner: row.Owner, ContactId: row.ContactId,
+		Payload: row.After}
+	switch {
+	case !row.After.Valid:
+		outbox.EventType = events.Deleted
+	case row.Action == actionCreate:
+		outbox.EventType = events.Created
+	default:
+		outbox.EventType = events.Updated
+	}
+	return outbox
+}
+
+// toEvent converts an outbox row into the event that is relayed to the sinks.
+func (row outboxRow) toEvent() (events.Event, error) {
+	event := events.Event{Id: row.Id, Key: row.Key, TenantId: row.TenantId, Owner: row.Owner, Type: row.EventType, ContactId: row.ContactId, Time: row.CreatedAt}
+	if row.Payload.Valid {
+		var contact model.Contact
+		if err := json.Unmarshal([]byte(row.Payload.String), &contact); err != nil {
+			return event, fmt.Errorf("invalid payload of outbox event %d: %w", row.Id, err)
+		}
+		event.Contact = &contact
+	}
+	return event, nil
+}
+
+// signalOutbox wakes up the outbox dispatcher without waiting for it.
+func signalOutbox() {
+	select {
+	case outboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// DispatchOutbox relays the events in the outbox that were not dispatched yet to all sinks, in the
+// order in which they were written, and marks them as dispatched. It stops at the first event that
+// a sink fails to accept, so that the event and all later events are relayed again in the next
+// run. It returns the number of dispatched events.
+//
+// The events are claimed with a lock that other instances of the service skip, so every event is
+// dispatched by one instance only, unless that instance fails before it marks the event as
+// dispatched. Instances do not wait for each other, so events that are claimed by different
+// instances may reach the sinks out of order.
+func DispatchOutbox(ctx context.Context, sinks []OutboxSink) (int, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	var rows []outboxRow
+	err = tx.SelectContext(ctx, &rows, `
+		SELECT * FROM outbox
+		WHERE dispatched_at IS NULL
+		ORDER BY id
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED`, outboxBatchSize)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	dispatched, err := deliverOutbox(ctx, tx, rows, sinks)
+	// the events that were dispatched before a failure are committed as well
+	if commitErr := tx.Commit(); commitErr != nil {
+		return 0, commitErr
+	}
+	return dispatched, err
+}
+
+// deliverOutbox relays the claimed events to all sinks and marks them as dispatched within the
+// transaction. It returns the number of dispatched events.
+func deliverOutbox(ctx context.Context, tx *sqlx.Tx, rows []outboxRow, sinks []OutboxSink) (int, error) {
+	for i, row := range rows {
+		event, err := row.toEvent()
+		if err != nil {
+			return i, err
+		}
+		for _, sink := range sinks {
+			if err := sink.Deliver(ctx, event); err != nil {
+				return i, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE outbox SET dispatched_at = ? WHERE id = ?`, time.Now().UTC(), row.Id); err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
+
+// purgeOutbox removes the events from the outbox that were dispatched before the retention
+// period.
+func purgeOutbox(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, `
+		DELETE FROM outbox WHERE dispatched_at < ?`, time.Now().Add(-outboxRetention).UTC())
+	return err
+}
+
+// StartOutboxDispatcher starts a background job that relays the events in the outbox to the
+// specified sinks until the context is cancelled. The job runs whenever a transaction was
+// committed, and at least every second to pick up events that other instances of the service
+// wrote or that could not be dispatched before.
+//
+// If several instances of the service run at the same time, every event is relayed to the sinks
+// by one of them; see DispatchOutbox. Every instance publishes all events to the clients of its
+// own event stream, however; see eventStreamRelay. The dispatcher must be started after the router
+// is set up, since the relay depends on the configured request timeout.
+func StartOutboxDispatcher(ctx context.Context, sinks ...OutboxSink) {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+		lastPurge := time.Now()
+		relay := newEventStreamRelay()
+		for {
+			if _, err := relay.publish(ctx); err != nil && ctx.Err() == nil {
+				log.Println("could not publish events to the event stream:", err)
+			}
+			// dispatch until the outbox is drained, so that bursts of changes do not wait for the ticker
+			for {
+				dispatched, err := DispatchOutbox(ctx, sinks)
+				if err != nil && ctx.Err() == nil {
+					log.Println("could not dispatch outbox:", err)
+				}
+				if err != nil || dispatched < outboxBatchSize {
+					break
+				}
+			}
+			if time.Since(lastPurge) >= outboxPurgeInterval {
+				if err := purgeOutbox(ctx); err != nil && ctx.Err() == nil {
+					log.Println("could not purge outbox:", err)
+				}
+				lastPurge = time.Now()
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-outboxSignal:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
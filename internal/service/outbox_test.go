@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/events"
+)
+
+// recordingSink is an outbox sink that records the events it receives. It fails for the events of
+// the contact with the id failFor.
+type recordingSink struct {
+	events  []events.Event
+	failFor int64
+}
+
+// Deliver implements the OutboxSink interface.
+func (sink *recordingSink) Deliver(ctx context.Context, event events.Event) error {
+	if event.ContactId == sink.failFor {
+		return errors.New("sink is not available")
+	}
+	sink.events = append(sink.events, event)
+	return nil
+}
+
+// expectOutboxRelay instructs the mock object to expect that the recent events are selected from
+// the outbox to be published to the event stream. A single event is returned.
+func expectOutboxRelay(mock sqlmock.Sqlmock, id int, eventType string, payload interface{}) {
+	rows := mock.NewRows([]string{"id", "idempotency_key", "tenant_id", "event_type", "contact_id", "payload", "created_at"}).
+		AddRow(7, "0123456789abcdef0123456789abcdef", defaultTenant, eventType, id, payload, createdAt)
+	mock.ExpectQuery("SELECT \\* FROM outbox WHERE created_at > NOW\\(6\\) - INTERVAL \\? MICROSECOND ORDER BY id").
+		WithArgs(changeSettleTime().Microseconds()).
+		WillReturnRows(rows)
+}
+
+// TestDispatchOutbox dispatches the outbox with two events. It expects that both events are
+// relayed to all sinks in order, and that they are marked as dispatched.
+func TestDispatchOutbox(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	rows := mock.NewRows([]string{"id", "idempotency_key", "event_type", "contact_id", "payload", "created_at"}).
+		AddRow(7, "0123456789abcdef0123456789abcdef", "updated", 42, `{"id": 42, "firstname": "Erika", "version": 2}`, createdAt).
+		AddRow(8, "fedcba9876543210fedcba9876543210", "deleted", 43, nil, createdAt)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM outbox WHERE dispatched_at IS NULL ORDER BY id LIMIT \\? FOR UPDATE SKIP LOCKED").
+		WithArgs(outboxBatchSize).
+		WillReturnRows(rows)
+	for _, id := range []int64{7, 8} {
+		mock.ExpectExec("UPDATE outbox SET dispatched_at = \\? WHERE id = \\?").
+			WithArgs(sqlmock.AnyArg(), id).
+			WillReturnResult(sqlmock.NewResult(-1, 1))
+	}
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	initializeContactsService(db)
+	first, second := &recordingSink{}, &recordingSink{}
+	dispatched, err := DispatchOutbox(context.Background(), []OutboxSink{first, second})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, dispatched)
+	assert.Equal(t, first.events, second.events)
+	assert.Equal(t, 2, len(first.events))
+	assert.Equal(t, "0123456789abcdef0123456789abcdef", first.events[0].Key)
+	assert.Equal(t, events.Updated, first.events[0].Type)
+	assert.Equal(t, "Erika", *first.events[0].Contact.FirstName)
+	assert.Equal(t, createdAt, first.events[0].Time)
+	assert.Equal(t, events.Deleted, first.events[1].Type)
+	assert.Nil(t, first.events[1].Contact)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestDispatchOutboxSinkFails dispatches the outbox to a sink that rejects the second event. It
+// expects that only the first event is marked as dispatched and committed, so that the second one
+// is relayed again in the next run.
+func TestDispatchOutboxSinkFails(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	rows := mock.NewRows([]string{"id", "idempotency_key", "event_type", "contact_id", "payload", "created_at"}).
+		AddRow(7, "0123456789abcdef0123456789abcdef", "deleted", 42, nil, createdAt).
+		AddRow(8, "fedcba9876543210fedcba9876543210", "deleted", 43, nil, createdAt).
+		AddRow(9, "00000000000000000000000000000000", "deleted", 44, nil, createdAt)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM outbox WHERE dispatched_at IS NULL ORDER BY id LIMIT \\? FOR UPDATE SKIP LOCKED").
+		WithArgs(outboxBatchSize).
+		WillReturnRows(rows)
+	mock.ExpectExec("UPDATE outbox SET dispatched_at = \\? WHERE id = \\?").
+		WithArgs(sqlmock.AnyArg(), int64(7)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	initializeContactsService(db)
+	sink := &recordingSink{failFor: 43}
+	dispatched, err := DispatchOutbox(context.Background(), []OutboxSink{sink})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, dispatched)
+	assert.Equal(t, 1, len(sink.events))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestNewOutboxRow converts audit log entries into outbox events. It expects that the event types
+// match the changes, and that every event gets its own key.
+func TestNewOutboxRow(t *testing.T) {
+	after := sql.NullString{String: `{"id": 42}`, Valid: true}
+	created := newOutboxRow(auditRow{ContactId: 42, Action: actionCreate, After: after})
+	updated := newOutboxRow(auditRow{ContactId: 42, Action: actionRestore, After: after})
+	deleted := newOutboxRow(auditRow{ContactId: 42, Action: actionMerge})
+	assert.Equal(t, events.Created, created.EventType)
+	assert.Equal(t, events.Updated, updated.EventType)
+	assert.Equal(t, events.Deleted, deleted.EventType)
+	assert.Equal(t, 32, len(created.Key))
+	assert.NotEqual(t, created.Key, updated.Key)
+}
+
+// TestPublishOutboxToEventStream publishes the recent events in the outbox to the event stream
+// twice. It expects that every event is published once, including events with lower ids that
+// appear later.
+func TestPublishOutboxToEventStream(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	columns := []string{"id", "idempotency_key", "event_type", "contact_id", "payload", "created_at"}
+	mock.ExpectQuery("SELECT \\* FROM outbox WHERE created_at > NOW\\(6\\) - INTERVAL \\? MICROSECOND ORDER BY id").
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(8, "fedcba9876543210fedcba9876543210", "deleted", 43, nil, createdAt))
+	mock.ExpectQuery("SELECT \\* FROM outbox WHERE created_at > NOW\\(6\\) - INTERVAL \\? MICROSECOND ORDER BY id").
+		WillReturnRows(mock.NewRows(columns).
+			AddRow(7, "0123456789abcdef0123456789abcdef", "deleted", 42, nil, createdAt).
+			AddRow(8, "fedcba9876543210fedcba9876543210", "deleted", 43, nil, createdAt))
+
+	// Run test and compare results
+	initializeContactsService(db)
+	subscription, _, _ := eventBus.Subscribe(0, false)
+	defer eventBus.Unsubscribe(subscription)
+	relay := newEventStreamRelay()
+	published, err := relay.publish(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, published)
+	published, err = relay.publish(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, published)
+	assert.Equal(t, int64(43), (<-subscription.C).ContactId)
+	assert.Equal(t, int64(42), (<-subscription.C).ContactId)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,280 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// mergePatchContentType is the media type of a JSON Merge Patch document as defined in RFC 7396.
+const mergePatchContentType = "application/merge-patch+json"
+
+// jsonPatchContentType is the media type of a JSON Patch document as defined in RFC 6902.
+const jsonPatchContentType = "application/json-patch+json"
+
+// patchableFields are the contact properties that can be changed with a PATCH request.
+var patchableFields = []string{"firstname", "lastname", "phone", "birthday", "vip"}
+
+// jsonNull is the JSON representation of a null value.
+var jsonNull = json.RawMessage("null")
+
+// document is the JSON representation of a contact on which patches operate. Properties without
+// a value are not present in the map, just like they are omitted in the JSON responses.
+type document map[string]json.RawMessage
+
+// contactPatch is a parsed and validated patch document that can be applied to a contact.
+type contactPatch interface {
+	apply(doc document) error
+	fields() []string
+}
+
+// mergePatch is a JSON Merge Patch document. A null value removes the property from the contact,
+// any other value replaces it.
+type mergePatch map[string]json.RawMessage
+
+// patchOperation is a single operation of a JSON Patch document.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// jsonPatch is a JSON Patch document, a sequence of operations which are applied in order.
+type jsonPatch []patchOperation
+
+// parseMergePatch parses and validates a JSON Merge Patch document. Only the properties listed in
+// patchableFields may be used, and their values must have the correct type.
+func parseMergePatch(body []byte) (contactPatch, error) {
+	var patch mergePatch
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		return nil, errors.New("merge patch must be a JSON object")
+	}
+	for field, value := range patch {
+		if !contains(patchableFields, field) {
+			return nil, fmt.Errorf("property '%s' cannot be patched", field)
+		}
+		if err := validateFieldValue(field, value); err != nil {
+			return nil, err
+		}
+	}
+	return patch, nil
+}
+
+// apply applies the merge patch to the document.
+func (patch mergePatch) apply(doc document) error {
+	for field, value := range patch {
+		setField(doc, field, value)
+	}
+	return nil
+}
+
+// fields returns the properties that the merge patch changes.
+func (patch mergePatch) fields() []string {
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// parseJSONPatch parses and validates a JSON Patch document. Every operation must be known, must
+// refer to one of the properties in patchableFields and must carry the members it requires.
+func parseJSONPatch(body []byte) (contactPatch, error) {
+	var patch jsonPatch
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		return nil, errors.New("JSON patch must be a JSON array of operations")
+	}
+	for i, operation := range patch {
+		if err := operation.validate(); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return patch, nil
+}
+
+// validate checks that the operation is syntactically correct.
+func (operation patchOperation) validate() error {
+	if _, err := fieldFromPointer(operation.Path); err != nil {
+		return err
+	}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return fmt.Errorf("'%s' requires a value", operation.Op)
+		}
+		field, _ := fieldFromPointer(operation.Path)
+		return validateFieldValue(field, operation.Value)
+	case "move", "copy":
+		_, err := fieldFromPointer(operation.From)
+		return err
+	case "remove":
+		return nil
+	default:
+		return fmt.Errorf("unknown operation '%s'", operation.Op)
+	}
+}
+
+// apply applies all operations of the JSON patch to the document. It stops at the first
+// operation that fails.
+func (patch jsonPatch) apply(doc document) error {
+	for i, operation := range patch {
+		if err := operation.apply(doc); err != nil {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// fields returns the properties that the operations of the JSON patch read or change, including
+// the properties that values are moved or copied from.
+func (patch jsonPatch) fields() []string {
+	var fields []string
+	for _, operation := range patch {
+		field, _ := fieldFromPointer(operation.Path)
+		fields = append(fields, field)
+		if operation.Op == "move" || operation.Op == "copy" {
+			from, _ := fieldFromPointer(operation.From)
+			fields = append(fields, from)
+		}
+	}
+	return fields
+}
+
+// apply applies a single operation to the document.
+func (operation patchOperation) apply(doc document) error {
+	field, _ := fieldFromPointer(operation.Path)
+	switch operation.Op {
+	case "add":
+		setField(doc, field, operation.Value)
+	case "remove":
+		if _, found := doc[field]; !found {
+			return fmt.Errorf("property '%s' does not exist", field)
+		}
+		delete(doc, field)
+	case "replace":
+		if _, found := doc[field]; !found {
+			return fmt.Errorf("property '%s' does not exist", field)
+		}
+		setField(doc, field, operation.Value)
+	case "move", "copy":
+		from, _ := fieldFromPointer(operation.From)
+		value, found := doc[from]
+		if !found {
+			return fmt.Errorf("property '%s' does not exist", from)
+		}
+		if err := validateFieldValue(field, value); err != nil {
+			return err
+		}
+		if operation.Op == "move" {
+			delete(doc, from)
+		}
+		doc[field] = value
+	case "test":
+		value, found := doc[field]
+		if !found {
+			value = jsonNull
+		}
+		if !jsonEqual(value, operation.Value) {
+			return fmt.Errorf("test of property '%s' failed", field)
+		}
+	}
+	return nil
+}
+
+// fieldFromPointer converts a JSON pointer like '/firstname' into the name of the property it
+// points to. Only pointers to the properties in patchableFields are accepted.
+func fieldFromPointer(pointer string) (string, error) {
+	field, found := strings.CutPrefix(pointer, "/")
+	if !found || !contains(patchableFields, field) {
+		return "", fmt.Errorf("path '%s' cannot be patched", pointer)
+	}
+	return field, nil
+}
+
+// validateFieldValue checks that the value is either null or a string, and that it is a valid
+// RFC 3339 timestamp in case of the birthday. The VIP flag must be null, which clears it, or a
+// boolean.
+func validateFieldValue(field string, value json.RawMessage) error {
+	if isNull(value) {
+		return nil
+	}
+	if field == "vip" {
+		var flag bool
+		if err := json.Unmarshal(value, &flag); err != nil {
+			return fmt.Errorf("property '%s' must be a boolean or null", field)
+		}
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(value, &str); err != nil {
+		return fmt.Errorf("property '%s' must be a string or null", field)
+	}
+	if field == "birthday" {
+		if _, err := time.Parse(time.RFC3339, str); err != nil {
+			return fmt.Errorf("property '%s' must be an RFC 3339 timestamp", field)
+		}
+	}
+	return nil
+}
+
+// setField sets the property of the document to the value. A null value removes the property.
+func setField(doc document, field string, value json.RawMessage) {
+	if isNull(value) {
+		delete(doc, field)
+	} else {
+		doc[field] = value
+	}
+}
+
+// isNull returns true if the raw JSON value is null.
+func isNull(value json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(value), jsonNull)
+}
+
+// jsonEqual returns true if both raw JSON values are semantically equal.
+func jsonEqual(a json.RawMessage, b json.RawMessage) bool {
+	var valueA, valueB interface{}
+	if json.Unmarshal(a, &valueA) != nil || json.Unmarshal(b, &valueB) != nil {
+		return false
+	}
+	return reflect.DeepEqual(valueA, valueB)
+}
+
+// contactToDocument converts a contact into the document representation that patches operate on.
+// The id, the version and the timestamps are not part of the document because they cannot be
+// patched.
+func contactToDocument(contact model.Contact) (document, error) {
+	marshalled, err := json.Marshal(contact)
+	if err != nil {
+		return nil, err
+	}
+	var doc document
+	if err := json.Unmarshal(marshalled, &doc); err != nil {
+		return nil, err
+	}
+	delete(doc, "id")
+	delete(doc, "version")
+	delete(doc, "created_at")
+	delete(doc, "updated_at")
+	return doc, nil
+}
+
+// documentToContact converts a patched document back into a contact.
+func documentToContact(doc document) (model.Contact, error) {
+	var contact model.Contact
+	marshalled, err := json.Marshal(doc)
+	if err != nil {
+		return contact, err
+	}
+	err = json.Unmarshal(marshalled, &contact)
+	return contact, err
+}
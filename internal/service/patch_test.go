@@ -0,0 +1,84 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMergePatchApply applies a JSON Merge Patch to a document. It expects that values are
+// replaced or added, that null values remove properties, and that other properties are untouched.
+func TestMergePatchApply(t *testing.T) {
+	doc := document{
+		"firstname": json.RawMessage(`"Erika"`),
+		"phone":     json.RawMessage(`"0815"`),
+	}
+	patch, err := parseMergePatch([]byte(`{"lastname": "Mustermann", "phone": null}`))
+	assert.Nil(t, err)
+	assert.Nil(t, patch.apply(doc))
+	assert.Equal(t, document{
+		"firstname": json.RawMessage(`"Erika"`),
+		"lastname":  json.RawMessage(`"Mustermann"`),
+	}, doc)
+}
+
+// TestMergePatchVIP applies JSON Merge Patches to the VIP flag. It expects that true sets it, that
+// null clears it, and that values other than booleans are rejected.
+func TestMergePatchVIP(t *testing.T) {
+	doc := document{"firstname": json.RawMessage(`"Erika"`)}
+	patch, err := parseMergePatch([]byte(`{"vip": true}`))
+	assert.Nil(t, err)
+	assert.Nil(t, patch.apply(doc))
+	contact, err := documentToContact(doc)
+	assert.Nil(t, err)
+	assert.True(t, contact.VIP)
+
+	patch, err = parseMergePatch([]byte(`{"vip": null}`))
+	assert.Nil(t, err)
+	assert.Nil(t, patch.apply(doc))
+	contact, err = documentToContact(doc)
+	assert.Nil(t, err)
+	assert.False(t, contact.VIP)
+
+	_, err = parseMergePatch([]byte(`{"vip": "yes"}`))
+	assert.NotNil(t, err)
+	_, err = parseJSONPatch([]byte(`[{"op": "add", "path": "/phone", "value": true}]`))
+	assert.NotNil(t, err)
+}
+
+// TestJSONPatchMoveAndCopy applies JSON Patch documents with move and copy operations. It expects
+// that move removes the source property while copy keeps it.
+func TestJSONPatchMoveAndCopy(t *testing.T) {
+	doc := document{"firstname": json.RawMessage(`"Erika"`)}
+	patch, err := parseJSONPatch([]byte(`[{"op": "copy", "from": "/firstname", "path": "/lastname"}]`))
+	assert.Nil(t, err)
+	assert.Nil(t, patch.apply(doc))
+	assert.Equal(t, json.RawMessage(`"Erika"`), doc["firstname"])
+	assert.Equal(t, json.RawMessage(`"Erika"`), doc["lastname"])
+
+	patch, err = parseJSONPatch([]byte(`[{"op": "move", "from": "/lastname", "path": "/phone"}]`))
+	assert.Nil(t, err)
+	assert.Nil(t, patch.apply(doc))
+	assert.NotContains(t, doc, "lastname")
+	assert.Equal(t, json.RawMessage(`"Erika"`), doc["phone"])
+}
+
+// TestJSONPatchApplyErrors applies JSON Patch documents that are syntactically valid but do not
+// fit the document. It expects that an error is returned for each of them.
+func TestJSONPatchApplyErrors(t *testing.T) {
+	patches := []string{
+		`[{"op": "remove", "path": "/phone"}]`,
+		`[{"op": "replace", "path": "/phone", "value": "0815"}]`,
+		`[{"op": "move", "from": "/phone", "path": "/lastname"}]`,
+		`[{"op": "test", "path": "/firstname", "value": "Rudi"}]`,
+		`[{"op": "copy", "from": "/firstname", "path": "/birthday"}]`,
+		`[{"op": "copy", "from": "/firstname", "path": "/vip"}]`,
+	}
+	for _, body := range patches {
+		doc := document{"firstname": json.RawMessage(`"Erika"`)}
+		patch, err := parseJSONPatch([]byte(body))
+		assert.Nil(t, err, "patch: "+body)
+		assert.NotNil(t, patch.apply(doc), "patch: "+body)
+	}
+}
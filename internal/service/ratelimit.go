@@ -0,0 +1,153 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/ratelimit"
+)
+
+// clientKey is the key under which the identity of the client for rate limiting is stored in the
+// gin context. It is only set for authenticated clients.
+const clientKey = "client"
+
+// Groups of routes that are rate limited separately, by the scope that they require, and the group
+// of all requests, which are rate limited by IP address before the client is authenticated.
+const (
+	rateLimitRead    = "read"
+	rateLimitWrite   = "write"
+	rateLimitAdmin   = "admin"
+	rateLimitAddress = "ip"
+)
+
+// rateLimits are the limits of the route groups. Groups without a limit are not rate limited.
+// They are taken from the RATE_LIMIT_READ, RATE_LIMIT_WRITE, RATE_LIMIT_ADMIN and RATE_LIMIT_IP
+// environment variables when the router is set up.
+var rateLimits map[string]ratelimit.Limit
+
+// trustedProxies are the addresses and networks of the proxies whose X-Forwarded-For and X-Real-IP
+// headers are trusted to carry the IP address of the client. If it is empty, no proxy is trusted,
+// and the IP address of a client is the address that the request comes from.
+var trustedProxies []string
+
+// rateLimitStore keeps the token buckets of the clients.
+var rateLimitStore ratelimit.Store
+
+// sharedRateLimitStore is the store that replaces the memory store, or nil if every instance of
+// the service keeps its own buckets.
+var sharedRateLimitStore ratelimit.Store
+
+// UseRateLimitStore makes the service keep the token buckets of the clients in the store, for
+// example one that is shared by all instances of the service. It must be called before the router
+// is set up.
+func UseRateLimitStore(store ratelimit.Store) {
+	sharedRateLimitStore = store
+}
+
+// setupRateLimits reads the limits of the route groups from environment variables, in the format
+// '<count>/<unit>' of ratelimit.ParseLimit, for example RATE_LIMIT_READ=600/m. Without a shared
+// store, the buckets are kept in memory, and start out full whenever the router is set up.
+//
+// The environment variable TRUSTED_PROXIES is a comma-separated list of the IP addresses and CIDR
+// networks of the proxies in front of the service, for example TRUSTED_PROXIES=10.0.0.0/8. Without
+// it, the X-Forwarded-For header is ignored, so that clients cannot escape their limit by sending
+// a different address in it.
+func setupRateLimits() {
+	trustedProxies = nil
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	rateLimits = make(map[string]ratelimit.Limit)
+	for group, variable := range map[string]string{
+		rateLimitRead:    "RATE_LIMIT_READ",
+		rateLimitWrite:   "RATE_LIMIT_WRITE",
+		rateLimitAdmin:   "RATE_LIMIT_ADMIN",
+		rateLimitAddress: "RATE_LIMIT_IP",
+	} {
+		value := os.Getenv(variable)
+		if value == "" {
+			continue
+		}
+		limit, err := ratelimit.ParseLimit(value)
+		if err != nil {
+			log.Fatalf("could not parse %s env variable: %v", variable, err)
+		}
+		rateLimits[group] = limit
+	}
+	rateLimitStore = sharedRateLimitStore
+	if rateLimitStore == nil {
+		rateLimitStore = ratelimit.NewMemoryStore()
+	}
+}
+
+// rateLimitClient returns the identity of the client for rate limiting: the API key or the subject
+// of the bearer token of authenticated clients, and the IP address of other clients.
+func rateLimitClient(c *gin.Context) string {
+	if client := c.GetString(clientKey); client != "" {
+		return client
+	}
+	return rateLimitAddressOf(c)
+}
+
+// rateLimitAddressOf returns the IP address of the client for rate limiting.
+func rateLimitAddressOf(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// rateLimit returns a middleware that limits the requests of every client to the route group with
+// a token bucket. The responses carry the RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining
+// and RateLimit-Reset headers. Requests beyond the limit are answered with the TOO MANY REQUESTS
+// status code and a Retry-After header. If the store fails, requests are let through, so that the
+// service stays available without its store.
+func rateLimit(group string) gin.HandlerFunc {
+	return limitRate(group, rateLimitClient)
+}
+
+// rateLimitAddresses returns a middleware that limits the requests of every IP address, whether
+// authenticated or not. It runs before the client is authenticated, so that a flood of requests
+// with made-up credentials does not reach the database.
+func rateLimitAddresses() gin.HandlerFunc {
+	return limitRate(rateLimitAddress, rateLimitAddressOf)
+}
+
+// limitRate returns a middleware that limits the requests to the route group with a token bucket
+// for every client, as identified by the function.
+func limitRate(group string, client func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, found := rateLimits[group]
+		if !found {
+			c.Next()
+			return
+		}
+		result, err := rateLimitStore.Take(c.Request.Context(), group+"|"+client(c), limit)
+		if err != nil {
+			log.Println("could not take rate limit token:", err)
+			c.Next()
+			return
+		}
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Count, int(limit.Period.Seconds())))
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.Count))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", wholeSeconds(result.Reset))
+		if !result.Allowed {
+			c.Header("Retry-After", wholeSeconds(result.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// wholeSeconds formats a duration as a number of seconds, rounded up.
+func wholeSeconds(duration time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(duration.Seconds())))
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/ratelimit"
+)
+
+// failingStore is a rate limit store that is not available.
+type failingStore struct{}
+
+// Take implements the ratelimit.Store interface.
+func (failingStore) Take(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("store not available")
+}
+
+// expectContactNotFound instructs the mock object to expect that a contact is selected, but that
+// it does not exist.
+func expectContactNotFound(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\?").
+		WillReturnRows(mock.NewRows([]string{"id", "firstname"}))
+}
+
+// serveFrom executes a GET request against the router on behalf of the client with the IP address.
+func serveFrom(router *gin.Engine, url string, address string) *httptest.ResponseRecorder {
+	return serveRequestFrom(router, "GET", url, address)
+}
+
+// serveRequestFrom executes a request without body against the router on behalf of the client
+// with the IP address.
+func serveRequestFrom(router *gin.Engine, method string, url string, address string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest(method, url, nil)
+	request.RemoteAddr = address + ":41234"
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// serveWithHeaders executes a GET request with the headers against the router on behalf of the
+// client with the IP address.
+func serveWithHeaders(router *gin.Engine, url string, address string, headers map[string]string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", url, nil)
+	request.RemoteAddr = address + ":41234"
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// TestRateLimitExceeded executes more GET requests than the limit allows. It expects that the
+// responses carry the state of the limit, and that the last request is answered with the TOO MANY
+// REQUESTS status code without reaching the database.
+func TestRateLimitExceeded(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("RATE_LIMIT_READ", "2/m")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectContactNotFound(mock)
+	expectContactNotFound(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	first := serveFrom(router, "/contacts/42", "192.0.2.1")
+	assert.Equal(t, http.StatusNotFound, first.Code)
+	assert.Equal(t, "2", first.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", first.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2;w=60", first.Header().Get("RateLimit-Policy"))
+	second := serveFrom(router, "/contacts/42", "192.0.2.1")
+	assert.Equal(t, http.StatusNotFound, second.Code)
+	assert.Equal(t, "0", second.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", second.Header().Get("RateLimit-Reset"))
+	third := serveFrom(router, "/contacts/42", "192.0.2.1")
+	assert.Equal(t, http.StatusTooManyRequests, third.Code)
+	assert.Equal(t, "30", third.Header().Get("Retry-After"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRateLimitPerClientAndGroup executes requests of two clients to two route groups, of which
+// only one is limited. It expects that every client has its own bucket, and that the other group
+// is not limited.
+func TestRateLimitPerClientAndGroup(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("RATE_LIMIT_WRITE", "1/h")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectContactNotFound(mock)
+	expectContactNotFound(mock)
+	expectContactNotFound(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	assert.Equal(t, http.StatusNotFound, serveFrom(router, "/contacts/42", "192.0.2.1").Code)
+	assert.Equal(t, http.StatusNotFound, serveFrom(router, "/contacts/42", "192.0.2.1").Code)
+	assert.Empty(t, serveFrom(router, "/contacts/42", "192.0.2.1").Header().Get("RateLimit-Limit"))
+
+	writing := serveRequestFrom(router, "DELETE", "/contacts/abc", "192.0.2.1")
+	assert.Equal(t, http.StatusNotFound, writing.Code)
+	assert.Equal(t, "1", writing.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, http.StatusTooManyRequests, serveRequestFrom(router, "DELETE", "/contacts/abc", "192.0.2.1").Code)
+	assert.Equal(t, http.StatusNotFound, serveRequestFrom(router, "DELETE", "/contacts/abc", "192.0.2.2").Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRateLimitStoreFailure executes a GET request while the rate limit store is not available. It
+// expects that the request is executed anyway.
+func TestRateLimitStoreFailure(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("RATE_LIMIT_READ", "1/h")
+	UseRateLimitStore(failingStore{})
+	t.Cleanup(func() { UseRateLimitStore(nil) })
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectContactNotFound(mock)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/42", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("RateLimit-Limit"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRateLimitIgnoresForwardedFor executes requests of one client that claims a different IP
+// address in every X-Forwarded-For header. It expects that the header is ignored, and that the
+// client is limited by the address that the requests come from.
+func TestRateLimitIgnoresForwardedFor(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("RATE_LIMIT_READ", "1/h")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectContactNotFound(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	first := serveWithHeaders(router, "/contacts/42", "192.0.2.1", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+	assert.Equal(t, http.StatusNotFound, first.Code)
+	second := serveWithHeaders(router, "/contacts/42", "192.0.2.1", map[string]string{"X-Forwarded-For": "198.51.100.2"})
+	assert.Equal(t, http.StatusTooManyRequests, second.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRateLimitTrustedProxy executes requests of two clients behind a trusted proxy. It expects
+// that the clients are told apart by the X-Forwarded-For header.
+func TestRateLimitTrustedProxy(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("RATE_LIMIT_READ", "1/h")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectContactNotFound(mock)
+	expectContactNotFound(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	first := serveWithHeaders(router, "/contacts/42", "192.0.2.1", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+	assert.Equal(t, http.StatusNotFound, first.Code)
+	second := serveWithHeaders(router, "/contacts/42", "192.0.2.1", map[string]string{"X-Forwarded-For": "198.51.100.2"})
+	assert.Equal(t, http.StatusNotFound, second.Code)
+	third := serveWithHeaders(router, "/contacts/42", "192.0.2.1", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+	assert.Equal(t, http.StatusTooManyRequests, third.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRateLimitAddressBeforeAuthentication executes more requests with an API key from one IP
+// address than the limit of the address allows. It expects that the last request is rejected
+// before the key is looked up in the database.
+func TestRateLimitAddressBeforeAuthentication(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("RATE_LIMIT_IP", "1/h")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, scopeRead, time.Now().UTC())
+	expectContactNotFound(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	headers := map[string]string{apiKeyHeader: testAPIKey}
+	assert.Equal(t, http.StatusNotFound, serveWithHeaders(router, "/contacts/42", "192.0.2.1", headers).Code)
+	rejected := serveWithHeaders(router, "/contacts/42", "192.0.2.1", headers)
+	assert.Equal(t, http.StatusTooManyRequests, rejected.Code)
+	assert.Equal(t, "1", rejected.Header().Get("RateLimit-Limit"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// findContactAsOf responds with the contact whose ID value matches the id parameter of the
+// request URL as it was at the point in time given by the 'as_of' URL parameter. The contact is
+// reconstructed from the audit log. If the contact did not exist at that time, or was in the
+// trash, the call responds with the NOT FOUND status code.
+//
+// Example REST API call:
+//
+//	> curl "http://localhost:8080/contacts/56?as_of=2023-05-01T12:00:00Z"
+func findContactAsOf(c *gin.Context, id int64) {
+	asOf, err := time.Parse(time.RFC3339, c.Query("as_of"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid as_of parameter"})
+		return
+	}
+	if !checkAccess(c, contactAccess(c, id), accessRead, "contact not found") {
+		return
+	}
+	entry := findAuditEntry(c.Request.Context(), selectAuditAsOf, id, tenant(c), asOf.UTC())
+	if entry == nil || entry.After == nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, redactContact(c, *entry.After))
+}
+
+// revertContactByID rolls the contact whose ID value matches the id parameter of the request URL
+// back to the revision given by the 'to' URL parameter. A revision is the version of the contact
+// as listed in its history. The rollback is a regular change that is recorded in the audit log,
+// so it can be reverted itself. Contacts in the trash must be restored before they can be
+// reverted. An If-Match header makes the request conditional on the current version of the
+// contact.
+//
+// Example REST API call:
+//
+//	> curl "http://localhost:8080/contacts/56/revert?to=3" --request "POST"
+func revertContactByID(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	revision, err := strconv.ParseInt(c.Query("to"), 10, 64)
+	if err != nil || revision < 1 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid to parameter"})
+		return
+	}
+	version, success := parseIfMatch(c)
+	if !success {
+		return
+	}
+	if !checkAccess(c, contactAccess(c, id), accessWrite, "contact not found") {
+		return
+	}
+
+	entry := findAuditEntry(c.Request.Context(), selectAuditWhereVersion, id, tenant(c), revision)
+	if entry == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "revision not found"})
+		return
+	}
+	if entry.After == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "cannot revert to a deleted revision"})
+		return
+	}
+	reverted := *entry.After
+	reverted.TenantId = tenant(c)
+	reverted.Version = version
+	reverted.DeletedAt = nil
+	replaceContact(c, reverted, actionRevert)
+}
+
+// findAuditEntry executes a prepared statement that selects a single audit log entry, and returns
+// the entry or nil if there is none.
+func findAuditEntry(ctx context.Context, stmt *sqlx.Stmt, args ...interface{}) *model.AuditEntry {
+	var rows []auditRow
+	if err := stmt.SelectContext(ctx, &rows, args...); err != nil {
+		log.Panicln(err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	entry := rows[0].toAuditEntry()
+	return &entry
+}
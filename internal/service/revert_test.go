@@ -0,0 +1,143 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// auditColumns are the columns of the audit_log table.
+var auditColumns = []string{"id", "contact_id", "action", "version", "before_value", "after_value", "actor", "request_id", "created_at"}
+
+// TestGetAsOf executes a GET request for a contact as it was at a point in time. It expects that
+// the contact values recorded in the audit log are returned.
+func TestGetAsOf(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	rows := mock.NewRows(auditColumns).
+		AddRow(5, 29, "update", 2, nil, `{"id": 29, "firstname": "Rudi", "version": 2}`, "bob", "req-2", time.Now())
+	mock.ExpectQuery("SELECT \\* FROM audit_log WHERE contact_id = \\? AND tenant_id = \\? AND created_at <= \\?").
+		WithArgs(int64(29), defaultTenant, time.Date(2023, time.May, 1, 12, 0, 0, 0, time.UTC)).
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "GET", "/contacts/29?as_of=2023-05-01T14:00:00%2B02:00", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var body map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	assert.Equal(t, 29.0, body["id"])
+	assert.Equal(t, "Rudi", body["firstname"])
+	assert.Equal(t, 2.0, body["version"])
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetAsOfDeleted executes a GET request for a contact at a point in time when it was in the
+// trash. It expects that the HTTP request is answered with the NOT FOUND status code.
+func TestGetAsOfDeleted(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	rows := mock.NewRows(auditColumns).
+		AddRow(6, 29, "delete", 3, `{"id": 29, "firstname": "Rudi", "version": 2}`, nil, "bob", "req-3", time.Now())
+	mock.ExpectQuery("SELECT \\* FROM audit_log WHERE contact_id = \\? AND tenant_id = \\? AND created_at <= \\?").
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "GET", "/contacts/29?as_of=2023-05-01T12:00:00Z", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetAsOfInvalidTimestamp executes a GET request for a contact at a point in time that is not
+// an RFC 3339 timestamp. It expects that the HTTP request is answered with the BAD REQUEST status
+// code, and that we do not reach out to the database in the first place.
+func TestGetAsOfInvalidTimestamp(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/29?as_of=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRevert executes a POST request for reverting a contact to an earlier revision. It expects
+// that the contact is replaced with the values of that revision, that the change is recorded in
+// the audit log, and that the new version of the contact is returned.
+func TestRevert(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	rows := mock.NewRows(auditColumns).
+		AddRow(1, 29, "create", 1, nil, `{"id": 29, "firstname": "Erika", "lastname": "Mustermann", "version": 1}`, "alice", "req-1", time.Now())
+	mock.ExpectQuery("SELECT \\* FROM audit_log WHERE contact_id = \\? AND tenant_id = \\? AND version = \\?").
+		WithArgs(int64(29), defaultTenant, int64(1)).
+		WillReturnRows(rows)
+	mock.ExpectBegin()
+	expectLockedSelect(mock, 29, 2)
+	mock.ExpectExec("UPDATE contacts").
+		WithArgs("Erika", "Mustermann", nil, nil, false, int64(29), defaultTenant, int64(0), int64(0)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+	afterRows := mock.NewRows([]string{"id", "firstname", "lastname", "version"}).
+		AddRow(29, "Erika", "Mustermann", 3)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\?").
+		WithArgs(int64(29), defaultTenant).
+		WillReturnRows(afterRows)
+	expectAuditBy(mock, 29, "revert", 3, "key:billing")
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "POST", "/contacts/29/revert?to=1", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var body map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	assert.Equal(t, "Erika", body["firstname"])
+	assert.Equal(t, 3.0, body["version"])
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRevertUnknownRevision executes a POST request for reverting a contact to a revision that
+// does not exist. It expects that the HTTP request is answered with the NOT FOUND status code.
+func TestRevertUnknownRevision(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	mock.ExpectQuery("SELECT \\* FROM audit_log WHERE contact_id = \\? AND tenant_id = \\? AND version = \\?").
+		WithArgs(int64(29), defaultTenant, int64(7)).
+		WillReturnRows(mock.NewRows(auditColumns))
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "POST", "/contacts/29/revert?to=7", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// rolesKey is the key under which the roles of the client are stored in the gin context.
+const rolesKey = "roles"
+
+// Permissions that roles grant on the fields of contacts. Writing includes reading.
+const (
+	fieldRead  = "read"
+	fieldWrite = "write"
+)
+
+// allEndpoints is the entry in the endpoints of a role that permits all endpoints.
+const allEndpoints = "*"
+
+// role restricts what its clients may do beyond their scopes. Endpoints lists the endpoints that
+// the role may call, as the HTTP method and the route, for example 'GET /contacts/:id'. Fields
+// maps the JSON names of the fields of contacts to the permission on the field; fields that are
+// not listed can neither be read nor written. VIPFields does the same for VIP contacts, and
+// defaults to Fields. If Fields is missing, the role may read and write all fields.
+type role struct {
+	Endpoints []string          `json:"endpoints"`
+	Fields    map[string]string `json:"fields"`
+	VIPFields map[string]string `json:"vip_fields"`
+}
+
+// contactField gives access to a field of a contact that roles can restrict. The value of the
+// field is returned as text, or as nil if the field is not set.
+type contactField struct {
+	value  func(contact *model.Contact) *string
+	redact func(contact *model.Contact)
+}
+
+// contactFields are the fields of a contact that roles can restrict, by their JSON names. The id,
+// the owner and the fields that the service maintains can always be read.
+var contactFields = map[string]contactField{
+	"firstname": {
+		value:  func(contact *model.Contact) *string { return contact.FirstName },
+		redact: func(contact *model.Contact) { contact.FirstName = nil },
+	},
+	"lastname": {
+		value:  func(contact *model.Contact) *string { return contact.LastName },
+		redact: func(contact *model.Contact) { contact.LastName = nil },
+	},
+	"phone": {
+		value:  func(contact *model.Contact) *string { return contact.Phone },
+		redact: func(contact *model.Contact) { contact.Phone = nil },
+	},
+	"birthday": {
+		value: func(contact *model.Contact) *string {
+			if contact.Birthday == nil {
+				return nil
+			}
+			birthday := contact.Birthday.Format(time.DateOnly)
+			return &birthday
+		},
+		redact: func(contact *model.Contact) { contact.Birthday = nil },
+	},
+	"vip": {
+		value: func(contact *model.Contact) *string {
+			if !contact.VIP {
+				return nil
+			}
+			vip := "true"
+			return &vip
+		},
+		redact: func(contact *model.Contact) { contact.VIP = false },
+	},
+}
+
+// roles are the roles that can be assigned to clients, by their names. They are read from the
+// JSON file named by the ROLES_FILE environment variable when the router is set up.
+var roles map[string]role
+
+// roleClaim is the claim of a bearer token that holds the client's roles, or an empty string if
+// tokens do not carry roles. It is taken from the JWT_ROLE_CLAIM environment variable when the
+// router is set up.
+var roleClaim = ""
+
+// setupRoles reads the roles from the JSON file named by the ROLES_FILE environment variable, for
+// example:
+//
+//	{"support": {"endpoints": ["GET /contacts", "GET /contacts/:id", "PATCH /contacts/:id"],
+//	             "fields": {"firstname": "read", "lastname": "read", "phone": "write", "birthday": "read"},
+//	             "vip_fields": {"firstname": "read", "lastname": "read"}}}
+//
+// Without the file, there are no roles, and clients are only restricted by their scopes.
+func setupRoles() {
+	roles = nil
+	roleClaim = os.Getenv("JWT_ROLE_CLAIM")
+	file := os.Getenv("ROLES_FILE")
+	if file == "" {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &roles); err != nil {
+		log.Fatalf("invalid roles in %s: %v", file, err)
+	}
+	for name, role := range roles {
+		for _, endpoint := range role.Endpoints {
+			method, route, found := strings.Cut(endpoint, " ")
+			if endpoint != allEndpoints && (!found || method == "" || !strings.HasPrefix(route, "/")) {
+				log.Fatalf("invalid endpoint '%s' of role %s", endpoint, name)
+			}
+		}
+		for _, fields := range []map[string]string{role.Fields, role.VIPFields} {
+			for field, permission := range fields {
+				if _, found := contactFields[field]; !found || (permission != fieldRead && permission != fieldWrite) {
+					log.Fatalf("invalid permission '%s' on field '%s' of role %s", permission, field, name)
+				}
+			}
+		}
+	}
+}
+
+// validRoles tells whether all roles are defined.
+func validRoles(names []string) bool {
+	for _, name := range names {
+		if _, found := roles[name]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// authorizeRoles returns a middleware that answers requests with the FORBIDDEN status code if the
+// client has roles and none of them permits the endpoint of the request. Clients without roles may
+// call all endpoints that their scopes permit. Roles that are not defined permit nothing.
+func authorizeRoles() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		names := c.GetStringSlice(rolesKey)
+		if len(names) == 0 || c.FullPath() == "" {
+			c.Next()
+			return
+		}
+		endpoint := c.Request.Method + " " + c.FullPath()
+		for _, name := range names {
+			if role, found := roles[name]; found && (contains(role.Endpoints, allEndpoints) || contains(role.Endpoints, endpoint)) {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "endpoint not permitted for role"})
+	}
+}
+
+// fieldPermission returns the permission that the roles of the client grant on a field of the
+// contact: 'write', 'read', or an empty string if the client may not even read it. Clients
+// without roles may write all fields; clients with several roles have the strongest permission of
+// any of them.
+func fieldPermission(c *gin.Context, contact *model.Contact, field string) string {
+	names := c.GetStringSlice(rolesKey)
+	if len(names) == 0 {
+		return fieldWrite
+	}
+	permission := ""
+	for _, name := range names {
+		role, found := roles[name]
+		if !found {
+			continue
+		}
+		fields := role.Fields
+		if contact.VIP && role.VIPFields != nil {
+			fields = role.VIPFields
+		}
+		switch {
+		case fields == nil || fields[field] == fieldWrite:
+			return fieldWrite
+		case fields[field] == fieldRead:
+			permission = fieldRead
+		}
+	}
+	return permission
+}
+
+// redactContact returns a copy of the contact without the fields that the client may not read.
+// Redacted fields are left out of the JSON of the contact, as if they were not set.
+func redactContact(c *gin.Context, contact model.Contact) model.Contact {
+	redacted := contact
+	for name, field := range contactFields {
+		if fieldPermission(c, &contact, name) == "" {
+			field.redact(&redacted)
+		}
+	}
+	return redacted
+}
+
+// redactContacts removes the fields that the client may not read from all contacts of the list.
+func redactContacts(c *gin.Context, contacts []model.Contact) {
+	for i := range contacts {
+		contacts[i] = redactContact(c, contacts[i])
+	}
+}
+
+// checkFieldReads makes sure that the client may read all fields of the contact that a request
+// refers to, so that the request cannot reveal the values of hidden fields, for example by copying
+// them to other fields or by testing them. Otherwise, the request is answered with the FORBIDDEN
+// status code. It returns whether all fields may be read.
+func checkFieldReads(c *gin.Context, contact *model.Contact, fields []string) bool {
+	for _, field := range fields {
+		if fieldPermission(c, contact, field) == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "no read access to field " + field})
+			return false
+		}
+	}
+	return true
+}
+
+// checkFieldFilters makes sure that the client may read the fields that a request searches,
+// sorts or compares contacts by, on VIP contacts as well as on other contacts, since the results
+// would reveal the values of hidden fields. Fields that roles cannot restrict are always
+// permitted. Otherwise, the request is answered with the FORBIDDEN status code. It returns whether
+// all fields may be read.
+func checkFieldFilters(c *gin.Context, fields []string) bool {
+	var restricted []string
+	for _, field := range fields {
+		if _, found := contactFields[field]; found {
+			restricted = append(restricted, field)
+		}
+	}
+	for _, contact := range []*model.Contact{{}, {VIP: true}} {
+		if !checkFieldReads(c, contact, restricted) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFieldWrites compares the stored contact with its new values, or with an empty contact if
+// the contact is created, and makes sure that the client may write all fields that change. The
+// permissions are those on the stored contact, or on the new contact if it is created. Otherwise,
+// the request is answered with the FORBIDDEN status code. It returns whether all changes are
+// permitted.
+func checkFieldWrites(c *gin.Context, before *model.Contact, after *model.Contact) bool {
+	permissions := before
+	if before == nil {
+		before = &model.Contact{}
+		permissions = after
+	}
+	names := make([]string, 0, len(contactFields))
+	for name := range contactFields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		field := contactFields[name]
+		previous, next := field.value(before), field.value(after)
+		changed := (previous == nil) != (next == nil) || (previous != nil && *previous != *next)
+		if changed && fieldPermission(c, permissions, name) != fieldWrite {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "no write access to field " + name})
+			return false
+		}
+	}
+	return true
+}
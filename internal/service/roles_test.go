@@ -0,0 +1,351 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// testRoles are the roles in the tests of the role-based access control. Support staff may see
+// the names of VIP contacts, but not their other data.
+const testRoles = `{
+	"support": {
+		"endpoints": ["GET /contacts", "GET /contacts/:id", "PATCH /contacts/:id", "POST /contacts", "GET /contacts/duplicates"],
+		"fields": {"firstname": "write", "lastname": "write", "phone": "write", "birthday": "read"},
+		"vip_fields": {"firstname": "read", "lastname": "read"}
+	}
+}`
+
+// setupRolesTest writes the test roles to a file and configures the service to read them.
+func setupRolesTest(t *testing.T) {
+	t.Setenv("ROLES_FILE", writeRoles(t, testRoles))
+}
+
+// writeRoles writes the roles to a temporary file and returns its path.
+func writeRoles(t *testing.T, roles string) string {
+	path := filepath.Join(t.TempDir(), "roles.json")
+	if err := os.WriteFile(path, []byte(roles), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// expectSupportKeyLookup instructs the mock object to expect that the API key of the tests is
+// looked up, and returns it with the 'write' scope and the 'support' role.
+func expectSupportKeyLookup(mock sqlmock.Sqlmock) {
+	rows := mock.NewRows([]string{"id", "tenant_id", "name", "prefix", "key_hash", "scopes", "roles", "created_at", "last_used_at", "revoked_at"}).
+		AddRow(3, defaultTenant, "helpdesk", testAPIKey[:12], hashAPIKey(testAPIKey), "write", "support", createdAt, time.Now().UTC(), nil)
+	mock.ExpectQuery("SELECT \\* FROM api_keys WHERE key_hash = \\? AND revoked_at IS NULL").
+		WithArgs(hashAPIKey(testAPIKey)).
+		WillReturnRows(rows)
+}
+
+// expectContactWithVIP instructs the mock object to expect that a contact with all fields is
+// selected with the specified statement.
+func expectContactWithVIP(mock sqlmock.Sqlmock, query string, id int, vip bool) {
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday", "vip", "version"}).
+		AddRow(id, "Erika", "Mustermann", "+49 0815 4711", time.Date(1969, time.March, 4, 0, 0, 0, 0, time.UTC), vip, 1)
+	mock.ExpectQuery(query).
+		WithArgs(int64(id), defaultTenant).
+		WillReturnRows(rows)
+}
+
+// TestGetVIPContactAsSupport executes a GET request for a VIP contact on behalf of support staff.
+// It expects that the names are returned, but neither the phone number nor the birthday.
+func TestGetVIPContactAsSupport(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupRolesTest(t)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSupportKeyLookup(mock)
+	expectContactWithVIP(mock, "SELECT \\* FROM contacts WHERE id = \\?", 42, true)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var contact model.Contact
+	json.Unmarshal(recorder.Body.Bytes(), &contact)
+	assert.Equal(t, "Erika", *contact.FirstName)
+	assert.Equal(t, "Mustermann", *contact.LastName)
+	assert.Nil(t, contact.Phone)
+	assert.Nil(t, contact.Birthday)
+	assert.NotContains(t, recorder.Body.String(), "4711")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetAllAsSupport executes a GET request for all contacts on behalf of support staff. It
+// expects that only the data of the VIP contacts is redacted.
+func TestGetAllAsSupport(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupRolesTest(t)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSupportKeyLookup(mock)
+	rows := mock.NewRows([]string{"id", "firstname", "phone", "vip"}).
+		AddRow(7, "Aaron", "0815", false).
+		AddRow(8, "Erika", "4711", true)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL").
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var contacts []model.Contact
+	json.Unmarshal(recorder.Body.Bytes(), &contacts)
+	assert.Equal(t, 2, len(contacts))
+	assert.Equal(t, "0815", *contacts[0].Phone)
+	assert.Nil(t, contacts[1].Phone)
+	assert.Equal(t, "Erika", *contacts[1].FirstName)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestFilterByHiddenFieldAsSupport executes GET requests that search, sort or compare contacts by
+// fields that support staff may not read on VIP contacts. It expects that the HTTP requests are
+// answered with the FORBIDDEN status code before any contact is selected.
+func TestFilterByHiddenFieldAsSupport(t *testing.T) {
+	urls := []string{
+		"/contacts?birthday=03-04",
+		"/contacts?orderby=phone",
+		"/contacts?orderby=birthday&ascending=false",
+		"/contacts/duplicates",
+	}
+	for _, url := range urls {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+		setupRolesTest(t)
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock)
+		expectSupportKeyLookup(mock)
+
+		// Run test and compare results
+		recorder := runTestWithHeaders(db, "GET", url, nil, map[string]string{apiKeyHeader: testAPIKey})
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "url: "+url)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+// TestFilterByVisibleFieldAsSupport executes a GET request that searches and sorts contacts by the
+// last name, which support staff may read on all contacts. It expects that the contacts are
+// selected.
+func TestFilterByVisibleFieldAsSupport(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupRolesTest(t)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSupportKeyLookup(mock)
+	rows := mock.NewRows([]string{"id", "lastname", "vip"}).
+		AddRow(8, "Mustermann", true)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL .* AND lastname LIKE \\? ORDER BY lastname ASC").
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts?lastname=Must&orderby=lastname", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestEndpointNotPermittedForRole executes a DELETE request on behalf of support staff, whose role
+// does not permit deleting contacts. It expects that the HTTP request is answered with the
+// FORBIDDEN status code before any contact is selected.
+func TestEndpointNotPermittedForRole(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupRolesTest(t)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSupportKeyLookup(mock)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "DELETE", "/contacts/42", nil, map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPatchReadOnlyFieldAsSupport executes a PATCH request that changes the birthday of a contact
+// on behalf of support staff, who may only read it. It expects that nothing is changed, and that
+// the HTTP request is answered with the FORBIDDEN status code.
+func TestPatchReadOnlyFieldAsSupport(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupRolesTest(t)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSupportKeyLookup(mock)
+	expectContactWithVIP(mock, "SELECT \\* FROM contacts WHERE id = \\?", 42, false)
+	mock.ExpectBegin()
+	expectContactWithVIP(mock, "SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE", 42, false)
+	mock.ExpectRollback()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PATCH", "/contacts/42", strings.NewReader(`{"birthday": "1970-01-01T00:00:00Z"}`),
+		map[string]string{"Content-Type": mergePatchContentType, apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "birthday")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPatchHiddenFieldAsSupport executes JSON Patch requests on a VIP contact on behalf of support
+// staff, who may not read its phone number. The patches test the phone number, or copy it to a
+// field. It expects that the patches are not applied, and that the HTTP requests are answered with
+// the FORBIDDEN status code without revealing whether the test would have passed.
+func TestPatchHiddenFieldAsSupport(t *testing.T) {
+	patches := []string{
+		`[{"op": "test", "path": "/phone", "value": "+49 0815 4711"}]`,
+		`[{"op": "copy", "from": "/phone", "path": "/lastname"}]`,
+		`[{"op": "move", "from": "/phone", "path": "/firstname"}]`,
+	}
+	for _, body := range patches {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+		setupRolesTest(t)
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock)
+		expectSupportKeyLookup(mock)
+		expectContactWithVIP(mock, "SELECT \\* FROM contacts WHERE id = \\?", 42, true)
+
+		// Run test and compare results
+		recorder := runTestWithHeaders(db, "PATCH", "/contacts/42", strings.NewReader(body),
+			map[string]string{"Content-Type": jsonPatchContentType, apiKeyHeader: testAPIKey})
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "patch: "+body)
+		assert.Contains(t, recorder.Body.String(), "phone", "patch: "+body)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+// TestPatchWritableFieldAsSupport executes a PATCH request that changes the phone number of a
+// contact on behalf of support staff, who may write it. It expects that the contact is updated.
+func TestPatchWritableFieldAsSupport(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupRolesTest(t)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSupportKeyLookup(mock)
+	expectContactWithVIP(mock, "SELECT \\* FROM contacts WHERE id = \\?", 42, false)
+	mock.ExpectBegin()
+	expectContactWithVIP(mock, "SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE", 42, false)
+	mock.ExpectExec("UPDATE contacts").
+		WithArgs("Erika", "Mustermann", "110", sqlmock.AnyArg(), false, int64(42), defaultTenant, int64(1), int64(1)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+	expectContactWithVIP(mock, "SELECT \\* FROM contacts WHERE id = \\?", 42, false)
+	mock.ExpectExec("INSERT INTO audit_log").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectOutbox(mock, 42, "updated")
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PATCH", "/contacts/42", strings.NewReader(`{"phone": "110"}`),
+		map[string]string{"Content-Type": mergePatchContentType, apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPostVIPAsSupport executes a POST request for a VIP contact on behalf of support staff, who
+// may not mark contacts as VIP. It expects that the HTTP request is answered with the FORBIDDEN
+// status code before the contact is inserted.
+func TestPostVIPAsSupport(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupRolesTest(t)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSupportKeyLookup(mock)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "POST", "/contacts", strings.NewReader(`{"vip": true}`),
+		map[string]string{apiKeyHeader: testAPIKey})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "vip")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestCreateAPIKeyUnknownRole executes a POST request for an API key with a role that is not
+// defined. It expects that the HTTP request is answered with the BAD REQUEST status code.
+func TestCreateAPIKeyUnknownRole(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupRolesTest(t)
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+	expectAdminKeyLookup(mock)
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "POST", "/api-keys", strings.NewReader(`{"name": "helpdesk", "scopes": ["write"], "roles": ["janitor"]}`))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestMergeHiddenFieldAsSupport executes merge requests on behalf of support staff that would take
+// the phone number of a VIP loser, which they may not read, into a contact that is not a VIP. It
+// expects that the contacts are not merged, and that the HTTP requests are answered with the
+// FORBIDDEN status code.
+func TestMergeHiddenFieldAsSupport(t *testing.T) {
+	bodies := []string{
+		`{"survivor": 12, "losers": [15], "rules": {"phone": 15}}`,
+		`{"survivor": 12, "losers": [15], "rules": {"phone": "first_non_null"}}`,
+		`{"survivor": 12, "losers": [15], "rules": {"phone": "longest"}}`,
+	}
+	for _, body := range bodies {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+		t.Setenv("ROLES_FILE", writeRoles(t, strings.Replace(testRoles, `"endpoints": [`, `"endpoints": ["POST /contacts/merge", `, 1)))
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock)
+		expectSupportKeyLookup(mock)
+		mock.ExpectBegin()
+		expectContactWithVIP(mock, "SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE", 12, false)
+		expectContactWithVIP(mock, "SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE", 15, true)
+		mock.ExpectRollback()
+
+		// Run test and compare results
+		recorder := runTestWithHeaders(db, "POST", "/contacts/merge", strings.NewReader(body),
+			map[string]string{apiKeyHeader: testAPIKey})
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "merge: "+body)
+		assert.Contains(t, recorder.Body.String(), "no read access to field phone", "merge: "+body)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -8,44 +9,91 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/metrics"
 	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
 )
 
-// maxInt is the largest possible int value
-const maxInt = int(^uint(0) >> 1)
-
 // db is a handle to the database.
 var db *sqlx.DB
 
-// insert is a prepared statement for creating a contact on the database.
+// insert is a prepared statement for creating a contact of a tenant on the database.
 var insert *sqlx.NamedStmt
 
-// selectWhereId is a prepared statement for selecting contacts with a given id.
+// selectWhereId is a prepared statement for selecting contacts of a tenant with a given id.
+// Contacts in the trash are not selected.
 var selectWhereId *sqlx.Stmt
 
-// deleteWhereId is a prepared statement for deleting a contact with a given id.
+// deleteWhereId is a prepared statement for moving a contact of a tenant with a given id to the
+// trash. If a version other than anyVersion is given, the contact is only deleted if it still has
+// this version.
 var deleteWhereId *sqlx.Stmt
 
+// updateWhereId is a prepared statement for replacing all values of a contact of a tenant with a
+// given id. If a version other than anyVersion is given, the contact is only updated if it still
+// has this version. The version is incremented with every update. Contacts in the trash are not
+// updated.
+var updateWhereId *sqlx.NamedStmt
+
+// restoreWhereId is a prepared statement for restoring a contact of a tenant with a given id from
+// the trash.
+var restoreWhereId *sqlx.Stmt
+
+// purgeDeletedBefore is a prepared statement for permanently removing all contacts that were
+// moved to the trash before a given point in time.
+var purgeDeletedBefore *sqlx.Stmt
+
+// selectWhereIdForUpdate is a prepared statement for selecting a contact of a tenant with a given
+// id and locking it until the end of the transaction. Contacts in the trash are not selected.
+var selectWhereIdForUpdate *sqlx.Stmt
+
+// insertAudit is a prepared statement for writing an entry to the audit log.
+var insertAudit *sqlx.NamedStmt
+
+// insertOutbox is a prepared statement for writing an event to the outbox.
+var insertOutbox *sqlx.NamedStmt
+
+// selectAuditAsOf is a prepared statement for selecting the last audit log entry of a contact of
+// a tenant that was written at or before a given point in time.
+var selectAuditAsOf *sqlx.Stmt
+
+// selectAuditWhereVersion is a prepared statement for selecting the audit log entry of a contact
+// of a tenant that led to a given version of the contact.
+var selectAuditWhereVersion *sqlx.Stmt
+
 // allowedOrderby are the allowed values for the 'orderby' URL parameter.
-var allowedOrderby = []string{"id", "firstname", "lastname", "phone", "birthday"}
+var allowedOrderby = []string{"id", "firstname", "lastname", "phone", "birthday", "created_at", "updated_at"}
+
+// epoch is used for the 'updated_since' URL parameter if it is not specified. All contacts have
+// been updated after this point in time.
+var epoch = time.Unix(0, 0).UTC()
 
 // allowedAscending are the allowed values for the 'ascending' URL parameter.
 var allowedAscending = []string{"true", "false"}
 
 // CreateDatabase initializes and returns a database connection. The connection parameters are
 // taken from the system's environment variables.
+//
+// The clientFoundRows option makes MySQL report the matched rows instead of the changed rows for
+// UPDATE statements. Otherwise, replacing a contact with identical values would look as if the
+// contact did not exist. The time_zone option makes the database session use UTC, like the driver
+// does, so that timestamps written by the database can be compared with timestamps of the service.
 func CreateDatabase() *sql.DB {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s)/test?parseTime=true",
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/test?parseTime=true&clientFoundRows=true&time_zone=%%27%%2B00%%3A00%%27",
 		os.Getenv("DBUSER"), os.Getenv("DBPWD"), os.Getenv("DBHOST"))
-	sqlDB, err := sql.Open("mysql", dsn)
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	connector, err := mysql.NewConnector(config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return sqlDB
+	return sql.OpenDB(metrics.InstrumentConnector(connector, observeQuery))
 }
 
 // SetupDatabaseWrapper initializes the sqlx database wrapper with the specified sql database. It
@@ -57,28 +105,160 @@ func SetupDatabaseWrapper(sqlDB *sql.DB) {
 
 	// Prepared statements offer a significant speed increase if executed many times.
 	insert, err = db.PrepareNamed(`
-		INSERT INTO contacts (firstname, lastname, phone, birthday)
-		VALUES (:firstname, :lastname, :phone, :birthday)
+		INSERT INTO contacts (tenant_id, owner, firstname, lastname, phone, birthday, vip)
+		VALUES (:tenant_id, :owner, :firstname, :lastname, :phone, :birthday, :vip)
 	`)
 	if err != nil {
 		log.Fatal(err)
 	}
 	selectWhereId, err = db.Preparex(`
-		SELECT * FROM contacts WHERE id = ?
+		SELECT * FROM contacts WHERE id = ? AND tenant_id = ? AND deleted_at IS NULL
 	`)
 	if err != nil {
 		log.Fatal(err)
 	}
 	deleteWhereId, err = db.Preparex(`
-		DELETE FROM contacts WHERE id = ?
+		UPDATE contacts
+		SET deleted_at = NOW(6), version = version + 1
+		WHERE id = ? AND tenant_id = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	updateWhereId, err = db.PrepareNamed(`
+		UPDATE contacts
+		SET firstname = :firstname, lastname = :lastname, phone = :phone, birthday = :birthday, vip = :vip,
+			version = version + 1
+		WHERE id = :id AND tenant_id = :tenant_id AND deleted_at IS NULL AND (:version = 0 OR version = :version)
 	`)
 	if err != nil {
 		log.Fatal(err)
 	}
+	restoreWhereId, err = db.Preparex(`
+		UPDATE contacts
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = ? AND tenant_id = ? AND deleted_at IS NOT NULL
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	purgeDeletedBefore, err = db.Preparex(`
+		DELETE FROM contacts WHERE deleted_at < ?
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectWhereIdForUpdate, err = db.Preparex(`
+		SELECT * FROM contacts WHERE id = ? AND tenant_id = ? AND deleted_at IS NULL FOR UPDATE
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	insertAudit, err = db.PrepareNamed(`
+		INSERT INTO audit_log (tenant_id, contact_id, action, version, before_value, after_value, merged_ids, actor, request_id)
+		VALUES (:tenant_id, :contact_id, :action, :version, :before_value, :after_value, :merged_ids, :actor, :request_id)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	insertOutbox, err = db.PrepareNamed(`
+		INSERT INTO outbox (idempotency_key, tenant_id, owner, event_type, contact_id, payload)
+		VALUES (:idempotency_key, :tenant_id, :owner, :event_type, :contact_id, :payload)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectAuditAsOf, err = db.Preparex(`
+		SELECT * FROM audit_log WHERE contact_id = ? AND tenant_id = ? AND created_at <= ? ORDER BY id DESC LIMIT 1
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectAuditWhereVersion, err = db.Preparex(`
+		SELECT * FROM audit_log WHERE contact_id = ? AND tenant_id = ? AND version = ? ORDER BY id DESC LIMIT 1
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statementsPrepared.Store(true)
+}
+
+// withTransaction runs the function within a database transaction. The transaction is committed
+// if the function returns true, and rolled back if it returns false or panics. It returns whether
+// the transaction was committed. The outbox dispatcher is woken up after the commit, so that the
+// events written within the transaction are published without delay.
+func withTransaction(ctx context.Context, fn func(tx *sqlx.Tx) bool) bool {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		log.Panicln(err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	if !fn(tx) {
+		return false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Panicln(err)
+	}
+	committed = true
+	signalOutbox()
+	return true
 }
 
 // SetupHttpRouter initializes the REST API router and registers all endpoints.
+//
+// If the environment variable REQUIRE_IF_MATCH is set to 'true', requests that change a contact
+// must specify the expected version of the contact in an If-Match header.
+//
+// If the environment variable REQUIRE_AUTH is set to 'true', all requests must carry an API key
+// in the X-API-Key header or a bearer token; see setupTokenVerification. Every endpoint requires a
+// scope: reading contacts requires 'read', changing contacts requires 'write', and managing
+// webhooks and API keys requires 'admin'. Clients with roles are further restricted to the
+// endpoints and the fields of contacts that their roles permit; see setupRoles. The first API
+// keys are created with the bootstrap key; see setupBootstrapKey.
+//
+// The requests of every client to the reading, writing and admin endpoints can be rate limited
+// separately, and so can all requests of an IP address before the client is authenticated; see
+// setupRateLimits.
+//
+// Every request is cancelled after the time in the environment variable REQUEST_TIMEOUT, together
+// with its database queries, and so is a request whose client goes away; see limitRequestTime.
+//
+// Orchestrators can probe whether the process is alive at /healthz, and whether it accepts requests
+// at /readyz, without credentials. The service is not ready when its database is not available,
+// and once it starts to shut down; see checkReadiness and Drain.
+//
+// Metrics of the requests, the database and the contacts are exposed at /metrics in the text
+// format of Prometheus, to clients with the 'admin' scope, or without credentials if the
+// environment variable PUBLIC_METRICS is set to 'true'; see instrumentRequests and exposeMetrics.
+//
+// Every request is executed for a tenant, which is taken from the API key or bearer token of the
+// client, or from the X-Tenant-ID header if TRUST_TENANT_HEADER is set; see resolveTenant.
+// Contacts, their history, webhooks and API keys of other tenants are invisible to the client.
+// Within a tenant, users only have access to the contacts they own, the contacts without owner and
+// the contacts that were shared with them; see accessTo.
+//
+// The environment variable DUPLICATE_THRESHOLD sets the minimum score between 0 and 1 for two
+// contacts to be considered duplicates. DUPLICATE_CHECK controls what happens if a new contact is
+// a probable duplicate: 'off' skips the check, 'warn' adds a Warning header to the response, and
+// 'strict' rejects the contact.
 func SetupHttpRouter() *gin.Engine {
+	requireIfMatch = strings.EqualFold(os.Getenv("REQUIRE_IF_MATCH"), "true")
+	requireAuth = strings.EqualFold(os.Getenv("REQUIRE_AUTH"), "true")
+	publicMetrics := strings.EqualFold(os.Getenv("PUBLIC_METRICS"), "true")
+	setupTokenVerification()
+	setupBootstrapKey()
+	setupDuplicateCheck()
+	setupIdempotency()
+	setupTenants()
+	setupRoles()
+	setupRateLimits()
+	setupLimits()
+	setupDraining()
 	var router *gin.Engine
 	if strings.EqualFold(os.Getenv("GIN_LOGGING"), "off") {
 		fmt.Println("Turning off HTTP request logging.")
@@ -86,15 +266,57 @@ func SetupHttpRouter() *gin.Engine {
 	} else {
 		router = gin.Default()
 	}
-	router.GET("/contacts", findContacts)
-	router.POST("/contacts", createContact)
-	router.GET("/contacts/:id", findContactByID)
-	router.PUT("/contacts/:id", updateContactByID)
-	router.DELETE("/contacts/:id", deleteContactByID)
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("could not parse TRUSTED_PROXIES env variable: %v", err)
+	}
+	// the probes are registered before the middleware, so that they need no credentials and are not limited
+	router.GET("/healthz", checkLiveness)
+	router.GET("/readyz", checkReadiness())
+	if publicMetrics {
+		router.GET("/metrics", exposeMetrics)
+	}
+	router.Use(instrumentRequests(), requestID(), limitRequestTime(), limitBodySize(), rateLimitAddresses(), authenticate(), resolveTenant(), authorizeRoles())
+
+	reading := router.Group("", requireScope(scopeRead), rateLimit(rateLimitRead))
+	reading.GET("/contacts", findContacts)
+	reading.GET("/contacts/trash", findDeletedContacts)
+	reading.GET("/contacts/duplicates", findDuplicateContacts)
+	reading.GET("/contacts/changes", findContactChanges)
+	reading.GET("/contacts/events", streamContactEvents)
+	reading.GET("/contacts/:id/history", findContactHistory)
+	reading.GET("/contacts/:id/shares", findContactShares)
+	reading.GET("/contacts/:id", findContactByID)
+
+	writing := router.Group("", requireScope(scopeWrite), rateLimit(rateLimitWrite))
+	writing.POST("/contacts", createContact)
+	writing.POST("/contacts/merge", mergeContacts)
+	writing.POST("/contacts/:id/restore", restoreContactByID)
+	writing.POST("/contacts/:id/revert", revertContactByID)
+	writing.PUT("/contacts/:id", updateContactByID)
+	writing.PATCH("/contacts/:id", patchContactByID)
+	writing.DELETE("/contacts/:id", deleteContactByID)
+	writing.PUT("/contacts/:id/shares/:grantee", shareContact)
+	writing.DELETE("/contacts/:id/shares/:grantee", unshareContact)
+
+	admin := router.Group("", requireScope(scopeAdmin), rateLimit(rateLimitAdmin))
+	admin.GET("/webhooks", findWebhooks)
+	admin.POST("/webhooks", createWebhook)
+	admin.GET("/webhooks/:id", findWebhookByID)
+	admin.DELETE("/webhooks/:id", deleteWebhookByID)
+	admin.GET("/webhooks/:id/deliveries", findWebhookDeliveries)
+	admin.GET("/api-keys", findAPIKeys)
+	admin.POST("/api-keys", createAPIKey)
+	admin.GET("/api-keys/:id", findAPIKeyByID)
+	admin.DELETE("/api-keys/:id", revokeAPIKey)
+	admin.POST("/api-keys/:id/rotate", rotateAPIKey)
+	if !publicMetrics {
+		admin.GET("/metrics", exposeMetrics)
+	}
 	return router
 }
 
-// findContacts responds with a list of contacts as JSON.
+// findContacts responds with a list of the tenant's contacts that the user may see as JSON.
+// Contacts in the trash are not included.
 //
 // The URL parameters 'firstname' and 'lastname' are interpreted as the beginning of the first name
 // or last name of the contact.
@@ -105,15 +327,27 @@ func SetupHttpRouter() *gin.Engine {
 // The URL parameter 'limit' specifies how many contacts matching the search criteria are returned.
 // The URL parameter 'offset' specifies how many items from the sorted list of results are skipped
 // in the beginning. Together with the 'limit' parameter, one can implement search result paging.
+// Both are capped by the MAX_PAGE_SIZE and MAX_OFFSET env variables; without a limit, a full page
+// is returned.
 //
 // The URL parameter 'orderby' specifies the contact property by which the results shall be sorted.
-// Valid values are 'id', 'firstname', 'lastname', 'phone', and 'birthday'. If this URL parameter
-// is not specified, the contacts will be sorted by id.
+// Valid values are 'id', 'firstname', 'lastname', 'phone', 'birthday', 'created_at', and
+// 'updated_at'. If this URL parameter is not specified, the contacts will be sorted by id.
 //
 // If the URL parameter 'ascending' is set to 'false' then the sort order is reversed, starting
 // with the 'highest' value. If it is set to 'true', or if this URL parameter is omitted, the
 // result starts with the lowest value.
 //
+// Searching or sorting by a field that the roles of the client hide on some contacts is answered
+// with the FORBIDDEN status code, since the results would reveal its values.
+//
+// The URL parameter 'updated_since' is a point in time in RFC 3339 format. Only contacts that were
+// created or changed at or after that time are returned. Clients can use the highest 'updated_at'
+// value of the previous response to fetch changes incrementally.
+//
+// The response carries a weak ETag derived from the result. If the request's If-None-Match header
+// contains this ETag, the call responds with the NOT MODIFIED status code and no body.
+//
 // REST API calls:
 //
 //	> curl "http://localhost:8080/contacts"
@@ -122,6 +356,7 @@ func SetupHttpRouter() *gin.Engine {
 //	> curl "http://localhost:8080/contacts?birthday=11-29"
 //	> curl "http://localhost:8080/contacts?limit=20&offset=60"
 //	> curl "http://localhost:8080/contacts?orderby=birthday&ascending=false"
+//	> curl "http://localhost:8080/contacts?updated_since=2023-05-01T12:00:00Z&orderby=updated_at"
 func findContacts(c *gin.Context) {
 	first, last, bday, bmonth, successNameAndBirthday := parseNameAndBirthday(c)
 	if !successNameAndBirthday {
@@ -135,64 +370,113 @@ func findContacts(c *gin.Context) {
 	if !successOrderbyAndAscending {
 		return
 	}
+	updatedSince, successUpdatedSince := parseUpdatedSince(c)
+	if !successUpdatedSince {
+		return
+	}
+	filters := []string{orderby}
+	if first != "" {
+		filters = append(filters, "firstname")
+	}
+	if last != "" {
+		filters = append(filters, "lastname")
+	}
+	if bmonth != 0 || bday != 0 {
+		filters = append(filters, "birthday")
+	}
+	if !checkFieldFilters(c, filters) {
+		return
+	}
+	ctx := c.Request.Context()
 	var contacts []model.Contact
 	var err error
+	args := append([]interface{}{tenant(c)}, visibilityArgs(c)...)
 	if (first != "" || last != "") && (bmonth != 0 || bday != 0) {
 		sql := fmt.Sprintf(`
 			SELECT *
 			FROM contacts
-			WHERE firstname LIKE ?
+			WHERE tenant_id = ?
+				AND deleted_at IS NULL
+				AND `+visibleContacts+`
+				AND updated_at >= ?
+				AND firstname LIKE ?
 				AND lastname LIKE ?
 				AND MONTH(birthday) = ?
 				AND DAY(birthday) = ?
 			ORDER BY %s %s
 			LIMIT ?
 			OFFSET ?`, orderby, ascending)
-		err = db.Select(&contacts, sql, first+"%", last+"%", bmonth, bday, limit, offset)
+		err = db.SelectContext(ctx, &contacts, sql, append(args, updatedSince, first+"%", last+"%", bmonth, bday, limit, offset)...)
 	} else if (first != "" || last != "") && bmonth == 0 && bday == 0 {
 		sql := fmt.Sprintf(`
 			SELECT *
 			FROM contacts
-			WHERE firstname LIKE ?
+			WHERE tenant_id = ?
+				AND deleted_at IS NULL
+				AND `+visibleContacts+`
+				AND updated_at >= ?
+				AND firstname LIKE ?
 				AND lastname LIKE ?
 			ORDER BY %s %s
 			LIMIT ?
 			OFFSET ?`, orderby, ascending)
-		err = db.Select(&contacts, sql, first+"%", last+"%", limit, offset)
+		err = db.SelectContext(ctx, &contacts, sql, append(args, updatedSince, first+"%", last+"%", limit, offset)...)
 	} else if first == "" && last == "" && (bmonth != 0 || bday != 0) {
 		sql := fmt.Sprintf(`
 			SELECT *
 			FROM contacts
-			WHERE MONTH(birthday) = ?
+			WHERE tenant_id = ?
+				AND deleted_at IS NULL
+				AND `+visibleContacts+`
+				AND updated_at >= ?
+				AND MONTH(birthday) = ?
 				AND DAY(birthday) = ?
 			ORDER BY %s %s
 			LIMIT ?
 			OFFSET ?`, orderby, ascending)
-		err = db.Select(&contacts, sql, bmonth, bday, limit, offset)
+		err = db.SelectContext(ctx, &contacts, sql, append(args, updatedSince, bmonth, bday, limit, offset)...)
 	} else {
 		sql := fmt.Sprintf(`
 			SELECT *
 			FROM contacts
+			WHERE tenant_id = ?
+				AND deleted_at IS NULL
+				AND `+visibleContacts+`
+				AND updated_at >= ?
 			ORDER BY %s %s
 			LIMIT ?
 			OFFSET ?`, orderby, ascending)
-		err = db.Select(&contacts, sql, limit, offset)
+		err = db.SelectContext(ctx, &contacts, sql, append(args, updatedSince, limit, offset)...)
 	}
 	if err != nil {
 		log.Panicln(err)
 	}
 	if len(contacts) == 0 {
 		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
-	} else {
-		c.IndentedJSON(http.StatusOK, contacts)
+		return
 	}
+	redactContacts(c, contacts)
+	etag := listETag(contacts)
+	c.Header("ETag", etag)
+	if matchesIfNoneMatch(c, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, contacts)
 }
 
 // parseNameAndBirthday inspects the URL parameters and determines values for first name, last
-// name, day and month of the contact's birthday.
+// name, day and month of the contact's birthday. Wildcards in the names are escaped, so that
+// clients cannot make the database scan all names for a substring.
 func parseNameAndBirthday(c *gin.Context) (firstname string, lastname string, bday int, bmonth int, success bool) {
 	firstname = c.Query("firstname")
 	lastname = c.Query("lastname")
+	if len(firstname) > maxSearchLength || len(lastname) > maxSearchLength {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid name URL parameter"})
+		return "", "", 0, 0, false
+	}
+	firstname = escapeLike(firstname)
+	lastname = escapeLike(lastname)
 	birthday := c.Query("birthday")
 	if birthday != "" {
 		var err error
@@ -216,7 +500,8 @@ func parseNameAndBirthday(c *gin.Context) (firstname string, lastname string, bd
 }
 
 // parseLimitAndOffset inspects the URL parameters and determines values for limit and offset of
-// the result set.
+// the result set. The limit defaults to the maximum page size, and neither the limit nor the
+// offset may exceed their maximum.
 func parseLimitAndOffset(c *gin.Context) (limit string, offset string, success bool) {
 	limit = c.Query("limit")
 	offset = c.Query("offset")
@@ -226,8 +511,12 @@ func parseLimitAndOffset(c *gin.Context) (limit string, offset string, success b
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid limit parameter"})
 			return "", "", false
 		}
+		if limitAsInt > maxPageSize {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("limit parameter exceeds maximum of %d", maxPageSize)})
+			return "", "", false
+		}
 	} else {
-		limit = strconv.Itoa(maxInt)
+		limit = strconv.Itoa(maxPageSize)
 	}
 	if offset != "" {
 		offsetAsIt, errConv := strconv.Atoi(offset)
@@ -235,6 +524,10 @@ func parseLimitAndOffset(c *gin.Context) (limit string, offset string, success b
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid offset parameter"})
 			return "", "", false
 		}
+		if offsetAsIt > maxOffset {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("offset parameter exceeds maximum of %d", maxOffset)})
+			return "", "", false
+		}
 	} else {
 		offset = "0"
 	}
@@ -268,6 +561,21 @@ func parseOrderbyAndAscending(c *gin.Context) (orderby string, ascending string,
 	return orderby, ascending, true
 }
 
+// parseUpdatedSince inspects the 'updated_since' URL parameter and determines the point in time
+// at or after which the contacts must have been updated.
+func parseUpdatedSince(c *gin.Context) (updatedSince time.Time, success bool) {
+	value := c.Query("updated_since")
+	if value == "" {
+		return epoch, true
+	}
+	updatedSince, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid updated_since parameter"})
+		return updatedSince, false
+	}
+	return updatedSince.UTC(), true
+}
+
 // contains returns true if a string is present in a slice.
 func contains(slice []string, str string) bool {
 	for _, v := range slice {
@@ -278,8 +586,29 @@ func contains(slice []string, str string) bool {
 	return false
 }
 
-// createContact inserts the contact specified in the request's JSON into the database. It responds
-// with the full contact data including the newly assigned id.
+// parseID inspects the id parameter of the request URL. If it is not a number, the request is
+// answered with the NOT FOUND status code.
+func parseID(c *gin.Context) (id int64, success bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "invalid id parameter"})
+		return 0, false
+	}
+	return id, true
+}
+
+// createContact inserts the contact specified in the request's JSON into the database and records
+// the creation in the audit log. It responds with the full contact data including the newly
+// assigned id. The authenticated user becomes the owner of the contact; contacts created without
+// authentication are shared by all users of the tenant. Before the contact is inserted, it is
+// compared with the existing contacts; see checkDuplicates. The roles of the client must permit
+// writing all fields that are set; see checkFieldWrites.
+//
+// If the request carries an Idempotency-Key header, the response is stored with the key. A repeated
+// request with the same key and body is answered with the stored response instead of creating
+// another contact, as long as the key has not expired; the response carries the header
+// 'Idempotent-Replayed: true'. If the key was used for a different body, the request is answered
+// with the UNPROCESSABLE ENTITY status code.
 //
 // Limitations:
 // - If firstname, lastname or phone are not specified then an empty string is stored.
@@ -288,63 +617,116 @@ func contains(slice []string, str string) bool {
 // Example REST API call:
 //
 //	> curl http://localhost:8080/contacts --request "POST" --include --header "Content-Type: application/json" --data '{"firstname": "Hans", "lastname": "Wurst", "phone": "0815", "birthday": "1969-03-02T00:00:00+00:00"}'
+//	> curl http://localhost:8080/contacts --request "POST" --include --header "Idempotency-Key: 4f1c2d7e-8b3a-4e5f-9c6d-0a1b2c3d4e5f" --data '{"firstname": "Hans"}'
 func createContact(c *gin.Context) {
+	key, success := parseIdempotencyKey(c)
+	if !success {
+		return
+	}
 	var newContact model.Contact
 	if err := c.BindJSON(&newContact); err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid JSON"})
 		return
 	}
-	result, err := insert.Exec(&newContact)
-	if err != nil {
-		log.Panicln(err)
+	newContact.TenantId = tenant(c)
+	newContact.Owner = nil
+	if owner := user(c); owner != "" {
+		newContact.Owner = &owner
 	}
-	id, err := result.LastInsertId()
-	if err != nil {
-		log.Panicln(err)
+	if !checkFieldWrites(c, nil, &newContact) {
+		return
 	}
-	newContact.Id = id
-	c.IndentedJSON(http.StatusCreated, newContact)
+	requestHash := hashRequest(newContact)
+	if key != "" && replayIdempotentResponse(c, key, requestHash) {
+		return
+	}
+	if !checkDuplicates(c, newContact) {
+		return
+	}
+	ctx := c.Request.Context()
+	committed := withTransaction(ctx, func(tx *sqlx.Tx) bool {
+		result, err := tx.NamedStmt(insert).ExecContext(ctx, &newContact)
+		if err != nil {
+			log.Panicln(err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			log.Panicln(err)
+		}
+		newContact = *findContact(ctx, tx.Stmtx(selectWhereId), id, tenant(c))
+		recordAudit(tx, c, actionCreate, nil, &newContact)
+		return key == "" ||
+			storeIdempotentResponse(ctx, tx, tenant(c), key, requestHash, http.StatusCreated, contactETag(newContact),
+				redactContact(c, newContact))
+	})
+	if !committed {
+		// a concurrent request with the same idempotency key created the contact first
+		if !replayIdempotentResponse(c, key, requestHash) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "request with the same idempotency key is in progress"})
+		}
+		return
+	}
+	c.Header("ETag", contactETag(newContact))
+	c.IndentedJSON(http.StatusCreated, redactContact(c, newContact))
 }
 
-// findContactByID locates the contact whose ID value matches the id parameter of the request URL,
-// then returns that contact as a response.
+// findContactByID locates the contact of the tenant whose ID value matches the id parameter of the
+// request URL, then returns that contact as a response. The version of the contact is returned as
+// ETag. If the request's If-None-Match header contains this ETag, the call responds with the NOT
+// MODIFIED status code and no body.
+//
+// If the URL parameter 'as_of' is specified, the contact is returned as it was at that point in
+// time. See findContactAsOf.
 //
 // Example REST API call:
 //
 //	> curl http://localhost:8080/contacts/56
 func findContactByID(c *gin.Context) {
-	id := c.Param("id")
-	_, errConv := strconv.Atoi(id)
-	if errConv != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "invalid id parameter"})
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	if c.Query("as_of") != "" {
+		findContactAsOf(c, id)
 		return
 	}
 
 	var contacts []model.Contact
-	err := selectWhereId.Select(&contacts, id)
+	err := selectWhereId.SelectContext(c.Request.Context(), &contacts, id, tenant(c))
 	if err != nil {
 		log.Panicln(err)
 	}
-	if len(contacts) == 0 {
+	if len(contacts) == 0 || accessTo(c, &contacts[0]) == accessNone {
 		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
-	} else {
-		c.IndentedJSON(http.StatusOK, contacts[0])
+		return
 	}
+	etag := contactETag(contacts[0])
+	c.Header("ETag", etag)
+	if matchesIfNoneMatch(c, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, redactContact(c, contacts[0]))
 }
 
-// updateContactByID updates the contact whose ID value matches the id parameter of the request
-// URL, updates the values specified in the JSON (and only those), and finally responds with the
-// new version of the contact.
+// updateContactByID replaces the contact whose ID value matches the id parameter of the request
+// URL with the contact specified in the JSON, and finally responds with the new version of the
+// contact. Values that are not specified in the JSON are cleared. Use PATCH for partial updates.
 //
-// Example REST API calls:
+// If the request carries an If-Match header with the ETag of the contact, the contact is only
+// replaced if it has not been changed in the meantime. Otherwise the call responds with the
+// PRECONDITION FAILED status code.
 //
-//	> curl http://localhost:8080/contacts/56 --request "PUT" --include --header "Content-Type: application/json" --data '{"phone": "81970"}'
-//	> curl http://localhost:8080/contacts/56 --request "PUT" --include --header "Content-Type: application/json" --data '{"birthday": "1972-06-06T00:00:00+00:00"}'
+// Example REST API call:
+//
+//	> curl http://localhost:8080/contacts/56 --request "PUT" --include --header "Content-Type: application/json" --data '{"firstname": "Rudi", "lastname": "Völler", "phone": "81970", "birthday": "1960-04-13T00:00:00+00:00"}'
 func updateContactByID(c *gin.Context) {
-	id := c.Param("id")
-	_, errConv := strconv.Atoi(id)
-	if errConv != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "invalid id parameter"})
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	version, success := parseIfMatch(c)
+	if !success {
 		return
 	}
 
@@ -353,83 +735,189 @@ func updateContactByID(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid JSON"})
 		return
 	}
+	submitted.Id = id
+	submitted.TenantId = tenant(c)
+	submitted.Version = version
+	replaceContact(c, submitted, actionUpdate)
+}
 
-	var args []interface{}
-	sql := "UPDATE contacts SET "
-	if submitted.FirstName != nil {
-		args = append(args, submitted.FirstName)
-		sql += "firstname=?, "
-	}
-	if submitted.LastName != nil {
-		args = append(args, submitted.LastName)
-		sql += "lastname=?, "
-	}
-	if submitted.Phone != nil {
-		args = append(args, submitted.Phone)
-		sql += "phone=?, "
+// patchContactByID changes the contact whose ID value matches the id parameter of the request URL
+// as described by the patch document in the request body, and finally responds with the new
+// version of the contact.
+//
+// Two patch formats are supported, selected by the Content-Type header:
+//   - application/merge-patch+json (RFC 7396): the given properties are replaced, a null value
+//     clears the property.
+//   - application/json-patch+json (RFC 6902): a list of add, remove, replace, move, copy and test
+//     operations on the paths '/firstname', '/lastname', '/phone', '/birthday' and '/vip'.
+//
+// The patch document is validated before the database is accessed. A patch that is valid but
+// cannot be applied to the current state of the contact, for example because a test operation
+// fails, is answered with the CONFLICT status code. Like for PUT, an If-Match header makes the
+// request conditional on the version of the contact. Patches that refer to fields that the roles
+// of the client hide, even only to test or copy them, are answered with the FORBIDDEN status code.
+//
+// Example REST API calls:
+//
+//	> curl http://localhost:8080/contacts/56 --request "PATCH" --include --header "Content-Type: application/merge-patch+json" --data '{"phone": "81970", "birthday": null}'
+//	> curl http://localhost:8080/contacts/56 --request "PATCH" --include --header "Content-Type: application/json-patch+json" --data '[{"op": "test", "path": "/phone", "value": "81970"}, {"op": "remove", "path": "/phone"}]'
+func patchContactByID(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
 	}
-	if submitted.Birthday != nil {
-		args = append(args, &submitted.Birthday)
-		sql += "birthday=?, "
+	version, success := parseIfMatch(c)
+	if !success {
+		return
 	}
 
-	// It only makes sense to continue if we have at least one value to update.
-	if len(args) == 0 {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "no values to be updated"})
+	body, errRead := c.GetRawData()
+	if errRead != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid patch document"})
 		return
 	}
-
-	sql = sql[:len(sql)-2]
-	sql += " WHERE id=?"
-	args = append(args, id)
-	result := db.MustExec(sql, args...)
-	rowsAffected, errRows := result.RowsAffected()
-	if errRows != nil {
-		log.Panicln(errRows)
+	var patch contactPatch
+	var errParse error
+	switch c.ContentType() {
+	case mergePatchContentType:
+		patch, errParse = parseMergePatch(body)
+	case jsonPatchContentType:
+		patch, errParse = parseJSONPatch(body)
+	default:
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"message": "unsupported patch format"})
+		return
 	}
-	if rowsAffected == 0 {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+	if errParse != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid patch document: " + errParse.Error()})
 		return
 	}
 
-	// In the HTTP response, return the full contact after the update.
 	var contacts []model.Contact
-	errSelect := selectWhereId.Select(&contacts, id)
-	if errSelect != nil {
-		log.Panicln(errRows)
+	if err := selectWhereId.SelectContext(c.Request.Context(), &contacts, id, tenant(c)); err != nil {
+		log.Panicln(err)
 	}
 	if len(contacts) == 0 {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+		return
+	}
+	if !checkAccess(c, accessTo(c, &contacts[0]), accessWrite, "contact not found") {
+		return
+	}
+	if version != anyVersion && version != contacts[0].Version {
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"message": "contact version does not match"})
+		return
+	}
+	if !checkFieldReads(c, &contacts[0], patch.fields()) {
+		return
+	}
+	doc, err := contactToDocument(contacts[0])
+	if err != nil {
+		log.Panicln(err)
+	}
+	if errApply := patch.apply(doc); errApply != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "patch cannot be applied: " + errApply.Error()})
 		return
 	}
-	c.IndentedJSON(http.StatusOK, contacts[0])
+	patched, errConvert := documentToContact(doc)
+	if errConvert != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "patch cannot be applied: " + errConvert.Error()})
+		return
+	}
+	patched.Id = id
+	patched.TenantId = tenant(c)
+	patched.Version = contacts[0].Version // detects changes since the contact was read
+	replaceContact(c, patched, actionUpdate)
 }
 
-// deleteContactByID deletes the contact whose ID value matches the id parameter of the request URL
-// from the database.
+// replaceContact overwrites all values of the stored contact with the values of the specified
+// contact, provided that the stored contact belongs to the same tenant, the user may change it,
+// it has the specified version, and the roles of the client permit changing the fields that
+// change. The change is recorded in the audit log under the specified action within the same
+// transaction. It responds with the full contact as it is stored in the database afterwards.
+func replaceContact(c *gin.Context, contact model.Contact, action string) {
+	var after *model.Contact
+	ctx := c.Request.Context()
+	committed := withTransaction(ctx, func(tx *sqlx.Tx) bool {
+		before := findContact(ctx, tx.Stmtx(selectWhereIdForUpdate), contact.Id, contact.TenantId)
+		if before == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+			return false
+		}
+		if !checkAccess(c, accessTo(c, before), accessWrite, "contact not found") {
+			return false
+		}
+		if contact.Version != anyVersion && contact.Version != before.Version {
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"message": "contact version does not match"})
+			return false
+		}
+		if !checkFieldWrites(c, before, &contact) {
+			return false
+		}
+		if _, err := tx.NamedStmt(updateWhereId).ExecContext(ctx, &contact); err != nil {
+			log.Panicln(err)
+		}
+		after = findContact(ctx, tx.Stmtx(selectWhereId), contact.Id, contact.TenantId)
+		recordAudit(tx, c, action, before, after)
+		return true
+	})
+	if committed {
+		c.Header("ETag", contactETag(*after))
+		c.IndentedJSON(http.StatusOK, redactContact(c, *after))
+	}
+}
+
+// deleteContactByID moves the contact whose ID value matches the id parameter of the request URL
+// to the trash. From there it can be restored until it is purged after the retention period. An
+// If-Match header makes the request conditional on the version of the contact.
 //
 // Example REST API call:
 //
 //	> curl http://localhost:8080/contacts/56 --request "DELETE"
 func deleteContactByID(c *gin.Context) {
-	id := c.Param("id")
-	_, error := strconv.Atoi(id)
-	if error != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "invalid id parameter"})
+	id, success := parseID(c)
+	if !success {
 		return
 	}
 
-	result, err := deleteWhereId.Exec(id)
-	if err != nil {
-		log.Panicln(err)
+	version, success := parseIfMatch(c)
+	if !success {
+		return
 	}
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
+
+	ctx := c.Request.Context()
+	committed := withTransaction(ctx, func(tx *sqlx.Tx) bool {
+		before := findContact(ctx, tx.Stmtx(selectWhereIdForUpdate), id, tenant(c))
+		if before == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+			return false
+		}
+		if !checkAccess(c, accessTo(c, before), accessWrite, "contact not found") {
+			return false
+		}
+		if version != anyVersion && version != before.Version {
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"message": "contact version does not match"})
+			return false
+		}
+		if _, err := tx.Stmtx(deleteWhereId).ExecContext(ctx, id, tenant(c), version, version); err != nil {
+			log.Panicln(err)
+		}
+		recordAudit(tx, c, actionDelete, before, nil)
+		return true
+	})
+	if committed {
+		c.IndentedJSON(http.StatusOK, gin.H{"message": "contact deleted"})
+	}
+}
+
+// findContact executes a statement that selects a contact of a tenant by id, and returns the
+// contact or nil if no contact was found.
+func findContact(ctx context.Context, stmt *sqlx.Stmt, id int64, tenant string) *model.Contact {
+	var contacts []model.Contact
+	if err := stmt.SelectContext(ctx, &contacts, id, tenant); err != nil {
 		log.Panicln(err)
 	}
-	if rowsAffected == 1 {
-		c.IndentedJSON(http.StatusOK, gin.H{"message": "contact deleted"})
-	} else {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+	if len(contacts) == 0 {
+		return nil
 	}
+	return &contacts[0]
 }
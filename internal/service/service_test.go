@@ -2,10 +2,10 @@ package service
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -31,19 +31,89 @@ func createMockObjects(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
 func expectPreparedStatements(mock sqlmock.Sqlmock) {
 	mock.ExpectPrepare(`INSERT INTO contacts`)
 	mock.ExpectPrepare(`SELECT \* FROM contacts WHERE id = \?`)
-	mock.ExpectPrepare(`DELETE FROM contacts WHERE id = \?`)
+	mock.ExpectPrepare(`UPDATE contacts SET deleted_at = NOW\(6\)`)
+	mock.ExpectPrepare(`UPDATE contacts SET firstname`)
+	mock.ExpectPrepare(`UPDATE contacts SET deleted_at = NULL`)
+	mock.ExpectPrepare(`DELETE FROM contacts WHERE deleted_at < \?`)
+	mock.ExpectPrepare(`SELECT \* FROM contacts WHERE id = \? AND tenant_id = \? AND deleted_at IS NULL FOR UPDATE`)
+	mock.ExpectPrepare(`INSERT INTO audit_log`)
+	mock.ExpectPrepare(`INSERT INTO outbox`)
+	mock.ExpectPrepare(`SELECT \* FROM audit_log WHERE contact_id = \? AND tenant_id = \? AND created_at <= \?`)
+	mock.ExpectPrepare(`SELECT \* FROM audit_log WHERE contact_id = \? AND tenant_id = \? AND version = \?`)
 }
 
 // expectSingleRowSelect instructs the mock object to expect that a select statement for a single
-// contact will be executed.
+// contact will be executed. The contact is returned with version 1.
 func expectSingleRowSelect(mock sqlmock.Sqlmock, id int, firstname string, lastname string, phone string, birthday time.Time) {
-	rows := mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday"}).
-		AddRow(id, firstname, lastname, phone, birthday)
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday", "version"}).
+		AddRow(id, firstname, lastname, phone, birthday, 1)
 	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id=?").
-		WithArgs(strconv.Itoa(id)).
+		WithArgs(int64(id), defaultTenant).
+		WillReturnRows(rows)
+}
+
+// createdAt is the point in time at which contacts in the tests are created.
+var createdAt = time.Date(2023, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+// expectCreatedSelect instructs the mock object to expect that a newly created contact is selected
+// within the transaction that created it. The contact is returned with version 1 and the
+// timestamps assigned by the database.
+func expectCreatedSelect(mock sqlmock.Sqlmock, id int, firstname interface{}, lastname interface{}, phone interface{}, birthday interface{}) {
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday", "version", "created_at", "updated_at"}).
+		AddRow(id, firstname, lastname, phone, birthday, 1, createdAt, createdAt)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\?").
+		WithArgs(int64(id), defaultTenant).
 		WillReturnRows(rows)
 }
 
+// expectLockedSelect instructs the mock object to expect that a contact is selected and locked
+// within a transaction. The contact is returned with the specified version.
+func expectLockedSelect(mock sqlmock.Sqlmock, id int, version int) {
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "version"}).
+		AddRow(id, "Erika", "Mustermann", version)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE").
+		WithArgs(int64(id), defaultTenant).
+		WillReturnRows(rows)
+}
+
+// expectLockedSelectNotFound instructs the mock object to expect that a contact is selected and
+// locked within a transaction, but that it does not exist.
+func expectLockedSelectNotFound(mock sqlmock.Sqlmock, id int) {
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE").
+		WithArgs(int64(id), defaultTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "version"}))
+}
+
+// expectAudit instructs the mock object to expect that a change of a contact by an anonymous
+// client is written to the audit log and to the outbox.
+func expectAudit(mock sqlmock.Sqlmock, id int, action string, version int) {
+	expectAuditBy(mock, id, action, version, anonymousActor)
+}
+
+// expectAuditBy instructs the mock object to expect that a change of a contact by the actor is
+// written to the audit log and to the outbox.
+func expectAuditBy(mock sqlmock.Sqlmock, id int, action string, version int, actor string) {
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(defaultTenant, int64(id), action, int64(version), sqlmock.AnyArg(), sqlmock.AnyArg(), nil, actor, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectOutbox(mock, id, sqlmock.AnyArg())
+}
+
+// expectOutbox instructs the mock object to expect that an event of the specified type for a
+// contact is written to the outbox.
+func expectOutbox(mock sqlmock.Sqlmock, id int, eventType driver.Value) {
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs(sqlmock.AnyArg(), defaultTenant, "", eventType, int64(id), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectDuplicateCandidates instructs the mock object to expect that the contacts with similar
+// names are selected before a contact is created. No candidates are returned.
+func expectDuplicateCandidates(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL AND " + visibleContactsPattern + " AND \\(firstname LIKE").
+		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname"}))
+}
+
 // initializeContactsService sets up the contacts service with the mock database and returns a
 // handle to the gin engine against which requests can be executed.
 func initializeContactsService(db *sql.DB) *gin.Engine {
@@ -54,12 +124,33 @@ func initializeContactsService(db *sql.DB) *gin.Engine {
 
 // runTest executes the HTTP request with the specified arguments and returns the response.
 func runTest(db *sql.DB, method string, url string, body *strings.Reader) *httptest.ResponseRecorder {
+	return runTestWithHeaders(db, method, url, body, nil)
+}
+
+// runAdminTest executes the HTTP request with the API key of the tests, which the mock object must
+// return with the admin scope, and returns the response; see expectAdminKeyLookup.
+func runAdminTest(db *sql.DB, method string, url string, body *strings.Reader) *httptest.ResponseRecorder {
+	return runTestWithHeaders(db, method, url, body, map[string]string{apiKeyHeader: testAPIKey})
+}
+
+// expectAdminKeyLookup instructs the mock object to expect that the API key of the tests is looked
+// up, and returns it with the admin scope. Its last use is recent, so it is not tracked again.
+func expectAdminKeyLookup(mock sqlmock.Sqlmock) {
+	expectAPIKeyLookup(mock, scopeAdmin, time.Now().UTC())
+}
+
+// runTestWithHeaders executes the HTTP request with the specified arguments and additional
+// request headers, and returns the response.
+func runTestWithHeaders(db *sql.DB, method string, url string, body *strings.Reader, headers map[string]string) *httptest.ResponseRecorder {
 	router := initializeContactsService(db)
 	recorder := httptest.NewRecorder()
 	if body == nil {
 		body = strings.NewReader("")
 	}
 	request, _ := http.NewRequest(method, url, body)
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
 	router.ServeHTTP(recorder, request)
 	return recorder
 }
@@ -286,6 +377,52 @@ func TestGetByBirthdayInvalidMonth(t *testing.T) {
 	}
 }
 
+// TestGetUpdatedSince executes a GET request for the contacts that were updated since a point in
+// time, sorted by the time of their last update. It expects that the point in time is passed to
+// the database, and that the JSON for a list of contacts is returned.
+func TestGetUpdatedSince(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	rows := mock.NewRows([]string{"id", "firstname", "version", "created_at", "updated_at"}).
+		AddRow(7, "Aaron", 2, createdAt, createdAt.Add(2*time.Hour))
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL AND "+visibleContactsPattern+" AND updated_at >= \\? ORDER BY updated_at DESC").
+		WithArgs(defaultTenant, false, "", "", createdAt.Add(time.Hour), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts?updated_since=2023-05-01T14:00:00%2B01:00&orderby=updated_at&ascending=false", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var contacts []model.Contact
+	json.Unmarshal(recorder.Body.Bytes(), &contacts)
+	assert.Equal(t, 1, len(contacts))
+	assert.Equal(t, createdAt, *contacts[0].CreatedAt)
+	assert.Equal(t, createdAt.Add(2*time.Hour), *contacts[0].UpdatedAt)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetInvalidUpdatedSince executes a GET request for the contacts that were updated since a
+// point in time, but the point in time is not in RFC 3339 format. It expects that the HTTP request
+// is answered with the BAD REQUEST status code, and that we do not reach out to the database.
+func TestGetInvalidUpdatedSince(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts?updated_since=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 // TestGet executes a GET request for a single contact with a valid ID. It expects that the JSON
 // for the contact is returned.
 func TestGet(t *testing.T) {
@@ -312,6 +449,36 @@ func TestGet(t *testing.T) {
 	assert.Equal(t, "Mustermann", getBody["lastname"])
 	assert.Equal(t, "+49 0815 4711", getBody["phone"])
 	assert.Equal(t, "1969-03-02T00:00:00Z", getBody["birthday"])
+	assert.Equal(t, 1.0, getBody["version"])
+	assert.Equal(t, `"1"`, recorder.Header().Get("ETag"))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetNotModified executes a GET request for a single contact with an If-None-Match header
+// that contains the current ETag of the contact. It expects that the HTTP request is answered with
+// the NOT MODIFIED status code and an empty body.
+func TestGetNotModified(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSingleRowSelect(mock,
+		29,
+		"Erika",
+		"Mustermann",
+		"+49 0815 4711",
+		time.Date(1969, time.March, 2, 0, 0, 0, 0, time.UTC),
+	)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/29", nil,
+		map[string]string{"If-None-Match": `"1"`})
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Equal(t, `"1"`, recorder.Header().Get("ETag"))
+	assert.Empty(t, recorder.Body.String())
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
@@ -326,7 +493,7 @@ func TestGetInvalidNumericID(t *testing.T) {
 	// Define expectations on SQL statements
 	expectPreparedStatements(mock)
 	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id=?").
-		WithArgs("9999").
+		WithArgs(int64(9999), defaultTenant).
 		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday"}))
 
 	// Run test and compare results
@@ -363,14 +530,22 @@ func TestPost(t *testing.T) {
 
 	// Define expectations on SQL statements
 	expectPreparedStatements(mock)
+	expectDuplicateCandidates(mock)
+	mock.ExpectBegin()
 	mock.ExpectExec("INSERT INTO contacts").
 		WithArgs(
+			defaultTenant,
+			nil,
 			"Erika",
 			"Mustermann",
 			"+49 0815 4711",
 			time.Date(1969, time.March, 4, 0, 0, 0, 0, time.UTC),
+			false,
 		).
 		WillReturnResult(sqlmock.NewResult(42, 1))
+	expectCreatedSelect(mock, 42, "Erika", "Mustermann", "+49 0815 4711", time.Date(1969, time.March, 4, 0, 0, 0, 0, time.UTC))
+	expectAudit(mock, 42, "create", 1)
+	mock.ExpectCommit()
 
 	// Run test and compare results
 	recorder := runTest(db, "POST", "/contacts", strings.NewReader(`
@@ -388,6 +563,8 @@ func TestPost(t *testing.T) {
 	assert.Equal(t, "Mustermann", postBody["lastname"])
 	assert.Equal(t, "+49 0815 4711", postBody["phone"])
 	assert.Equal(t, "1969-03-04T00:00:00Z", postBody["birthday"])
+	assert.Equal(t, "2023-05-01T12:00:00Z", postBody["created_at"])
+	assert.Equal(t, "2023-05-01T12:00:00Z", postBody["updated_at"])
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
@@ -431,9 +608,13 @@ func TestPostEmptyJSON(t *testing.T) {
 
 	// Define expectations on SQL statements
 	expectPreparedStatements(mock)
+	mock.ExpectBegin()
 	mock.ExpectExec("INSERT INTO contacts").
-		WithArgs(nil, nil, nil, nil).
+		WithArgs(defaultTenant, nil, nil, nil, nil, nil, false).
 		WillReturnResult(sqlmock.NewResult(49, 1))
+	expectCreatedSelect(mock, 49, nil, nil, nil, nil)
+	expectAudit(mock, 49, "create", 1)
+	mock.ExpectCommit()
 
 	// Run test and compare results
 	recorder := runTest(db, "POST", "/contacts", strings.NewReader("{}"))
@@ -457,13 +638,19 @@ func TestPut(t *testing.T) {
 
 	// Define expectations on SQL statements
 	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	expectLockedSelect(mock, 17, 1)
 	mock.ExpectExec("UPDATE contacts").
 		WithArgs(
 			"Rudi",
 			"Völler",
 			"+49 1234567890",
 			time.Date(1960, time.April, 13, 0, 0, 0, 0, time.UTC),
-			"17",
+			false,
+			int64(17),
+			defaultTenant,
+			int64(0),
+			int64(0),
 		).
 		WillReturnResult(sqlmock.NewResult(-1, 1))
 	expectSingleRowSelect(mock,
@@ -473,6 +660,8 @@ func TestPut(t *testing.T) {
 		"+49 1234567890",
 		time.Date(1960, time.April, 13, 0, 0, 0, 0, time.UTC),
 	)
+	expectAudit(mock, 17, "update", 1)
+	mock.ExpectCommit()
 
 	// Run test and compare results
 	recorder := runTest(db, "PUT", "/contacts/17", strings.NewReader(`
@@ -497,27 +686,36 @@ func TestPut(t *testing.T) {
 }
 
 // TestPutPartial executes a PUT request with a valid ID and a valid body that contains only a
-// subset of new values. It expects that the HTTP request is answered with the OK status code and a
-// body with all values of the contact.
+// subset of new values. It expects that the values which are not specified are cleared, and that
+// the HTTP request is answered with the OK status code and a body with all values of the contact.
 func TestPutPartial(t *testing.T) {
 	db, mock := createMockObjects(t)
 	defer db.Close()
 
 	// Define expectations on SQL statements
 	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	expectLockedSelect(mock, 35, 1)
 	mock.ExpectExec("UPDATE contacts").
 		WithArgs(
+			nil,
+			nil,
+			nil,
 			time.Date(1950, time.April, 13, 0, 0, 0, 0, time.UTC),
-			"35",
+			false,
+			int64(35),
+			defaultTenant,
+			int64(0),
+			int64(0),
 		).
 		WillReturnResult(sqlmock.NewResult(-1, 1))
-	expectSingleRowSelect(mock,
-		35,
-		"Rudi",
-		"Völler",
-		"+49 1234567890",
-		time.Date(1950, time.April, 13, 0, 0, 0, 0, time.UTC),
-	)
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday", "version"}).
+		AddRow(35, nil, nil, nil, time.Date(1950, time.April, 13, 0, 0, 0, 0, time.UTC), 2)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id=?").
+		WithArgs(int64(35), defaultTenant).
+		WillReturnRows(rows)
+	expectAudit(mock, 35, "update", 2)
+	mock.ExpectCommit()
 
 	// Run test and compare results
 	recorder := runTest(db, "PUT", "/contacts/35", strings.NewReader(`
@@ -529,9 +727,9 @@ func TestPutPartial(t *testing.T) {
 	var postBody map[string]interface{}
 	json.Unmarshal(recorder.Body.Bytes(), &postBody)
 	assert.Equal(t, 35.0, postBody["id"])
-	assert.Equal(t, "Rudi", postBody["firstname"])
-	assert.Equal(t, "Völler", postBody["lastname"])
-	assert.Equal(t, "+49 1234567890", postBody["phone"])
+	assert.Nil(t, postBody["firstname"])
+	assert.Nil(t, postBody["lastname"])
+	assert.Nil(t, postBody["phone"])
 	assert.Equal(t, "1950-04-13T00:00:00Z", postBody["birthday"])
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -547,9 +745,9 @@ func TestPutInvalidNumericID(t *testing.T) {
 
 	// Define expectations on SQL statements
 	expectPreparedStatements(mock)
-	mock.ExpectExec("UPDATE contacts").
-		WithArgs("Rudi", "Völler", "9999").
-		WillReturnResult(sqlmock.NewResult(-1, 0))
+	mock.ExpectBegin()
+	expectLockedSelectNotFound(mock, 9999)
+	mock.ExpectRollback()
 
 	// Run test and compare results
 	recorder := runTest(db, "PUT", "/contacts/9999", strings.NewReader(`
@@ -564,6 +762,51 @@ func TestPutInvalidNumericID(t *testing.T) {
 	}
 }
 
+// TestPutVersionMismatch executes a PUT request with an If-Match header that does not contain the
+// current ETag of the contact. It expects that the HTTP request is answered with the PRECONDITION
+// FAILED status code.
+func TestPutVersionMismatch(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	expectLockedSelect(mock, 17, 2)
+	mock.ExpectRollback()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PUT", "/contacts/17", strings.NewReader(`
+		{
+			"firstname": "Rudi",
+			"lastname": "Völler"
+		}
+	`), map[string]string{"If-Match": `"3"`})
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPutIfMatchRequired executes a PUT request without an If-Match header while the header is
+// required. It expects that the HTTP request is answered with the PRECONDITION REQUIRED status
+// code, and that we do not reach out to the database in the first place.
+func TestPutIfMatchRequired(t *testing.T) {
+	t.Setenv("REQUIRE_IF_MATCH", "true")
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	recorder := runTest(db, "PUT", "/contacts/17", strings.NewReader(`{"firstname": "Rudi"}`))
+	assert.Equal(t, http.StatusPreconditionRequired, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 // TestPutInvalidCharacterID executes a PUT request with an invalid ID consisting of characters.
 // It expects that the HTTP request is answered with the NOT FOUND status code. It also expects
 // that we do not reach out to the database in the first place.
@@ -592,7 +835,6 @@ func TestPutInvalidCharacterID(t *testing.T) {
 func TestPutInvalidBodies(t *testing.T) {
 	invalidRequestBodies := []string{
 		"",
-		"{}",
 		"not JSON",
 		`{
 			"firstname": "Erika"
@@ -617,6 +859,205 @@ func TestPutInvalidBodies(t *testing.T) {
 	}
 }
 
+// TestPatchMerge executes a PATCH request with a JSON Merge Patch document. It expects that the
+// specified values are replaced, that null values clear the property, and that the untouched
+// values are stored unchanged.
+func TestPatchMerge(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSingleRowSelect(mock,
+		29,
+		"Erika",
+		"Mustermann",
+		"+49 0815 4711",
+		time.Date(1969, time.March, 2, 0, 0, 0, 0, time.UTC),
+	)
+	mock.ExpectBegin()
+	expectLockedSelect(mock, 29, 1)
+	mock.ExpectExec("UPDATE contacts").
+		WithArgs("Erika", "Mustermann", "+49 999", nil, false, int64(29), defaultTenant, int64(1), int64(1)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday", "version"}).
+		AddRow(29, "Erika", "Mustermann", "+49 999", nil, 2)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id=?").
+		WithArgs(int64(29), defaultTenant).
+		WillReturnRows(rows)
+	expectAudit(mock, 29, "update", 2)
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PATCH", "/contacts/29",
+		strings.NewReader(`{"phone": "+49 999", "birthday": null}`),
+		map[string]string{"Content-Type": "application/merge-patch+json"})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var patchBody map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &patchBody)
+	assert.Equal(t, 29.0, patchBody["id"])
+	assert.Equal(t, "Erika", patchBody["firstname"])
+	assert.Equal(t, "+49 999", patchBody["phone"])
+	assert.Nil(t, patchBody["birthday"])
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPatchJSONPatch executes a PATCH request with a JSON Patch document consisting of a
+// successful test operation followed by a replace and a remove operation. It expects that the
+// operations are applied in order.
+func TestPatchJSONPatch(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSingleRowSelect(mock,
+		29,
+		"Erika",
+		"Mustermann",
+		"+49 0815 4711",
+		time.Date(1969, time.March, 2, 0, 0, 0, 0, time.UTC),
+	)
+	mock.ExpectBegin()
+	expectLockedSelect(mock, 29, 1)
+	mock.ExpectExec("UPDATE contacts").
+		WithArgs("Erika", "Musterfrau", nil, time.Date(1969, time.March, 2, 0, 0, 0, 0, time.UTC), false, int64(29), defaultTenant, int64(1), int64(1)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday", "version"}).
+		AddRow(29, "Erika", "Musterfrau", nil, time.Date(1969, time.March, 2, 0, 0, 0, 0, time.UTC), 2)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id=?").
+		WithArgs(int64(29), defaultTenant).
+		WillReturnRows(rows)
+	expectAudit(mock, 29, "update", 2)
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PATCH", "/contacts/29", strings.NewReader(`[
+			{"op": "test", "path": "/lastname", "value": "Mustermann"},
+			{"op": "replace", "path": "/lastname", "value": "Musterfrau"},
+			{"op": "remove", "path": "/phone"}
+		]`),
+		map[string]string{"Content-Type": "application/json-patch+json"})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var patchBody map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &patchBody)
+	assert.Equal(t, "Musterfrau", patchBody["lastname"])
+	assert.Nil(t, patchBody["phone"])
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPatchFailingTest executes a PATCH request with a JSON Patch document whose test operation
+// does not match the stored contact. It expects that the HTTP request is answered with the
+// CONFLICT status code and that the contact is not updated.
+func TestPatchFailingTest(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSingleRowSelect(mock,
+		29,
+		"Erika",
+		"Mustermann",
+		"+49 0815 4711",
+		time.Date(1969, time.March, 2, 0, 0, 0, 0, time.UTC),
+	)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PATCH", "/contacts/29", strings.NewReader(`[
+			{"op": "test", "path": "/lastname", "value": "Musterfrau"},
+			{"op": "remove", "path": "/phone"}
+		]`),
+		map[string]string{"Content-Type": "application/json-patch+json"})
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPatchVersionMismatch executes a PATCH request with an If-Match header that does not contain
+// the current ETag of the contact. It expects that the HTTP request is answered with the
+// PRECONDITION FAILED status code and that the contact is not updated.
+func TestPatchVersionMismatch(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectSingleRowSelect(mock,
+		29,
+		"Erika",
+		"Mustermann",
+		"+49 0815 4711",
+		time.Date(1969, time.March, 2, 0, 0, 0, 0, time.UTC),
+	)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PATCH", "/contacts/29", strings.NewReader(`{"phone": null}`),
+		map[string]string{"Content-Type": "application/merge-patch+json", "If-Match": `"2"`})
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPatchInvalidDocuments executes PATCH requests with invalid patch documents. It expects that
+// the HTTP requests are all answered with the BAD REQUEST status code, and that we do not reach
+// out to the database in the first place.
+func TestPatchInvalidDocuments(t *testing.T) {
+	invalidRequests := map[string]string{
+		"not JSON":                                                    "application/merge-patch+json",
+		`["firstname"]`:                                               "application/merge-patch+json",
+		`{"id": 5}`:                                                   "application/merge-patch+json",
+		`{"nickname": "Rudi"}`:                                        "application/merge-patch+json",
+		`{"firstname": 42}`:                                           "application/merge-patch+json",
+		`{"birthday": "yesterday"}`:                                   "application/merge-patch+json",
+		`{"op": "remove", "path": "/phone"}`:                          "application/json-patch+json",
+		`[{"op": "delete", "path": "/phone"}]`:                        "application/json-patch+json",
+		`[{"op": "replace", "path": "/id", "value": 5}]`:              "application/json-patch+json",
+		`[{"op": "replace", "path": "/phone"}]`:                       "application/json-patch+json",
+		`[{"op": "add", "path": "/birthday", "value": "1969"}]`:       "application/json-patch+json",
+		`[{"op": "copy", "from": "/nickname", "path": "/firstname"}]`: "application/json-patch+json",
+	}
+	for body, contentType := range invalidRequests {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+		// Run test and compare results
+		recorder := runTestWithHeaders(db, "PATCH", "/contacts/1", strings.NewReader(body),
+			map[string]string{"Content-Type": contentType})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "request body: "+body)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+// TestPatchUnsupportedContentType executes a PATCH request with a plain JSON body. It expects
+// that the HTTP request is answered with the UNSUPPORTED MEDIA TYPE status code.
+func TestPatchUnsupportedContentType(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PATCH", "/contacts/1", strings.NewReader(`{"phone": "0815"}`),
+		map[string]string{"Content-Type": "application/json"})
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 // TestDelete executes a DELETE request for a single contact with a valid ID. It expects that the
 // status OK is returned.
 func TestDelete(t *testing.T) {
@@ -625,9 +1066,13 @@ func TestDelete(t *testing.T) {
 
 	// Define expectations on SQL statements
 	expectPreparedStatements(mock)
-	mock.ExpectExec("DELETE FROM contacts").
-		WithArgs("42").
+	mock.ExpectBegin()
+	expectLockedSelect(mock, 42, 1)
+	mock.ExpectExec("UPDATE contacts SET deleted_at").
+		WithArgs(int64(42), defaultTenant, int64(0), int64(0)).
 		WillReturnResult(sqlmock.NewResult(-1, 1))
+	expectAudit(mock, 42, "delete", 2)
+	mock.ExpectCommit()
 
 	// Run test and compare results
 	recorder := runTest(db, "DELETE", "/contacts/42", nil)
@@ -637,6 +1082,32 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+// TestDeleteIfMatch executes a DELETE request with an If-Match header that contains the current
+// ETag of the contact. It expects that the version is passed to the database and that the status
+// OK is returned.
+func TestDeleteIfMatch(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	expectLockedSelect(mock, 42, 4)
+	mock.ExpectExec("UPDATE contacts SET deleted_at").
+		WithArgs(int64(42), defaultTenant, int64(4), int64(4)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+	expectAudit(mock, 42, "delete", 5)
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "DELETE", "/contacts/42", nil,
+		map[string]string{"If-Match": `"4"`})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 // TestDeleteInvalidNumericID executes a DELETE request with an invalid but still numeric ID for a
 // single contact. It expects that the HTTP request is answered with the NOT FOUND status code.
 func TestDeleteInvalidNumericID(t *testing.T) {
@@ -645,9 +1116,9 @@ func TestDeleteInvalidNumericID(t *testing.T) {
 
 	// Define expectations on SQL statements
 	expectPreparedStatements(mock)
-	mock.ExpectExec("DELETE FROM contacts").
-		WithArgs("9999").
-		WillReturnResult(sqlmock.NewResult(-1, 0))
+	mock.ExpectBegin()
+	expectLockedSelectNotFound(mock, 9999)
+	mock.ExpectRollback()
 
 	// Run test and compare results
 	recorder := runTest(db, "DELETE", "/contacts/9999", nil)
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"io"
+	"log"
+	"sync"
+)
+
+// backgroundJobs counts the background jobs that are running, so that the database is closed only
+// after they stopped.
+var backgroundJobs sync.WaitGroup
+
+// drainMutex guards the draining channel.
+var drainMutex sync.Mutex
+
+// draining is closed when the service starts to shut down. It is created when the router is set
+// up.
+var draining = make(chan struct{})
+
+// setupDraining marks the service as ready.
+func setupDraining() {
+	drainMutex.Lock()
+	defer drainMutex.Unlock()
+	draining = make(chan struct{})
+}
+
+// Drain prepares the service for shutting down. The readiness endpoint reports that the service is
+// not ready anymore, so that load balancers stop sending new requests, and the event streams are
+// ended, so that their clients reconnect to other instances. Requests in flight are not affected.
+func Drain() {
+	drainMutex.Lock()
+	defer drainMutex.Unlock()
+	select {
+	case <-draining:
+	default:
+		close(draining)
+	}
+}
+
+// drained returns a channel that is closed when the service starts to shut down.
+func drained() <-chan struct{} {
+	drainMutex.Lock()
+	defer drainMutex.Unlock()
+	return draining
+}
+
+// CloseDatabase waits until the background jobs stopped, whose context must have been cancelled
+// before, and then closes the prepared statements and the connection pool. It is called after the
+// HTTP server shut down.
+func CloseDatabase() {
+	backgroundJobs.Wait()
+	statementsPrepared.Store(false)
+	statements := []io.Closer{insert, selectWhereId, deleteWhereId, updateWhereId, restoreWhereId,
+		purgeDeletedBefore, selectWhereIdForUpdate, insertAudit, insertOutbox, selectAuditAsOf,
+		selectAuditWhereVersion}
+	for _, statement := range statements {
+		if err := statement.Close(); err != nil {
+			log.Println("could not close prepared statement:", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		log.Println("could not close database:", err)
+	}
+}
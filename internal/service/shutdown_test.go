@@ -0,0 +1,72 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReadinessWhileDraining executes a GET request for the readiness after the service started
+// to shut down. It expects that the service reports to be draining without checking the database.
+func TestReadinessWhileDraining(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	Drain()
+	recorder := serveFrom(router, "/readyz", "192.0.2.1")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	var status map[string]any
+	json.Unmarshal(recorder.Body.Bytes(), &status)
+	assert.Equal(t, "draining", status["status"])
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestDrainEndsEventStream opens the event stream and lets the service start to shut down. It
+// expects that the stream ends.
+func TestDrainEndsEventStream(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	server := httptest.NewServer(initializeContactsService(db))
+	t.Cleanup(server.Close) // runs after the event stream is closed
+	reader := openEventStream(t, server, "", nil)
+	Drain()
+	_, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestCloseDatabase closes the database after the background jobs stopped. It expects that the
+// connection pool is closed.
+func TestCloseDatabase(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectClose()
+
+	// Run test and compare results
+	SetupDatabaseWrapper(db)
+	CloseDatabase()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
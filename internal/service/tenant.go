@@ -0,0 +1,81 @@
+package service
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tenantHeader is the HTTP header with which unauthenticated clients select their tenant, if the
+// header is trusted.
+const tenantHeader = "X-Tenant-ID"
+
+// tenantKey is the key under which the tenant of the request is stored in the gin context.
+const tenantKey = "tenant"
+
+// defaultTenant is the tenant of requests that do not name one. All contacts that existed before
+// tenants were introduced belong to it.
+const defaultTenant = "default"
+
+// validTenant matches the ids that tenants may have.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// tenantClaim is the claim of a bearer token that holds the client's tenant, or an empty string if
+// tokens do not carry a tenant. It is taken from the JWT_TENANT_CLAIM environment variable when
+// the router is set up.
+var tenantClaim = ""
+
+// trustTenantHeader tells whether unauthenticated clients may select their tenant with the
+// X-Tenant-ID header. It is taken from the TRUST_TENANT_HEADER environment variable when the
+// router is set up.
+var trustTenantHeader = false
+
+// setupTenants reads the configuration of tenants from environment variables. TRUST_TENANT_HEADER
+// must be set to 'true' to let unauthenticated clients select their tenant, which is only safe if
+// a gateway in front of the service authenticates the clients and sets the header.
+func setupTenants() {
+	tenantClaim = os.Getenv("JWT_TENANT_CLAIM")
+	trustTenantHeader = strings.EqualFold(os.Getenv("TRUST_TENANT_HEADER"), "true")
+}
+
+// resolveTenant returns a middleware that determines the tenant of a request and stores it in the
+// gin context. Every query on tenant data is restricted to this tenant, so that clients can never
+// see or change the data of other tenants.
+//
+// Clients that authenticated with an API key or a bearer token belong to the tenant of the key or
+// token. They may send an X-Tenant-ID header, but it must name their own tenant; otherwise the
+// request is answered with the FORBIDDEN status code. Unauthenticated clients use the default
+// tenant, and may only select another tenant with the header if the header is trusted; see
+// setupTenants. The bootstrap key always selects the tenant with the header.
+func resolveTenant() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader(tenantHeader)
+		if header != "" && !validTenant.MatchString(header) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid X-Tenant-ID header"})
+			return
+		}
+		authenticated := c.GetString(tenantKey)
+		selectable := trustTenantHeader || c.GetBool(bootstrapKey)
+		switch {
+		case authenticated != "" && header != "" && header != authenticated:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "access to tenant denied"})
+			return
+		case authenticated == "" && header != "" && selectable:
+			c.Set(tenantKey, header)
+		case authenticated == "" && header != "" && header != defaultTenant:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "access to tenant denied"})
+			return
+		case authenticated == "":
+			c.Set(tenantKey, defaultTenant)
+		}
+		c.Next()
+	}
+}
+
+// tenant returns the tenant of the request.
+func tenant(c *gin.Context) string {
+	return c.GetString(tenantKey)
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/events"
+)
+
+// otherTenant is the tenant of the client in the tests that try to access the contacts of the
+// default tenant.
+const otherTenant = "acme"
+
+// TestGetOtherTenant executes a GET request for a contact of the default tenant on behalf of
+// another tenant. It expects that the contact is only looked up within the client's tenant, and
+// that the HTTP request is answered with the NOT FOUND status code.
+func TestGetOtherTenant(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("TRUST_TENANT_HEADER", "true")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\?").
+		WithArgs(int64(42), otherTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday"}))
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil, map[string]string{tenantHeader: otherTenant})
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetAllOtherTenant executes GET requests for lists of contacts on behalf of another tenant,
+// with all combinations of search criteria. It expects that every query is restricted to the
+// client's tenant.
+func TestGetAllOtherTenant(t *testing.T) {
+	queries := map[string][]driver.Value{
+		"":                            {otherTenant, false, "", "", epoch, sqlmock.AnyArg(), "0"},
+		"?firstname=Er":               {otherTenant, false, "", "", epoch, "Er%", "%", sqlmock.AnyArg(), "0"},
+		"?birthday=03-04":             {otherTenant, false, "", "", epoch, 3, 4, sqlmock.AnyArg(), "0"},
+		"?lastname=Mu&birthday=03-04": {otherTenant, false, "", "", epoch, "%", "Mu%", 3, 4, sqlmock.AnyArg(), "0"},
+	}
+	for query, args := range queries {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+		t.Setenv("TRUST_TENANT_HEADER", "true")
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock)
+		mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NULL").
+			WithArgs(args...).
+			WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday"}))
+
+		// Run test and compare results
+		recorder := runTestWithHeaders(db, "GET", "/contacts"+query, nil, map[string]string{tenantHeader: otherTenant})
+		assert.Equal(t, http.StatusNotFound, recorder.Code, "query: "+query)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations for query '%s': %s", query, err)
+		}
+	}
+}
+
+// TestPutOtherTenant executes a PUT request for a contact of the default tenant on behalf of
+// another tenant. It expects that the contact is only looked up within the client's tenant, that
+// nothing is changed, and that the HTTP request is answered with the NOT FOUND status code.
+func TestPutOtherTenant(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("TRUST_TENANT_HEADER", "true")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE").
+		WithArgs(int64(42), otherTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "version"}))
+	mock.ExpectRollback()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "PUT", "/contacts/42", strings.NewReader(`{"firstname": "Mallory"}`),
+		map[string]string{tenantHeader: otherTenant})
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestDeleteOtherTenant executes a DELETE request for a contact of the default tenant on behalf of
+// another tenant. It expects that the contact is only looked up within the client's tenant, that
+// it is not moved to the trash, and that the HTTP request is answered with the NOT FOUND status
+// code.
+func TestDeleteOtherTenant(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("TRUST_TENANT_HEADER", "true")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\? AND deleted_at IS NULL FOR UPDATE").
+		WithArgs(int64(42), otherTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "version"}))
+	mock.ExpectRollback()
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "DELETE", "/contacts/42", nil, map[string]string{tenantHeader: otherTenant})
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestTenantHeaderOfOtherTenant executes a GET request with an API key of the default tenant and
+// an X-Tenant-ID header that names another tenant. It expects that the HTTP request is answered
+// with the FORBIDDEN status code before any contact is selected.
+func TestTenantHeaderOfOtherTenant(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAPIKeyLookup(mock, "read", time.Now().UTC())
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil,
+		map[string]string{apiKeyHeader: testAPIKey, tenantHeader: otherTenant})
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestUntrustedTenantHeader executes GET requests without credentials and with X-Tenant-ID headers
+// while the header is not trusted. It expects that the default tenant may be named, and that
+// other tenants are answered with the FORBIDDEN status code before any contact is selected.
+func TestUntrustedTenantHeader(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE id = \\? AND tenant_id = \\?").
+		WithArgs(int64(42), defaultTenant).
+		WillReturnRows(mock.NewRows([]string{"id", "firstname", "lastname", "phone", "birthday"}))
+
+	// Run test and compare results
+	router := initializeContactsService(db)
+	for header, status := range map[string]int{otherTenant: http.StatusForbidden, defaultTenant: http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/contacts/42", nil)
+		request.Header.Set(tenantHeader, header)
+		router.ServeHTTP(recorder, request)
+		assert.Equal(t, status, recorder.Code, "header: "+header)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestInvalidTenantHeader executes GET requests with invalid X-Tenant-ID headers. It expects that
+// the HTTP requests are answered with the BAD REQUEST status code.
+func TestInvalidTenantHeader(t *testing.T) {
+	for _, header := range []string{"a b", "acme/eu", "%", strings.Repeat("a", 65)} {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+		// Run test and compare results
+		recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil, map[string]string{tenantHeader: header})
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "header: "+header)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+// TestBearerTokenWithoutTenant executes a GET request with a bearer token that lacks the
+// configured tenant claim. It expects that the request is answered with the UNAUTHORIZED status
+// code.
+func TestBearerTokenWithoutTenant(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	setupTokenTest(t)
+	t.Setenv("JWT_TENANT_CLAIM", "tenant")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+
+	// Run test and compare results
+	recorder := runTestWithHeaders(db, "GET", "/contacts/42", nil,
+		map[string]string{"Authorization": bearerToken(t, "contacts:read")})
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestEventStreamOtherTenant opens the event stream on behalf of another tenant after changes of
+// both tenants were published. It expects that only the events of the client's tenant are sent.
+func TestEventStreamOtherTenant(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	t.Setenv("TRUST_TENANT_HEADER", "true")
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+
+	// Run test and compare results
+	server := httptest.NewServer(initializeContactsService(db))
+	t.Cleanup(server.Close) // runs after the event stream is closed
+	useTestEventBus(t)
+	eventBus.Publish(events.Event{Id: 6, TenantId: defaultTenant, Type: events.Updated, ContactId: 6})
+	eventBus.Publish(events.Event{Id: 7, TenantId: defaultTenant, Type: events.Updated, ContactId: 7})
+	eventBus.Publish(events.Event{Id: 8, TenantId: defaultTenant, Type: events.Deleted, ContactId: 8})
+	eventBus.Publish(events.Event{Id: 9, TenantId: otherTenant, Type: events.Created, ContactId: 9})
+
+	reader := openEventStream(t, server, "", map[string]string{"Last-Event-ID": "6", tenantHeader: otherTenant})
+	lines := readEvent(t, reader)
+	assert.Equal(t, "id:9", lines[0])
+	assert.Equal(t, "event:created", lines[1])
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// defaultTrashRetention is the time after which contacts in the trash are purged if the
+// environment variable TRASH_RETENTION is not set.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashPurgeInterval is the time between two runs of the job that purges the trash.
+const trashPurgeInterval = time.Hour
+
+// findDeletedContacts responds with the list of contacts in the trash as JSON. The contacts that
+// were deleted most recently come first.
+//
+// The URL parameters 'limit' and 'offset' can be used for paging, like for findContacts.
+//
+// Example REST API calls:
+//
+//	> curl "http://localhost:8080/contacts/trash"
+//	> curl "http://localhost:8080/contacts/trash?limit=20&offset=60"
+func findDeletedContacts(c *gin.Context) {
+	limit, offset, success := parseLimitAndOffset(c)
+	if !success {
+		return
+	}
+	var contacts []model.Contact
+	args := append([]interface{}{tenant(c)}, visibilityArgs(c)...)
+	ctx := c.Request.Context()
+	err := db.SelectContext(ctx, &contacts, `
+		SELECT *
+		FROM contacts
+		WHERE tenant_id = ? AND deleted_at IS NOT NULL AND `+visibleContacts+`
+		ORDER BY deleted_at DESC, id DESC
+		LIMIT ?
+		OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(contacts) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "contact not found"})
+		return
+	}
+	redactContacts(c, contacts)
+	c.IndentedJSON(http.StatusOK, contacts)
+}
+
+// restoreContactByID moves the contact whose ID value matches the id parameter of the request URL
+// out of the trash, records this in the audit log, and responds with the restored contact.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/contacts/56/restore --request "POST"
+func restoreContactByID(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	if !checkAccess(c, contactAccess(c, id), accessWrite, "contact not found in trash") {
+		return
+	}
+
+	var after *model.Contact
+	ctx := c.Request.Context()
+	committed := withTransaction(ctx, func(tx *sqlx.Tx) bool {
+		result, err := tx.Stmtx(restoreWhereId).ExecContext(ctx, id, tenant(c))
+		if err != nil {
+			log.Panicln(err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			log.Panicln(err)
+		}
+		if rowsAffected == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "contact not found in trash"})
+			return false
+		}
+		after = findContact(ctx, tx.Stmtx(selectWhereId), id, tenant(c))
+		recordAudit(tx, c, actionRestore, nil, after)
+		return true
+	})
+	if committed {
+		c.Header("ETag", contactETag(*after))
+		c.IndentedJSON(http.StatusOK, redactContact(c, *after))
+	}
+}
+
+// PurgeTrash permanently removes all contacts that have been in the trash for longer than the
+// retention period. It returns the number of removed contacts.
+func PurgeTrash(ctx context.Context, retention time.Duration) (int64, error) {
+	result, err := purgeDeletedBefore.ExecContext(ctx, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StartTrashPurger starts a background job that purges the trash every hour until the context is
+// cancelled. The retention period is taken from the environment variable TRASH_RETENTION, which
+// must be a duration like '720h'. It defaults to 30 days.
+func StartTrashPurger(ctx context.Context) {
+	retention := defaultTrashRetention
+	if value := os.Getenv("TRASH_RETENTION"); value != "" {
+		var err error
+		retention, err = time.ParseDuration(value)
+		if err != nil || retention < 0 {
+			log.Fatal("could not parse TRASH_RETENTION env variable ", value)
+		}
+	}
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for {
+			purged, err := PurgeTrash(ctx, retention)
+			if err != nil {
+				log.Println("could not purge trash:", err)
+			} else if purged > 0 {
+				fmt.Printf("Purged %d contacts from the trash.\n", purged)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
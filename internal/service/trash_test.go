@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// TestGetTrash executes a GET request for all contacts in the trash. It expects that the JSON for
+// a list of deleted contacts is returned.
+func TestGetTrash(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	deletedAt := time.Date(2023, time.May, 1, 12, 0, 0, 0, time.UTC)
+	rows := mock.NewRows([]string{"id", "firstname", "lastname", "version", "deleted_at"}).
+		AddRow(7, "Aaron", "Huber", 3, deletedAt)
+	mock.ExpectQuery("SELECT \\* FROM contacts WHERE tenant_id = \\? AND deleted_at IS NOT NULL").
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runTest(db, "GET", "/contacts/trash?limit=10", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var contacts []model.Contact
+	json.Unmarshal(recorder.Body.Bytes(), &contacts)
+	assert.Equal(t, 1, len(contacts))
+	assert.Equal(t, int64(7), contacts[0].Id)
+	assert.Equal(t, deletedAt, *contacts[0].DeletedAt)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRestore executes a POST request for restoring a contact from the trash. It expects that the
+// HTTP request is answered with the OK status code and a body with the restored contact.
+func TestRestore(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE contacts SET deleted_at = NULL").
+		WithArgs(int64(29), defaultTenant).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+	expectSingleRowSelect(mock,
+		29,
+		"Erika",
+		"Mustermann",
+		"+49 0815 4711",
+		time.Date(1969, time.March, 2, 0, 0, 0, 0, time.UTC),
+	)
+	expectAuditBy(mock, 29, "restore", 1, "key:billing")
+	mock.ExpectCommit()
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "POST", "/contacts/29/restore", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var body map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	assert.Equal(t, 29.0, body["id"])
+	assert.Equal(t, "Erika", body["firstname"])
+	assert.Nil(t, body["deleted_at"])
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestRestoreNotInTrash executes a POST request for restoring a contact that is not in the trash.
+// It expects that the HTTP request is answered with the NOT FOUND status code.
+func TestRestoreNotInTrash(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE contacts SET deleted_at = NULL").
+		WithArgs(int64(29), defaultTenant).
+		WillReturnResult(sqlmock.NewResult(-1, 0))
+	mock.ExpectRollback()
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "POST", "/contacts/29/restore", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestPurgeTrash purges the trash. It expects that all contacts deleted before the retention
+// period are removed, and that their number is returned.
+func TestPurgeTrash(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectExec("DELETE FROM contacts WHERE deleted_at < \\?").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(-1, 5))
+
+	// Run test and compare results
+	initializeContactsService(db)
+	purged, err := PurgeTrash(context.Background(), 24*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), purged)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
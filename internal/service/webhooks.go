@@ -0,0 +1,463 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/events"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// webhookEventPrefix is prepended to the event types of the event bus to form the names of the
+// events that are sent to webhooks, for example 'contact.created'.
+const webhookEventPrefix = "contact."
+
+// HTTP headers of the requests that are sent to webhooks.
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	idempotencyKeyHeader   = "Idempotency-Key"
+)
+
+// Statuses of webhook deliveries.
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+// webhookMaxAttempts is the number of times a delivery is attempted before it is given up.
+const webhookMaxAttempts = 8
+
+// webhookMaxBackoff is the longest time between two attempts of a delivery.
+const webhookMaxBackoff = time.Hour
+
+// webhookTimeout is the time a webhook receiver has to answer a delivery.
+const webhookTimeout = 10 * time.Second
+
+// webhookBatchSize is the maximum number of deliveries that are attempted in one run.
+const webhookBatchSize = 100
+
+// webhookInitialBackoff is the time between the first and the second attempt of a delivery. It
+// doubles with every further attempt.
+var webhookInitialBackoff = 10 * time.Second
+
+// webhookPollInterval is the time between two runs of the job that attempts due deliveries.
+var webhookPollInterval = time.Second
+
+// webhookEvents are the names of the events that webhooks can subscribe to.
+var webhookEvents = []string{
+	webhookEventPrefix + events.Created,
+	webhookEventPrefix + events.Updated,
+	webhookEventPrefix + events.Deleted,
+}
+
+// webhookRow is a webhook as it is stored in the database. The events are stored as a comma
+// separated list. A webhook only receives the events of its tenant.
+type webhookRow struct {
+	Id        int64     `db:"id"`
+	TenantId  string    `db:"tenant_id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	Events    string    `db:"events"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// webhookPayload is the JSON body that is sent to webhooks.
+type webhookPayload struct {
+	Event     string         `json:"event"`
+	Key       string         `json:"idempotency_key"`
+	ContactId int64          `json:"contact_id"`
+	Contact   *model.Contact `json:"contact"`
+	Time      time.Time      `json:"time"`
+}
+
+// dueDelivery is a delivery that is due, together with the webhook it is sent to.
+type dueDelivery struct {
+	Id       int64           `db:"id"`
+	Event    string          `db:"event"`
+	Key      string          `db:"idempotency_key"`
+	Payload  json.RawMessage `db:"payload"`
+	Attempts int             `db:"attempts"`
+	URL      string          `db:"url"`
+	Secret   string          `db:"secret"`
+}
+
+// createWebhook registers the webhook specified in the request's JSON. The 'url' must be an
+// absolute http or https URL, and 'events' lists the events the webhook subscribes to. If no
+// 'secret' is specified, one is generated. The response carries the webhook including its secret,
+// which is not returned again later.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/webhooks --request "POST" --header "Content-Type: application/json" --data '{"url": "https://billing.example.com/hooks/contacts", "events": ["contact.created", "contact.deleted"]}'
+func createWebhook(c *gin.Context) {
+	var webhook model.Webhook
+	if err := c.BindJSON(&webhook); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid JSON"})
+		return
+	}
+	if parsed, err := url.Parse(webhook.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") ||
+		parsed.Host == "" || len(webhook.URL) > 2048 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid url"})
+		return
+	}
+	if len(webhook.Events) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid events"})
+		return
+	}
+	for _, event := range webhook.Events {
+		if !contains(webhookEvents, event) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid events"})
+			return
+		}
+	}
+	if len(webhook.Secret) > 100 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid secret"})
+		return
+	}
+	if webhook.Secret == "" {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			log.Panicln(err)
+		}
+		webhook.Secret = hex.EncodeToString(random)
+	}
+
+	result, err := db.ExecContext(c.Request.Context(), `
+		INSERT INTO webhooks (tenant_id, url, secret, events)
+		VALUES (?, ?, ?, ?)`, tenant(c), webhook.URL, webhook.Secret, strings.Join(webhook.Events, ","))
+	if err != nil {
+		log.Panicln(err)
+	}
+	webhook.Id, err = result.LastInsertId()
+	if err != nil {
+		log.Panicln(err)
+	}
+	webhook.CreatedAt = time.Now().UTC()
+	c.IndentedJSON(http.StatusCreated, webhook)
+}
+
+// findWebhooks responds with the list of webhooks of the tenant as JSON. The secrets are not
+// included.
+//
+// The URL parameters 'limit' and 'offset' can be used for paging, like for findContacts.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/webhooks
+func findWebhooks(c *gin.Context) {
+	limit, offset, success := parseLimitAndOffset(c)
+	if !success {
+		return
+	}
+	var rows []webhookRow
+	ctx := c.Request.Context()
+	err := db.SelectContext(ctx, &rows, `
+		SELECT *
+		FROM webhooks
+		WHERE tenant_id = ?
+		ORDER BY id
+		LIMIT ?
+		OFFSET ?`, tenant(c), limit, offset)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(rows) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "webhook not found"})
+		return
+	}
+	webhooks := make([]model.Webhook, len(rows))
+	for i, row := range rows {
+		webhooks[i] = row.toWebhook()
+	}
+	c.IndentedJSON(http.StatusOK, webhooks)
+}
+
+// findWebhookByID responds with the webhook whose ID value matches the id parameter of the request
+// URL. The secret is not included.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/webhooks/3
+func findWebhookByID(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	var rows []webhookRow
+	if err := db.SelectContext(c.Request.Context(), &rows, "SELECT * FROM webhooks WHERE id = ? AND tenant_id = ?", id, tenant(c)); err != nil {
+		log.Panicln(err)
+	}
+	if len(rows) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "webhook not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, rows[0].toWebhook())
+}
+
+// deleteWebhookByID removes the webhook whose ID value matches the id parameter of the request URL,
+// together with its deliveries.
+//
+// Example REST API call:
+//
+//	> curl http://localhost:8080/webhooks/3 --request "DELETE"
+func deleteWebhookByID(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	result, err := db.ExecContext(c.Request.Context(), "DELETE FROM webhooks WHERE id = ? AND tenant_id = ?", id, tenant(c))
+	if err != nil {
+		log.Panicln(err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		log.Panicln(err)
+	}
+	if rowsAffected == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "webhook not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "webhook deleted"})
+}
+
+// findWebhookDeliveries responds with the delivery log of the webhook whose ID value matches the id
+// parameter of the request URL, most recent delivery first.
+//
+// The URL parameter 'status' restricts the list to 'pending', 'succeeded' or 'failed' deliveries.
+// The URL parameters 'limit' and 'offset' can be used for paging, like for findContacts.
+//
+// Example REST API calls:
+//
+//	> curl http://localhost:8080/webhooks/3/deliveries
+//	> curl "http://localhost:8080/webhooks/3/deliveries?status=failed&limit=20"
+func findWebhookDeliveries(c *gin.Context) {
+	id, success := parseID(c)
+	if !success {
+		return
+	}
+	status := c.Query("status")
+	if status != "" && !contains([]string{deliveryPending, deliverySucceeded, deliveryFailed}, status) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid status parameter"})
+		return
+	}
+	limit, offset, success := parseLimitAndOffset(c)
+	if !success {
+		return
+	}
+	var deliveries []model.WebhookDelivery
+	ctx := c.Request.Context()
+	err := db.SelectContext(ctx, &deliveries, `
+		SELECT d.*
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.webhook_id = ? AND w.tenant_id = ? AND (? = '' OR d.status = ?)
+		ORDER BY d.id DESC
+		LIMIT ?
+		OFFSET ?`, id, tenant(c), status, status, limit, offset)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(deliveries) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "delivery not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, deliveries)
+}
+
+// toWebhook converts a webhook row into the webhook that is returned to clients, without its
+// secret.
+func (row webhookRow) toWebhook() model.Webhook {
+	return model.Webhook{
+		Id:        row.Id,
+		URL:       row.URL,
+		Events:    strings.Split(row.Events, ","),
+		CreatedAt: row.CreatedAt,
+	}
+}
+
+// enqueueWebhookDeliveries stores a delivery of the event for every webhook of the event's tenant
+// that subscribed to it. The deliveries are attempted by the webhook dispatcher. An event that was
+// already enqueued for a webhook, as identified by its key, is not enqueued again.
+func enqueueWebhookDeliveries(ctx context.Context, event events.Event) error {
+	name := webhookEventPrefix + event.Type
+	payload, err := json.Marshal(webhookPayload{
+		Event:     name,
+		Key:       event.Key,
+		ContactId: event.ContactId,
+		Contact:   event.Contact,
+		Time:      event.Time,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT IGNORE INTO webhook_deliveries (webhook_id, event, idempotency_key, payload, next_attempt_at)
+		SELECT id, ?, ?, ?, ?
+		FROM webhooks
+		WHERE tenant_id = ? AND FIND_IN_SET(?, events)`, name, event.Key, payload, time.Now().UTC(), event.TenantId, name)
+	return err
+}
+
+// DeliverDueWebhooks attempts all deliveries that are due, and schedules failed deliveries for
+// another attempt. It returns the number of attempted deliveries.
+func DeliverDueWebhooks(ctx context.Context, client *http.Client) (int, error) {
+	now := time.Now().UTC()
+	var due []dueDelivery
+	err := db.SelectContext(ctx, &due, `
+		SELECT d.id, d.event, d.idempotency_key, d.payload, d.attempts, w.url, w.secret
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = 'pending' AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT ?`, now, webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	attempted := 0
+	for _, delivery := range due {
+		// claim the delivery, so that other instances of the service do not attempt it as well
+		result, err := db.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET next_attempt_at = ?
+			WHERE id = ? AND status = 'pending' AND next_attempt_at <= ?`, now.Add(2*webhookTimeout), delivery.Id, now)
+		if err != nil {
+			return attempted, err
+		}
+		if claimed, err := result.RowsAffected(); err != nil || claimed == 0 {
+			continue
+		}
+		attempted++
+		statusCode, deliveryErr := sendWebhook(ctx, client, delivery)
+		if err := recordDeliveryAttempt(ctx, delivery, statusCode, deliveryErr); err != nil {
+			return attempted, err
+		}
+	}
+	return attempted, nil
+}
+
+// sendWebhook posts the payload of a delivery to the webhook. It returns the HTTP status code of
+// the response, and an error if the receiver did not accept the delivery.
+func sendWebhook(ctx context.Context, client *http.Client, delivery dueDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookEventHeader, delivery.Event)
+	request.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery.Id, 10))
+	request.Header.Set(idempotencyKeyHeader, delivery.Key)
+	request.Header.Set(webhookSignatureHeader, signWebhook(delivery.Secret, time.Now().Unix(), delivery.Payload))
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("receiver responded with status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// signWebhook returns the signature header value for a payload. It contains the time of signing
+// and the hex encoded HMAC-SHA256 of the time and the payload, keyed with the webhook's secret.
+// Receivers compute the same HMAC over '<t>.<payload>' and reject old timestamps to prevent
+// replays.
+func signWebhook(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// recordDeliveryAttempt records the outcome of an attempt in the delivery log. A failed delivery
+// is scheduled for another attempt with exponential backoff, until the maximum number of attempts
+// is reached.
+func recordDeliveryAttempt(ctx context.Context, delivery dueDelivery, statusCode int, deliveryErr error) error {
+	attempts := delivery.Attempts + 1
+	status := deliverySucceeded
+	nextAttemptAt := time.Now().UTC()
+	var code, message interface{}
+	if statusCode != 0 {
+		code = statusCode
+	}
+	if deliveryErr != nil {
+		message = truncate(deliveryErr.Error(), 500)
+		if attempts >= webhookMaxAttempts {
+			status = deliveryFailed
+		} else {
+			status = deliveryPending
+			nextAttemptAt = nextAttemptAt.Add(webhookBackoff(attempts))
+		}
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, next_attempt_at = ?, status_code = ?, error = ?
+		WHERE id = ?`, status, attempts, nextAttemptAt, code, message, delivery.Id)
+	return err
+}
+
+// webhookBackoff returns the time to wait after the specified number of failed attempts.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookInitialBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, webhookMaxBackoff)
+}
+
+// truncate shortens the string to at most the specified number of bytes.
+func truncate(str string, length int) string {
+	if len(str) <= length {
+		return str
+	}
+	return str[:length]
+}
+
+// WebhookSink is the outbox sink that turns events into deliveries to the webhooks that subscribed
+// to them.
+type WebhookSink struct{}
+
+// Deliver implements the OutboxSink interface.
+func (WebhookSink) Deliver(ctx context.Context, event events.Event) error {
+	return enqueueWebhookDeliveries(ctx, event)
+}
+
+// StartWebhookDispatcher starts a background job that attempts the due webhook deliveries until
+// the context is cancelled.
+func StartWebhookDispatcher(ctx context.Context) {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		client := &http.Client{}
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+		for {
+			if _, err := DeliverDueWebhooks(ctx, client); err != nil && ctx.Err() == nil {
+				log.Println("could not deliver webhooks:", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/events"
+	"gitlab.com/dirk.krummacker/contacts-service/internal/model"
+)
+
+// expectDueDelivery instructs the mock object to expect that the due deliveries are selected and
+// that the delivery to the URL is claimed.
+func expectDueDelivery(mock sqlmock.Sqlmock, url string, attempts int) {
+	rows := mock.NewRows([]string{"id", "event", "idempotency_key", "payload", "attempts", "url", "secret"}).
+		AddRow(5, "contact.created", "9f86d081884c7d659a2feaa0c55ad015",
+			[]byte(`{"event":"contact.created","contact_id":42}`), attempts, url, "s3cr3t")
+	mock.ExpectQuery("SELECT d.id, d.event, d.idempotency_key, d.payload, d.attempts, w.url, w.secret FROM webhook_deliveries d").
+		WillReturnRows(rows)
+	mock.ExpectExec("UPDATE webhook_deliveries SET next_attempt_at = \\? WHERE id = \\? AND status = 'pending'").
+		WithArgs(sqlmock.AnyArg(), int64(5), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+}
+
+// TestCreateWebhook executes a POST request for a new webhook without a secret. It expects that
+// the webhook is stored with a generated secret, and that the secret is returned.
+func TestCreateWebhook(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	mock.ExpectExec("INSERT INTO webhooks").
+		WithArgs(defaultTenant, "https://billing.example.com/hooks", sqlmock.AnyArg(), "contact.created,contact.deleted").
+		WillReturnResult(sqlmock.NewResult(3, 1))
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "POST", "/webhooks", strings.NewReader(
+		`{"url": "https://billing.example.com/hooks", "events": ["contact.created", "contact.deleted"]}`))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var webhook model.Webhook
+	json.Unmarshal(recorder.Body.Bytes(), &webhook)
+	assert.Equal(t, int64(3), webhook.Id)
+	assert.Equal(t, 64, len(webhook.Secret))
+	assert.Equal(t, []string{"contact.created", "contact.deleted"}, webhook.Events)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestCreateWebhookInvalidBodies executes POST requests for new webhooks with invalid bodies. It
+// expects that the HTTP requests are answered with the BAD REQUEST status code.
+func TestCreateWebhookInvalidBodies(t *testing.T) {
+	invalidRequestBodies := []string{
+		"not JSON",
+		`{"events": ["contact.created"]}`,
+		`{"url": "ftp://example.com", "events": ["contact.created"]}`,
+		`{"url": "/hooks", "events": ["contact.created"]}`,
+		`{"url": "https://example.com"}`,
+		`{"url": "https://example.com", "events": ["contact.renamed"]}`,
+		`{"url": "https://example.com", "events": ["contact.created"], "secret": "` + strings.Repeat("x", 101) + `"}`,
+	}
+	for _, body := range invalidRequestBodies {
+		db, mock := createMockObjects(t)
+		defer db.Close()
+
+		// Define expectations on SQL statements
+		expectPreparedStatements(mock) // we expect that the call will fail before the SQL statements
+		expectAdminKeyLookup(mock)
+
+		// Run test and compare results
+		recorder := runAdminTest(db, "POST", "/webhooks", strings.NewReader(body))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "request body: "+body)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+// TestGetWebhooks executes a GET request for all webhooks. It expects that the webhooks are
+// returned without their secrets.
+func TestGetWebhooks(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	rows := mock.NewRows([]string{"id", "url", "secret", "events", "created_at"}).
+		AddRow(3, "https://billing.example.com/hooks", "s3cr3t", "contact.created,contact.deleted", createdAt)
+	mock.ExpectQuery("SELECT \\* FROM webhooks WHERE tenant_id = \\? ORDER BY id").
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "GET", "/webhooks", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "s3cr3t")
+	var webhooks []model.Webhook
+	json.Unmarshal(recorder.Body.Bytes(), &webhooks)
+	assert.Equal(t, 1, len(webhooks))
+	assert.Equal(t, []string{"contact.created", "contact.deleted"}, webhooks[0].Events)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestDeleteWebhookNotFound executes a DELETE request for a webhook that does not exist. It
+// expects that the HTTP request is answered with the NOT FOUND status code.
+func TestDeleteWebhookNotFound(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	mock.ExpectExec("DELETE FROM webhooks WHERE id = \\? AND tenant_id = \\?").
+		WithArgs(int64(9999), defaultTenant).
+		WillReturnResult(sqlmock.NewResult(-1, 0))
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "DELETE", "/webhooks/9999", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestGetWebhookDeliveries executes a GET request for the failed deliveries of a webhook. It
+// expects that the delivery log is returned.
+func TestGetWebhookDeliveries(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectAdminKeyLookup(mock)
+	rows := mock.NewRows([]string{"id", "webhook_id", "event", "payload", "status", "attempts", "status_code", "error"}).
+		AddRow(5, 3, "contact.created", []byte(`{"contact_id":42}`), "failed", 8, 503, "receiver responded with status 503")
+	mock.ExpectQuery("SELECT d.\\* FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE d.webhook_id = \\? AND w.tenant_id = \\?").
+		WithArgs(int64(3), defaultTenant, "failed", "failed", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(rows)
+
+	// Run test and compare results
+	recorder := runAdminTest(db, "GET", "/webhooks/3/deliveries?status=failed", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var deliveries []model.WebhookDelivery
+	json.Unmarshal(recorder.Body.Bytes(), &deliveries)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, 503, *deliveries[0].StatusCode)
+	assert.JSONEq(t, `{"contact_id":42}`, string(deliveries[0].Payload))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestEnqueueWebhookDeliveries relays an event to the webhook sink. It expects that a delivery is
+// stored for all webhooks of the event's tenant that subscribed to the event, unless it was stored
+// before.
+func TestEnqueueWebhookDeliveries(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	mock.ExpectExec("INSERT IGNORE INTO webhook_deliveries \\(webhook_id, event, idempotency_key, payload, next_attempt_at\\) SELECT").
+		WithArgs("contact.deleted", "9f86d081884c7d659a2feaa0c55ad015", sqlmock.AnyArg(), sqlmock.AnyArg(), "acme", "contact.deleted").
+		WillReturnResult(sqlmock.NewResult(7, 2))
+
+	// Run test and compare results
+	initializeContactsService(db)
+	err := WebhookSink{}.Deliver(context.Background(),
+		events.Event{Key: "9f86d081884c7d659a2feaa0c55ad015", TenantId: "acme", Type: events.Deleted, ContactId: 42})
+	assert.Nil(t, err)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestDeliverWebhook delivers an event to a local receiver. It expects that the receiver gets the
+// payload with a valid signature, and that the delivery is recorded as succeeded.
+func TestDeliverWebhook(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	var received *http.Request
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectDueDelivery(mock, receiver.URL, 0)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\?, attempts = \\?").
+		WithArgs("succeeded", 1, sqlmock.AnyArg(), http.StatusNoContent, nil, int64(5)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+
+	// Run test and compare results
+	initializeContactsService(db)
+	attempted, err := DeliverDueWebhooks(context.Background(), receiver.Client())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempted)
+	assert.JSONEq(t, `{"event":"contact.created","contact_id":42}`, string(body))
+	assert.Equal(t, "contact.created", received.Header.Get("X-Webhook-Event"))
+	assert.Equal(t, "5", received.Header.Get("X-Webhook-Delivery"))
+	assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015", received.Header.Get("Idempotency-Key"))
+	signature := received.Header.Get("X-Webhook-Signature")
+	var timestamp int64
+	_, scanErr := fmt.Sscanf(signature, "t=%d,", &timestamp)
+	assert.Nil(t, scanErr)
+	assert.Equal(t, signWebhook("s3cr3t", timestamp, body), signature)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestDeliverWebhookRetry delivers an event to a local receiver that fails. It expects that the
+// delivery is scheduled for another attempt with backoff.
+func TestDeliverWebhookRetry(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectDueDelivery(mock, receiver.URL, 2)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\?, attempts = \\?").
+		WithArgs("pending", 3, nextAttemptAfter{time.Now().Add(webhookInitialBackoff * 4)}, http.StatusServiceUnavailable,
+			"receiver responded with status 503", int64(5)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+
+	// Run test and compare results
+	initializeContactsService(db)
+	attempted, err := DeliverDueWebhooks(context.Background(), receiver.Client())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempted)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestDeliverWebhookGiveUp delivers an event to a receiver that is not reachable for the last
+// time. It expects that the delivery is recorded as failed.
+func TestDeliverWebhookGiveUp(t *testing.T) {
+	db, mock := createMockObjects(t)
+	defer db.Close()
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := receiver.URL
+	receiver.Close()
+
+	// Define expectations on SQL statements
+	expectPreparedStatements(mock)
+	expectDueDelivery(mock, url, webhookMaxAttempts-1)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\?, attempts = \\?").
+		WithArgs("failed", webhookMaxAttempts, sqlmock.AnyArg(), nil, sqlmock.AnyArg(), int64(5)).
+		WillReturnResult(sqlmock.NewResult(-1, 1))
+
+	// Run test and compare results
+	initializeContactsService(db)
+	attempted, err := DeliverDueWebhooks(context.Background(), http.DefaultClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempted)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestWebhookBackoff verifies that the time between attempts doubles, up to a maximum.
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, webhookInitialBackoff, webhookBackoff(1))
+	assert.Equal(t, 2*webhookInitialBackoff, webhookBackoff(2))
+	assert.Equal(t, 8*webhookInitialBackoff, webhookBackoff(4))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(100))
+}
+
+// nextAttemptAfter matches a time argument that is about the expected point in time.
+type nextAttemptAfter struct {
+	expected time.Time
+}
+
+// Match implements the sqlmock.Argument interface.
+func (matcher nextAttemptAfter) Match(value driver.Value) bool {
+	actual, ok := value.(time.Time)
+	return ok && actual.Sub(matcher.expected).Abs() < 5*time.Second
+}
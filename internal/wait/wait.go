@@ -0,0 +1,267 @@
+// Package wait waits until the dependencies of a process are available, for example until a
+// service reports that it is ready, a port accepts connections or a database answers.
+//
+// All dependencies are checked at the same time. A check that fails is repeated with exponential
+// backoff and jitter, so that many waiting processes do not hit a dependency in lockstep, until it
+// succeeds or the overall time is up.
+package wait
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// maxBodySize is the maximum size of a response body that is inspected.
+const maxBodySize = 1 << 20
+
+// Dependency is something that a process needs before it can start.
+type Dependency interface {
+	// String describes the dependency in messages, without secrets.
+	String() string
+	// Check returns nil if the dependency is available, and the reason otherwise.
+	Check(ctx context.Context) error
+}
+
+// HTTPEndpoint is available if a GET request returns one of the Statuses, which default to 200,
+// and a JSON body in which every path of Fields has the expected value. A path names nested
+// fields separated by dots, for example 'components.database.status'.
+type HTTPEndpoint struct {
+	URL      string
+	Statuses []int
+	Fields   map[string]string
+	Client   *http.Client
+}
+
+// String implements the Dependency interface.
+func (endpoint HTTPEndpoint) String() string {
+	return endpoint.URL
+}
+
+// Check implements the Dependency interface.
+func (endpoint HTTPEndpoint) Check(ctx context.Context) error {
+	client := endpoint.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.URL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	statuses := endpoint.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusOK}
+	}
+	if !slices.Contains(statuses, response.StatusCode) {
+		return fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+	if len(endpoint.Fields) == 0 {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxBodySize))
+	if err != nil {
+		return err
+	}
+	var document any
+	if err := json.Unmarshal(body, &document); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	paths := make([]string, 0, len(endpoint.Fields))
+	for path := range endpoint.Fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		value, found := lookup(document, path)
+		if !found {
+			return fmt.Errorf("field '%s' is missing", path)
+		}
+		if value != endpoint.Fields[path] {
+			return fmt.Errorf("field '%s' is '%s' instead of '%s'", path, value, endpoint.Fields[path])
+		}
+	}
+	return nil
+}
+
+// lookup returns the value at the dotted path in the JSON document, formatted as a string.
+func lookup(document any, path string) (string, bool) {
+	value := document
+	for _, key := range strings.Split(path, ".") {
+		object, isObject := value.(map[string]any)
+		if !isObject {
+			return "", false
+		}
+		var found bool
+		if value, found = object[key]; !found {
+			return "", false
+		}
+	}
+	if value == nil {
+		return "null", true
+	}
+	return fmt.Sprint(value), true
+}
+
+// TCPPort is available if it accepts connections. Address is a host and port like 'mysql:3306'.
+type TCPPort struct {
+	Address string
+}
+
+// String implements the Dependency interface.
+func (port TCPPort) String() string {
+	return "tcp://" + port.Address
+}
+
+// Check implements the Dependency interface.
+func (port TCPPort) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	connection, err := dialer.DialContext(ctx, "tcp", port.Address)
+	if err != nil {
+		return err
+	}
+	return connection.Close()
+}
+
+// MySQL is available if the database with the data source name answers a ping, which requires
+// that the credentials are valid and the database exists.
+type MySQL struct {
+	DSN string
+}
+
+// String implements the Dependency interface. The password is left out.
+func (database MySQL) String() string {
+	config, err := mysql.ParseDSN(database.DSN)
+	if err != nil {
+		return "mysql"
+	}
+	return fmt.Sprintf("mysql://%s@%s/%s", config.User, config.Addr, config.DBName)
+}
+
+// Check implements the Dependency interface.
+func (database MySQL) Check(ctx context.Context) error {
+	db, err := sql.Open("mysql", database.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.PingContext(ctx)
+}
+
+// Backoff computes the time between two checks of a dependency. The time starts at Initial and
+// doubles after every failed check, up to Max. A random part of up to half of it is left out.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Delay returns the time to wait after the specified number of failed checks, given a random
+// number between 0 and 1.
+func (backoff Backoff) Delay(failures int, random float64) time.Duration {
+	delay := backoff.Initial
+	for i := 1; i < failures && delay < backoff.Max; i++ {
+		delay *= 2
+	}
+	delay = min(delay, backoff.Max)
+	return delay/2 + time.Duration(random*float64(delay/2))
+}
+
+// Waiter waits for dependencies. Every check may take up to CheckTimeout. Log receives a line for
+// every failed check.
+type Waiter struct {
+	Backoff      Backoff
+	CheckTimeout time.Duration
+	Log          func(format string, args ...any)
+}
+
+// Wait checks the dependencies until all of them are available, and returns nil then. If the
+// context ends before, it returns an error that names the dependencies that are not available,
+// with the reason of their last failed check.
+func (waiter Waiter) Wait(ctx context.Context, dependencies ...Dependency) error {
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	unavailable := make(map[int]error)
+	for i, dependency := range dependencies {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			if err := waiter.waitFor(ctx, dependency); err != nil {
+				mutex.Lock()
+				unavailable[i] = err
+				mutex.Unlock()
+			}
+		}()
+	}
+	waitGroup.Wait()
+	if len(unavailable) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(unavailable))
+	for i, dependency := range dependencies {
+		if err, found := unavailable[i]; found {
+			messages = append(messages, fmt.Sprintf("%s: %s", dependency, err))
+		}
+	}
+	return errors.New("not available: " + strings.Join(messages, "; "))
+}
+
+// waitFor checks the dependency until it is available or the context ends. It returns the reason
+// of the last failed check in the latter case.
+func (waiter Waiter) waitFor(ctx context.Context, dependency Dependency) error {
+	var lastErr error
+	for failures := 1; ; failures++ {
+		err := waiter.check(ctx, dependency)
+		if err == nil {
+			waiter.log("%s is available", dependency)
+			return nil
+		}
+		if ctx.Err() != nil && lastErr != nil {
+			// the check was cut off by the end of the context, the previous reason is more useful
+			return lastErr
+		}
+		lastErr = err
+		delay := waiter.Backoff.Delay(failures, rand.Float64())
+		waiter.log("%s is not available (%s), checking again in %s", dependency, err, delay.Round(time.Millisecond))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return lastErr
+		case <-timer.C:
+		}
+	}
+}
+
+// check checks the dependency once, within the check timeout.
+func (waiter Waiter) check(ctx context.Context, dependency Dependency) error {
+	if waiter.CheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, waiter.CheckTimeout)
+		defer cancel()
+	}
+	return dependency.Check(ctx)
+}
+
+// log writes a line to the log, if there is one.
+func (waiter Waiter) log(format string, args ...any) {
+	if waiter.Log != nil {
+		waiter.Log(format, args...)
+	}
+}
@@ -0,0 +1,122 @@
+package wait
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fastBackoff keeps tests short.
+var fastBackoff = Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond}
+
+// TestBackoffDelay verifies that the delay doubles after every failure up to the maximum, and that
+// the jitter leaves out up to half of it.
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Initial: time.Second, Max: 10 * time.Second}
+	assert.Equal(t, time.Second, backoff.Delay(1, 1))
+	assert.Equal(t, 2*time.Second, backoff.Delay(2, 1))
+	assert.Equal(t, 8*time.Second, backoff.Delay(4, 1))
+	assert.Equal(t, 10*time.Second, backoff.Delay(5, 1))
+	assert.Equal(t, 10*time.Second, backoff.Delay(100, 1))
+	assert.Equal(t, 5*time.Second, backoff.Delay(100, 0))
+	assert.Equal(t, 500*time.Millisecond, backoff.Delay(1, 0))
+}
+
+// TestHTTPEndpoint verifies that endpoints are available if they respond with an expected status
+// code and the expected JSON fields.
+func TestHTTPEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/readyz":
+			w.Write([]byte(`{"status": "ready", "components": {"database": {"status": "up"}}}`))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write([]byte("no JSON"))
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	assert.Nil(t, HTTPEndpoint{URL: server.URL + "/readyz"}.Check(ctx))
+	assert.Nil(t, HTTPEndpoint{URL: server.URL + "/readyz", Fields: map[string]string{
+		"status": "ready", "components.database.status": "up"}}.Check(ctx))
+	assert.EqualError(t, HTTPEndpoint{URL: server.URL + "/readyz", Fields: map[string]string{
+		"components.schema.status": "up"}}.Check(ctx), "field 'components.schema.status' is missing")
+	assert.EqualError(t, HTTPEndpoint{URL: server.URL + "/readyz", Fields: map[string]string{
+		"status": "draining"}}.Check(ctx), "field 'status' is 'ready' instead of 'draining'")
+	assert.EqualError(t, HTTPEndpoint{URL: server.URL + "/missing"}.Check(ctx), "unexpected status code 404")
+	assert.Nil(t, HTTPEndpoint{URL: server.URL + "/missing", Statuses: []int{200, 404}}.Check(ctx))
+	assert.NotNil(t, HTTPEndpoint{URL: server.URL + "/other", Fields: map[string]string{"status": "ready"}}.Check(ctx))
+}
+
+// TestTCPPort verifies that a port is available while it accepts connections.
+func TestTCPPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	port := TCPPort{Address: listener.Addr().String()}
+	assert.Nil(t, port.Check(context.Background()))
+	listener.Close()
+	assert.NotNil(t, port.Check(context.Background()))
+}
+
+// TestMySQLString verifies that the description of a database does not contain the password.
+func TestMySQLString(t *testing.T) {
+	database := MySQL{DSN: "dirk:bullo92@tcp(localhost:3306)/test?parseTime=true"}
+	assert.Equal(t, "mysql://dirk@localhost:3306/test", database.String())
+}
+
+// flakyDependency is available from the specified check on.
+type flakyDependency struct {
+	checks      atomic.Int32
+	availableAt int32
+}
+
+// String implements the Dependency interface.
+func (dependency *flakyDependency) String() string {
+	return "flaky"
+}
+
+// Check implements the Dependency interface.
+func (dependency *flakyDependency) Check(ctx context.Context) error {
+	if dependency.checks.Add(1) < dependency.availableAt {
+		return errors.New("starting")
+	}
+	return nil
+}
+
+// TestWait verifies that the waiter checks all dependencies again until they are available.
+func TestWait(t *testing.T) {
+	first := &flakyDependency{availableAt: 3}
+	second := &flakyDependency{availableAt: 1}
+	var lines atomic.Int32
+	waiter := Waiter{Backoff: fastBackoff, Log: func(string, ...any) { lines.Add(1) }}
+
+	err := waiter.Wait(context.Background(), first, second)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), first.checks.Load())
+	assert.Equal(t, int32(1), second.checks.Load())
+	assert.Equal(t, int32(4), lines.Load())
+}
+
+// TestWaitTimeout verifies that the waiter gives up when the context ends, and names the
+// dependencies that are not available with the reason of their last failed check.
+func TestWaitTimeout(t *testing.T) {
+	available := &flakyDependency{availableAt: 1}
+	unavailable := &flakyDependency{availableAt: 1000000}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := Waiter{Backoff: fastBackoff}.Wait(ctx, available, unavailable)
+	assert.EqualError(t, err, "not available: flaky: starting")
+	assert.Greater(t, unavailable.checks.Load(), int32(1))
+}
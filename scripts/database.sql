@@ -1,15 +1,160 @@
+DROP TABLE IF EXISTS contact_shares;
+
 DROP TABLE IF EXISTS contacts;
 
 CREATE TABLE contacts (
     id          INT AUTO_INCREMENT PRIMARY KEY,
+    tenant_id   VARCHAR(64) NOT NULL DEFAULT 'default',
+    owner       VARCHAR(100),
     firstname   VARCHAR(50),
     lastname    VARCHAR(50),
     phone       VARCHAR(50),
-    birthday    DATE
+    birthday    DATE,
+    vip         BOOLEAN NOT NULL DEFAULT FALSE,
+    version     INT NOT NULL DEFAULT 1,
+    created_at  DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    updated_at  DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+    deleted_at  DATETIME(6)
 );
 
 CREATE INDEX contacts_firstname
-    ON contacts (firstname);
+    ON contacts (tenant_id, firstname);
 
 CREATE INDEX contacts_lastname
-    ON contacts (lastname);
\ No newline at end of file
+    ON contacts (tenant_id, lastname);
+
+CREATE INDEX contacts_updated_at
+    ON contacts (tenant_id, updated_at);
+
+CREATE INDEX contacts_deleted_at
+    ON contacts (tenant_id, deleted_at);
+
+CREATE INDEX contacts_owner
+    ON contacts (tenant_id, owner);
+
+CREATE TABLE contact_shares (
+    contact_id      INT NOT NULL,
+    grantee         VARCHAR(100) NOT NULL,
+    permission      VARCHAR(5) NOT NULL,
+    created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    PRIMARY KEY (contact_id, grantee),
+    FOREIGN KEY (contact_id) REFERENCES contacts (id) ON DELETE CASCADE
+);
+
+CREATE INDEX contact_shares_grantee
+    ON contact_shares (grantee, contact_id);
+
+DROP TABLE IF EXISTS audit_log;
+
+CREATE TABLE audit_log (
+    id              INT AUTO_INCREMENT PRIMARY KEY,
+    tenant_id       VARCHAR(64) NOT NULL DEFAULT 'default',
+    contact_id      INT NOT NULL,
+    action          VARCHAR(10) NOT NULL,
+    version         INT NOT NULL,
+    before_value    JSON,
+    after_value     JSON,
+    merged_ids      JSON,
+    actor           VARCHAR(100) NOT NULL,
+    request_id      VARCHAR(64) NOT NULL,
+    created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE INDEX audit_log_contact_id
+    ON audit_log (tenant_id, contact_id, id);
+
+CREATE INDEX audit_log_tenant_id
+    ON audit_log (tenant_id, id);
+
+DROP TABLE IF EXISTS webhook_deliveries;
+
+DROP TABLE IF EXISTS webhooks;
+
+CREATE TABLE webhooks (
+    id              INT AUTO_INCREMENT PRIMARY KEY,
+    tenant_id       VARCHAR(64) NOT NULL DEFAULT 'default',
+    url             VARCHAR(2048) NOT NULL,
+    secret          VARCHAR(100) NOT NULL,
+    events          VARCHAR(100) NOT NULL,
+    created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE INDEX webhooks_tenant_id
+    ON webhooks (tenant_id, id);
+
+CREATE TABLE webhook_deliveries (
+    id              INT AUTO_INCREMENT PRIMARY KEY,
+    webhook_id      INT NOT NULL,
+    event           VARCHAR(20) NOT NULL,
+    idempotency_key CHAR(32) NOT NULL,
+    payload         JSON NOT NULL,
+    status          VARCHAR(10) NOT NULL DEFAULT 'pending',
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME(6) NOT NULL,
+    status_code     INT,
+    error           VARCHAR(500),
+    created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    updated_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+    UNIQUE KEY webhook_deliveries_idempotency_key (webhook_id, idempotency_key),
+    FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+
+CREATE INDEX webhook_deliveries_due
+    ON webhook_deliveries (status, next_attempt_at);
+
+CREATE INDEX webhook_deliveries_webhook_id
+    ON webhook_deliveries (webhook_id, id);
+
+DROP TABLE IF EXISTS outbox;
+
+CREATE TABLE outbox (
+    id              INT AUTO_INCREMENT PRIMARY KEY,
+    idempotency_key CHAR(32) NOT NULL UNIQUE,
+    tenant_id       VARCHAR(64) NOT NULL DEFAULT 'default',
+    owner           VARCHAR(100) NOT NULL DEFAULT '',
+    event_type      VARCHAR(10) NOT NULL,
+    contact_id      INT NOT NULL,
+    payload         JSON,
+    created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    dispatched_at   DATETIME(6)
+);
+
+CREATE INDEX outbox_dispatched_at
+    ON outbox (dispatched_at, id);
+
+CREATE INDEX outbox_created_at
+    ON outbox (created_at);
+
+DROP TABLE IF EXISTS idempotency_keys;
+
+CREATE TABLE idempotency_keys (
+    tenant_id       VARCHAR(64) NOT NULL DEFAULT 'default',
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash    CHAR(64) NOT NULL,
+    status_code     INT NOT NULL,
+    etag            VARCHAR(100),
+    response        JSON NOT NULL,
+    created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    PRIMARY KEY (tenant_id, idempotency_key)
+);
+
+CREATE INDEX idempotency_keys_created_at
+    ON idempotency_keys (created_at);
+
+DROP TABLE IF EXISTS api_keys;
+
+CREATE TABLE api_keys (
+    id              INT AUTO_INCREMENT PRIMARY KEY,
+    tenant_id       VARCHAR(64) NOT NULL DEFAULT 'default',
+    name            VARCHAR(100) NOT NULL,
+    prefix          VARCHAR(12) NOT NULL,
+    key_hash        CHAR(64) NOT NULL UNIQUE,
+    scopes          VARCHAR(100) NOT NULL,
+    roles           VARCHAR(255) NOT NULL DEFAULT '',
+    created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    last_used_at    DATETIME(6),
+    revoked_at      DATETIME(6)
+);
+
+CREATE INDEX api_keys_tenant_id
+    ON api_keys (tenant_id, id);